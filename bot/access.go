@@ -0,0 +1,365 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"openai-discord-bot/bot/storage"
+)
+
+// Access rules either allow or deny a feature
+const (
+	allowEffect = "allow"
+	denyEffect  = "deny"
+)
+
+// allFeatures is a rule feature that matches chat and images alike
+const allFeatures = "all"
+
+// The scopes an access rule can apply to. Rules on the guild, a category or a channel decide where the bot can be
+// used, rules on a role or a user decide who can use it. The @everyone role shares its ID with the guild
+const (
+	guildRule    = "guild"
+	categoryRule = "category"
+	channelRule  = "channel"
+	roleRule     = "role"
+	userRule     = "user"
+)
+
+// accessSubject is everything about a request that access rules can match
+type accessSubject struct {
+	guildID    string
+	categoryID string
+	// channelIDs is the channel a request was made in, and its parent channel if it's a thread
+	channelIDs []string
+	roleIDs    []string
+	userID     string
+}
+
+// locationRank is how specific a rule about where the bot is used is for subject, or zero if it doesn't apply
+func (s accessSubject) locationRank(rule storage.AccessRule) int {
+	switch {
+	case rule.Scope == guildRule:
+		return 1
+	case rule.Scope == categoryRule && rule.ID == s.categoryID:
+		return 2
+	case rule.Scope == channelRule && slices.Contains(s.channelIDs, rule.ID):
+		return 3
+	}
+	return 0
+}
+
+// identityRank is how specific a rule about who uses the bot is for subject, or zero if it doesn't apply
+func (s accessSubject) identityRank(rule storage.AccessRule) int {
+	switch {
+	case rule.Scope == roleRule && rule.ID == s.guildID:
+		return 1
+	case rule.Scope == roleRule && slices.Contains(s.roleIDs, rule.ID):
+		return 2
+	case rule.Scope == userRule && rule.ID == s.userID:
+		return 3
+	}
+	return 0
+}
+
+// evaluatePolicy decides whether policy allows subject to use feature. Rules about where the bot is used and rules about
+// who is using it are weighed separately, and both have to allow it
+func evaluatePolicy(policy storage.AccessPolicy, feature string, subject accessSubject) bool {
+	return decide(policy.Rules, feature, subject.locationRank) && decide(policy.Rules, feature, subject.identityRank)
+}
+
+// decide picks the rule that applies to feature, preferring the most specific scope, then rules for the feature itself
+// over rules for all features, then denying over allowing. Without any rule that applies, the feature is allowed
+func decide(rules []storage.AccessRule, feature string, rank func(storage.AccessRule) int) bool {
+	var best *storage.AccessRule
+	var bestWeight int
+	for i, rule := range rules {
+		if rule.Feature != feature && rule.Feature != allFeatures {
+			continue
+		}
+		scopeRank := rank(rule)
+		if scopeRank == 0 {
+			continue
+		}
+
+		weight := scopeRank * 4
+		if rule.Feature == feature {
+			weight += 2
+		}
+		if rule.Effect != allowEffect {
+			weight++
+		}
+		if best == nil || weight > bestWeight {
+			best, bestWeight = &rules[i], weight
+		}
+	}
+	return best == nil || best.Effect == allowEffect
+}
+
+// describeRule explains a rule in a form discord will render, e.g. "deny image for @role"
+func describeRule(guildID string, rule storage.AccessRule) string {
+	target := "the whole server"
+	switch {
+	case rule.Scope == roleRule && rule.ID == guildID:
+		target = "@everyone"
+	case rule.Scope == roleRule:
+		target = fmt.Sprintf("<@&%s>", rule.ID)
+	case rule.Scope == userRule:
+		target = fmt.Sprintf("<@%s>", rule.ID)
+	case rule.Scope == channelRule || rule.Scope == categoryRule:
+		target = fmt.Sprintf("%s <#%s>", rule.Scope, rule.ID)
+	}
+	return fmt.Sprintf("%s %s for %s", rule.Effect, rule.Feature, target)
+}
+
+// accessPolicies keeps each guild's access policy, caching them for a short while so that checking every request
+// doesn't mean a trip to the store. Guilds can also be allowed or denied outright by configuration
+type accessPolicies struct {
+	store         storage.AccessPolicyStore
+	ttl           time.Duration
+	allowedGuilds []string
+	deniedGuilds  []string
+
+	mu     sync.Mutex
+	cached map[string]cachedPolicy
+}
+
+type cachedPolicy struct {
+	policy   storage.AccessPolicy
+	loadedAt time.Time
+}
+
+// newAccessPolicies reads ALLOWED_GUILDS, DENIED_GUILDS and ACCESS_POLICY_CACHE_TTL settings
+func newAccessPolicies(store storage.AccessPolicyStore) *accessPolicies {
+	return &accessPolicies{
+		store:         store,
+		ttl:           viper.GetDuration("ACCESS_POLICY_CACHE_TTL"),
+		allowedGuilds: viper.GetStringSlice("ALLOWED_GUILDS"),
+		deniedGuilds:  viper.GetStringSlice("DENIED_GUILDS"),
+		cached:        make(map[string]cachedPolicy),
+	}
+}
+
+// guildAllowed applies the configured guild lists, direct messages aren't in a guild so they're always allowed
+func (a *accessPolicies) guildAllowed(guildID string) bool {
+	if guildID == "" {
+		return true
+	}
+	if slices.Contains(a.deniedGuilds, guildID) {
+		return false
+	}
+	return len(a.allowedGuilds) == 0 || slices.Contains(a.allowedGuilds, guildID)
+}
+
+// Policy returns a guild's access policy, from the cache if it was loaded recently
+func (a *accessPolicies) Policy(ctx context.Context, guildID string) (storage.AccessPolicy, error) {
+	a.mu.Lock()
+	cached, ok := a.cached[guildID]
+	a.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < a.ttl {
+		return cached.policy, nil
+	}
+
+	policy, err := a.store.GetAccessPolicy(ctx, guildID)
+	if err != nil {
+		return storage.AccessPolicy{}, fmt.Errorf("failed to load access policy: %w", err)
+	}
+	if policy == nil {
+		policy = &storage.AccessPolicy{}
+	}
+	a.remember(guildID, *policy)
+	return *policy, nil
+}
+
+// Update changes a guild's access policy, starting from the stored policy rather than a cached one. update can be
+// called more than once, if another change to the policy gets in first
+func (a *accessPolicies) Update(ctx context.Context, guildID string, update func(policy *storage.AccessPolicy)) error {
+	var updated storage.AccessPolicy
+	err := a.store.UpdateAccessPolicy(ctx, guildID, func(policy *storage.AccessPolicy) error {
+		update(policy)
+		updated = *policy
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update access policy: %w", err)
+	}
+	a.remember(guildID, updated)
+	return nil
+}
+
+func (a *accessPolicies) remember(guildID string, policy storage.AccessPolicy) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cached[guildID] = cachedPolicy{policy: policy, loadedAt: time.Now()}
+}
+
+// channel looks a channel up in the state cache, falling back to asking discord
+func (b *AIBot) channel(ctx context.Context, channelID string) (*discordgo.Channel, error) {
+	if ch, err := b.discordSession.State.Channel(channelID); err == nil {
+		return ch, nil
+	}
+	return b.discordSession.Channel(channelID, discordgo.WithContext(ctx))
+}
+
+// accessSubject works out where a request was made and by whom
+func (b *AIBot) accessSubject(ctx context.Context, req *request) accessSubject {
+	subject := accessSubject{
+		guildID:    req.guildID,
+		channelIDs: []string{req.channelID},
+		userID:     req.author.ID,
+	}
+	if req.member != nil {
+		subject.roleIDs = req.member.Roles
+	}
+
+	ch, err := b.channel(ctx, req.channelID)
+	if err != nil {
+		return subject
+	}
+	subject.categoryID = ch.ParentID
+	if ch.IsThread() {
+		subject.channelIDs = append(subject.channelIDs, ch.ParentID)
+		subject.categoryID = ""
+		if parent, err := b.channel(ctx, ch.ParentID); err == nil {
+			subject.categoryID = parent.ParentID
+		}
+	}
+	return subject
+}
+
+// allowed checks whether a request may use feature where it was made. It's checked before any call to OpenAI, and
+// fails closed, if the policy can't be loaded the request is refused
+func (b *AIBot) allowed(ctx context.Context, req *request, feature string) bool {
+	logger := slog.Default().WithGroup("allowed")
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "checkAccess")
+	defer span.End()
+	span.SetAttributes(attribute.String("feature", feature))
+
+	allowed := b.access.guildAllowed(req.guildID)
+	if allowed && req.guildID != "" {
+		policy, err := b.access.Policy(ctx, req.guildID)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			logger.ErrorContext(ctx, "failed to check access policy", slog.Any("error", err))
+			return false
+		}
+		allowed = evaluatePolicy(policy, feature, b.accessSubject(ctx, req))
+	}
+
+	span.SetAttributes(attribute.Bool("allowed", allowed))
+	span.SetStatus(codes.Ok, "Success")
+	return allowed
+}
+
+// accessCommand lets guild managers edit the access policy with /access allow, deny, remove and list
+func (b *AIBot) accessCommand(ctx context.Context, req *request, data discordgo.ApplicationCommandInteractionData) error {
+	reply := b.responderFor(ctx, req, req.channelID)
+	// Mentions in these replies are only there to name things, they shouldn't notify anyone
+	send := func(content string) error {
+		_, err := reply.Send(ctx, &discordgo.MessageSend{Content: content, AllowedMentions: &discordgo.MessageAllowedMentions{}})
+		return err
+	}
+
+	if req.guildID == "" {
+		return send("Access rules only apply in servers")
+	}
+	if req.member == nil || req.member.Permissions&discordgo.PermissionManageGuild == 0 {
+		return send("Only server managers can change where I'm allowed")
+	}
+	if len(data.Options) == 0 {
+		return send("I don't know how to do that")
+	}
+
+	subcommand := data.Options[0]
+	options := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(subcommand.Options))
+	for _, option := range subcommand.Options {
+		options[option.Name] = option
+	}
+
+	if subcommand.Name == "list" {
+		policy, err := b.access.Policy(ctx, req.guildID)
+		if err != nil {
+			_ = send("Whoops something went wrong processing that")
+			return err
+		}
+		if len(policy.Rules) == 0 {
+			return send("There aren't any access rules, I'll answer anyone anywhere")
+		}
+		lines := make([]string, 0, len(policy.Rules))
+		for _, rule := range policy.Rules {
+			lines = append(lines, "- "+describeRule(req.guildID, rule))
+		}
+		return send(strings.Join(lines, "\n"))
+	}
+
+	rule := storage.AccessRule{
+		Effect:  subcommand.Name,
+		Feature: stringOption(options, "feature"),
+		Scope:   guildRule,
+	}
+	var scopes []string
+	for _, scope := range []string{channelRule, categoryRule, roleRule, userRule} {
+		if option, ok := options[scope]; ok {
+			rule.Scope, rule.ID = scope, fmt.Sprint(option.Value)
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) > 1 {
+		return send("Pick just one of a channel, category, role or user")
+	}
+
+	// A new rule replaces any existing rule for the same feature and scope
+	sameTarget := func(existing storage.AccessRule) bool {
+		return existing.Feature == rule.Feature && existing.Scope == rule.Scope && existing.ID == rule.ID
+	}
+	var removed int
+	err := b.access.Update(ctx, req.guildID, func(policy *storage.AccessPolicy) {
+		before := len(policy.Rules)
+		policy.Rules = slices.DeleteFunc(policy.Rules, sameTarget)
+		removed = before - len(policy.Rules)
+		if rule.Effect != "remove" {
+			policy.Rules = append(policy.Rules, rule)
+		}
+	})
+	if err != nil {
+		_ = send("Whoops something went wrong processing that")
+		return err
+	}
+
+	action, content := "access.rule_added", describeRule(req.guildID, rule)
+	if rule.Effect == "remove" {
+		action = "access.rule_removed"
+		content = strings.TrimPrefix(content, "remove ")
+	}
+	auditErr := b.storage.AddAuditRecord(ctx, storage.AuditRecord{
+		GuildId:    req.guildID,
+		RecordedAt: time.Now().UnixNano(),
+		ChannelId:  req.channelID,
+		UserId:     req.author.ID,
+		UserName:   req.author.Username,
+		Action:     action,
+		Content:    content,
+	})
+	if auditErr != nil {
+		slog.Default().WithGroup("accessCommand").ErrorContext(ctx, "failed to record access audit record", slog.Any("error", auditErr))
+	}
+
+	if rule.Effect == "remove" {
+		if removed == 0 {
+			return send("There wasn't a rule for " + content)
+		}
+		return send("Removed the rule for " + content)
+	}
+	return send("Okay, " + content)
+}
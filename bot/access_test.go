@@ -0,0 +1,199 @@
+package bot
+
+import (
+	"slices"
+	"testing"
+
+	"openai-discord-bot/bot/storage"
+)
+
+func TestEvaluatePolicy(t *testing.T) {
+	// subject is asking in a thread of the "general" channel, in the "lounge" category, with the "member" role
+	subject := accessSubject{
+		guildID:    "guild",
+		categoryID: "lounge",
+		channelIDs: []string{"thread", "general"},
+		roleIDs:    []string{"member"},
+		userID:     "alice",
+	}
+	rule := func(effect string, feature string, scope string, id string) storage.AccessRule {
+		return storage.AccessRule{Effect: effect, Feature: feature, Scope: scope, ID: id}
+	}
+
+	tests := []struct {
+		name    string
+		rules   []storage.AccessRule
+		feature string
+		want    bool
+	}{
+		{
+			name:    "no rules",
+			feature: chatFeature,
+			want:    true,
+		},
+		{
+			name:    "only rules for other features",
+			rules:   []storage.AccessRule{rule(denyEffect, imageFeature, guildRule, "")},
+			feature: chatFeature,
+			want:    true,
+		},
+		{
+			name:    "only rules for other places and people",
+			rules:   []storage.AccessRule{rule(denyEffect, allFeatures, channelRule, "random"), rule(denyEffect, allFeatures, userRule, "bob"), rule(denyEffect, allFeatures, roleRule, "admin")},
+			feature: chatFeature,
+			want:    true,
+		},
+		{
+			name:    "guild denied",
+			rules:   []storage.AccessRule{rule(denyEffect, allFeatures, guildRule, "")},
+			feature: chatFeature,
+			want:    false,
+		},
+		{
+			name:    "channel allowed in a denied guild",
+			rules:   []storage.AccessRule{rule(denyEffect, allFeatures, guildRule, ""), rule(allowEffect, allFeatures, channelRule, "general")},
+			feature: chatFeature,
+			want:    true,
+		},
+		{
+			name:    "channel denied in an allowed category",
+			rules:   []storage.AccessRule{rule(allowEffect, allFeatures, categoryRule, "lounge"), rule(denyEffect, allFeatures, channelRule, "general")},
+			feature: chatFeature,
+			want:    false,
+		},
+		{
+			name:    "category allowed in a denied guild",
+			rules:   []storage.AccessRule{rule(denyEffect, chatFeature, guildRule, ""), rule(allowEffect, chatFeature, categoryRule, "lounge")},
+			feature: chatFeature,
+			want:    true,
+		},
+		{
+			name:    "feature rule beats all features at the same scope",
+			rules:   []storage.AccessRule{rule(denyEffect, allFeatures, channelRule, "general"), rule(allowEffect, chatFeature, channelRule, "general")},
+			feature: chatFeature,
+			want:    true,
+		},
+		{
+			name:    "deny beats allow at the same rank",
+			rules:   []storage.AccessRule{rule(allowEffect, chatFeature, channelRule, "general"), rule(denyEffect, chatFeature, channelRule, "thread")},
+			feature: chatFeature,
+			want:    false,
+		},
+		{
+			name:    "deny beats allow for the same target",
+			rules:   []storage.AccessRule{rule(denyEffect, chatFeature, roleRule, "member"), rule(allowEffect, chatFeature, roleRule, "member")},
+			feature: chatFeature,
+			want:    false,
+		},
+		{
+			name:    "everyone denied",
+			rules:   []storage.AccessRule{rule(denyEffect, allFeatures, roleRule, "guild")},
+			feature: imageFeature,
+			want:    false,
+		},
+		{
+			name:    "role allowed when everyone is denied",
+			rules:   []storage.AccessRule{rule(denyEffect, imageFeature, roleRule, "guild"), rule(allowEffect, imageFeature, roleRule, "member")},
+			feature: imageFeature,
+			want:    true,
+		},
+		{
+			name:    "user denied despite their role",
+			rules:   []storage.AccessRule{rule(allowEffect, allFeatures, roleRule, "member"), rule(denyEffect, allFeatures, userRule, "alice")},
+			feature: chatFeature,
+			want:    false,
+		},
+		{
+			name:    "user allowed in a denied channel",
+			rules:   []storage.AccessRule{rule(denyEffect, allFeatures, channelRule, "general"), rule(allowEffect, allFeatures, userRule, "alice")},
+			feature: chatFeature,
+			want:    false,
+		},
+		{
+			name:    "channel allowed for a denied user",
+			rules:   []storage.AccessRule{rule(allowEffect, allFeatures, channelRule, "general"), rule(denyEffect, allFeatures, userRule, "alice")},
+			feature: chatFeature,
+			want:    false,
+		},
+		{
+			name:    "allowed where and who",
+			rules:   []storage.AccessRule{rule(denyEffect, allFeatures, guildRule, ""), rule(allowEffect, allFeatures, channelRule, "general"), rule(denyEffect, allFeatures, roleRule, "guild"), rule(allowEffect, allFeatures, userRule, "alice")},
+			feature: chatFeature,
+			want:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := evaluatePolicy(storage.AccessPolicy{Rules: tt.rules}, tt.feature, subject)
+			if got != tt.want {
+				t.Errorf("evaluatePolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecide(t *testing.T) {
+	// rank ranks rules by their ID, so the order rules are weighed in can be tested apart from any scope
+	rank := func(rule storage.AccessRule) int {
+		return len(rule.ID)
+	}
+
+	tests := []struct {
+		name  string
+		rules []storage.AccessRule
+		want  bool
+	}{
+		{
+			name: "no rule applies",
+			rules: []storage.AccessRule{
+				{Effect: denyEffect, Feature: chatFeature},
+				{Effect: denyEffect, Feature: imageFeature, ID: "a"},
+			},
+			want: true,
+		},
+		{
+			name: "higher rank wins",
+			rules: []storage.AccessRule{
+				{Effect: denyEffect, Feature: chatFeature, ID: "a"},
+				{Effect: allowEffect, Feature: allFeatures, ID: "aa"},
+			},
+			want: true,
+		},
+		{
+			name: "feature beats all features at the same rank",
+			rules: []storage.AccessRule{
+				{Effect: allowEffect, Feature: chatFeature, ID: "a"},
+				{Effect: denyEffect, Feature: allFeatures, ID: "b"},
+			},
+			want: true,
+		},
+		{
+			name: "deny beats allow at the same rank, whichever comes first",
+			rules: []storage.AccessRule{
+				{Effect: denyEffect, Feature: chatFeature, ID: "a"},
+				{Effect: allowEffect, Feature: chatFeature, ID: "b"},
+			},
+			want: false,
+		},
+		{
+			name: "anything but allow denies",
+			rules: []storage.AccessRule{
+				{Effect: "remove", Feature: chatFeature, ID: "a"},
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decide(tt.rules, chatFeature, rank); got != tt.want {
+				t.Errorf("decide() = %v, want %v", got, tt.want)
+			}
+			// The order rules were added in doesn't matter
+			reversed := slices.Clone(tt.rules)
+			slices.Reverse(reversed)
+			if got := decide(reversed, chatFeature, rank); got != tt.want {
+				t.Errorf("decide() of the rules reversed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,66 +2,147 @@ package bot
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
-	"os"
+	"net/http"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/avast/retry-go/v4"
 	"github.com/bwmarrin/discordgo"
 	"github.com/pkg/errors"
 	gpt "github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
 	"go.opentelemetry.io/otel/trace"
+	"openai-discord-bot/bot/provider"
 	"openai-discord-bot/bot/storage"
+	"openai-discord-bot/config"
 )
 
+// errReported marks errors that the requester has already been told about
+var errReported = errors.New("already reported to the requester")
+
 type AIBot struct {
-	openapiClient  *gpt.Client
-	botCtx         context.Context
+	provider       provider.Provider
 	discordSession *discordgo.Session
-	basePrompt     []gpt.ChatCompletionMessage
-	storage        *storage.Storage
-	imageStorage   *storage.ImageStorage
+	prompts        storage.PromptStore
+	personas       atomic.Pointer[personaSet] // Every persona in the prompt store, which can be reloaded while the bot runs
+	commandsReady  atomic.Bool                // Whether the slash commands have been registered since the bot started
+	storage        storage.ConversationStore
+	imageStorage   storage.ImageStore
+	threadContext  *contextBuilder
+	historyLimit   int // How many of a thread's newest messages are loaded before fitting them into the context budget
+	generation     GenerationConfig
+	editInterval   time.Duration // The least time between edits of a reply that is streaming in
+	format         replyFormatter
+	vision         visionConfig
+	transcription  transcriptionConfig
+	speech         speechConfig
+	rateLimiter    *rateLimiter
+	usage          *usageMeter
+	moderation     moderationConfig
+	access         *accessPolicies
+	dispatcher     *dispatcher
+	lifecycle      lifecycleConfig
+	health         *healthMonitor
+	server         serverConfig
+	content        contentCapture
 }
 
-func (b *AIBot) Go() error {
-	// TODO Block here? Use a context or a control channel?
-	return nil
-}
+func NewAIBot(aiProvider provider.Provider, discordSession *discordgo.Session, storage storage.ConversationStore, imageStorage storage.ImageStore, prompts storage.PromptStore) *AIBot {
+	personas, err := loadPersonas(context.Background(), prompts, viper.GetString("DEFAULT_PERSONA"))
+	if err != nil {
+		log.Panic("Failed to load personas", err)
+	}
 
-func NewAIBot(botCtx context.Context, aiClient *gpt.Client, discordSession *discordgo.Session, storage *storage.Storage, imageStorage *storage.ImageStorage) *AIBot {
-	promptBytes, err := os.ReadFile("prompts/danbo.json")
+	generationConfig, err := loadGenerationConfig()
 	if err != nil {
-		log.Panic("Failed to read initial prompt", err)
+		log.Panic("Failed to load generation settings", err)
 	}
 
-	promptMessages := struct {
-		Prompt []gpt.ChatCompletionMessage
-	}{}
-	err = json.Unmarshal(promptBytes, &promptMessages)
+	usage, err := newUsageMeter(storage)
+	if err != nil {
+		log.Panic("Failed to load prices", err)
+	}
 
+	moderation, err := loadModerationConfig()
 	if err != nil {
-		log.Panic("Failed to parse initial prompt", err)
+		log.Panic("Failed to load moderation settings", err)
 	}
 
+	health := newHealthMonitor(healthConfig{
+		gatewayGrace:         viper.GetDuration("HEALTH_GATEWAY_GRACE"),
+		openaiWindow:         viper.GetDuration("HEALTH_OPENAI_WINDOW"),
+		openaiMinSuccessRate: viper.GetFloat64("HEALTH_OPENAI_MIN_SUCCESS_RATE"),
+	})
+
 	bot := &AIBot{
 		discordSession: discordSession,
-		openapiClient:  aiClient,
-		botCtx:         botCtx,
-		basePrompt:     promptMessages.Prompt,
+		provider:       aiProvider,
 		storage:        storage,
 		imageStorage:   imageStorage,
+		prompts:        prompts,
+		threadContext:  newContextBuilder(aiProvider, storage, usage, health, viper.GetInt("CONTEXT_TOKEN_BUDGET"), viper.GetInt("THREAD_HISTORY_LIMIT")),
+		historyLimit:   viper.GetInt("THREAD_HISTORY_LIMIT"),
+		generation:     generationConfig,
+		editInterval:   viper.GetDuration("STREAM_EDIT_INTERVAL"),
+		format: replyFormatter{
+			limit:      discordMessageLimit,
+			attachOver: viper.GetInt("REPLY_ATTACHMENT_THRESHOLD"),
+		},
+		vision: visionConfig{
+			maxImages:     viper.GetInt("VISION_MAX_IMAGES"),
+			maxImageBytes: viper.GetInt("VISION_MAX_IMAGE_BYTES"),
+		},
+		transcription: transcriptionConfig{
+			model:    viper.GetString("TRANSCRIPTION_MODEL"),
+			maxBytes: viper.GetInt("TRANSCRIPTION_MAX_BYTES"),
+			echo:     viper.GetBool("TRANSCRIPTION_ECHO"),
+		},
+		speech: speechConfig{
+			model: gpt.SpeechModel(viper.GetString("SPEECH_MODEL")),
+		},
+		rateLimiter: newRateLimiter(storage),
+		usage:       usage,
+		moderation:  moderation,
+		access:      newAccessPolicies(storage),
+		dispatcher:  newDispatcher(viper.GetInt("WORKERS"), viper.GetInt("WORK_QUEUE_SIZE")),
+		lifecycle: lifecycleConfig{
+			shutdownTimeout:      viper.GetDuration("SHUTDOWN_TIMEOUT"),
+			announcementChannels: viper.GetStringSlice("ANNOUNCEMENT_CHANNELS"),
+			watchPrompts:         viper.GetBool("PROMPTS_WATCH"),
+		},
+		health: health,
+		content: contentCapture{
+			enabled:   viper.GetBool("TRACE_CONTENT"),
+			maxLength: viper.GetInt("TRACE_CONTENT_MAX_LENGTH"),
+		},
+		server: serverConfig{
+			address:    viper.GetString("HTTP_ADDRESS"),
+			adminToken: viper.GetString("ADMIN_TOKEN"),
+			logLevel:   config.LogLevel(),
+		},
 	}
 
-	// TODO Wire up more handlers
-	discordSession.AddHandler(bot.ReadyHandler)
-	discordSession.AddHandler(bot.messageCreate)
+	bot.personas.Store(personas)
+
+	err = observeDispatcher(bot.dispatcher)
+	if err != nil {
+		slog.Default().Error("Failed to report work queue metrics", slog.Any("error", err))
+	}
+	transport := discordSession.Client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	discordSession.Client.Transport = discordTransport{next: transport}
 
 	return bot
 }
@@ -80,13 +161,27 @@ func userWasMentioned(user *discordgo.User, mentioned []*discordgo.User) bool {
 	return false
 }
 
+// inConversation reports whether a message continues a conversation with the bot without mentioning it, by being a
+// direct message, a reply to the bot, or a message in a thread the bot started
+func (b *AIBot) inConversation(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	if m.GuildID == "" {
+		return true
+	}
+	if m.ReferencedMessage != nil && m.ReferencedMessage.Author != nil && m.ReferencedMessage.Author.ID == s.State.User.ID {
+		return true
+	}
+	ch, err := s.State.Channel(m.ChannelID)
+	return err == nil && ch.IsThread() && ch.OwnerID == s.State.User.ID
+}
+
 func (b *AIBot) messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 	logger := slog.Default().WithGroup("messageCreate")
 	if m.Author.ID == s.State.User.ID {
 		return
 	}
 
-	if !userWasMentioned(s.State.User, m.Mentions) {
+	// Voice messages can't mention anyone, so we also listen for them wherever we're obviously part of the conversation
+	if !userWasMentioned(s.State.User, m.Mentions) && !(isVoiceMessage(m.Message) && b.inConversation(s, m)) {
 		return
 	}
 
@@ -100,30 +195,118 @@ func (b *AIBot) messageCreate(s *discordgo.Session, m *discordgo.MessageCreate)
 
 	logger.InfoContext(ctx, "Processing Message", slog.String("message", m.Content))
 
+	// Strip our UserId out of messages to keep the record from being too confusing,
+	sanitizedUserPrompt := strings.ReplaceAll(m.Content, fmt.Sprintf("<@%s>", s.State.User.ID), "")
+
+	options := promptOptions{
+		threaded: strings.Contains(m.Content, "🧵"),
+		images:   messageImages(m.Message),
+		audio:    messageAudio(m.Message),
+		speak:    strings.Contains(m.Content, speechTrigger),
+	}
+	if strings.Contains(strings.ToLower(sanitizedUserPrompt), "🎨") || strings.Contains(strings.ToLower(sanitizedUserPrompt), "draw me a picture of") {
+		// Strip the prompt prefix out of the message
+		sanitizedUserPrompt = strings.ReplaceAll(strings.ToLower(sanitizedUserPrompt), "draw me a picture of", "")
+		options.image = true
+	}
+
+	// Where the bot isn't allowed it stays completely silent
+	req := newMessageRequest(m)
+	feature := chatFeature
+	if options.image {
+		feature = imageFeature
+	}
+	if !b.allowed(ctx, req, feature) {
+		logger.DebugContext(ctx, "ignoring message the access policy doesn't allow", slog.String("feature", feature))
+		return
+	}
+
+	b.dispatchPrompt(ctx, req, sanitizedUserPrompt, options)
+}
+
+// promptOptions selects how handlePrompt responds to a prompt
+type promptOptions struct {
+	// threaded moves the conversation into a new thread, if it isn't in one already
+	threaded bool
+	// image draws a picture of the prompt instead of replying with text
+	image bool
+	// imageSize overrides the size of drawn pictures
+	imageSize string
+	// images were shown to the bot along with the prompt
+	images []imageSource
+	// audio was sent to the bot along with the prompt, and is transcribed into it
+	audio []audioSource
+	// speak reads the reply out loud as well
+	speak bool
+}
+
+// handlePrompt responds to a prompt from either an @mention or a slash command, loading or creating the thread it
+// belongs to, and reporting any failure back to the requester
+func (b *AIBot) handlePrompt(ctx context.Context, req *request, prompt string, options promptOptions) {
+	logger := slog.Default().WithGroup("handlePrompt")
+	span := trace.SpanFromContext(ctx)
+	metrics.recordMessage(ctx, b.messageKind(req, options), req.interaction != nil)
+
+	settings, threadPersona := b.generationSettings(ctx, req)
+	if options.imageSize != "" {
+		settings.ImageSize = options.imageSize
+	}
+	persona := b.personaSet().Get(settings.Persona)
+	span.SetAttributes(attribute.String("persona", persona.ID), attribute.String("prompt_version", persona.Version))
+
 	// Figure out if we should be acting in a thread
-	responseChannel, threadPromptContext, err := b.handleThreading(ctx, s, m)
+	responseChannel, threadPromptContext, err := b.handleThreading(ctx, req, options.threaded, settings, threadPersona)
 	if err != nil {
 		logger.ErrorContext(ctx, "failed to load or create thread context", slog.Any("error", err))
 		span.SetStatus(codes.Error, err.Error())
 		span.RecordError(err)
+		if req.interaction != nil {
+			_ = sendText(ctx, b.responderFor(ctx, req, req.channelID), "I couldn't start a thread for that")
+		}
 		return
 	}
 	logger.DebugContext(ctx, "loaded thread context", slog.Int("thread_length", len(threadPromptContext)))
 
-	// Strip our UserId out of messages to keep the record from being too confusing,
-	sanitizedUserPrompt := strings.ReplaceAll(m.Content, fmt.Sprintf("<@%s>", s.State.User.ID), "")
+	reply := b.responderFor(ctx, req, responseChannel)
 
-	// Let users know we're "typing", the call to OpenAI can take a few seconds
-	_ = s.ChannelTyping(responseChannel, discordgo.WithContext(ctx))
+	// Let users know we're "typing", the call to OpenAI can take a few seconds. Slash commands show that they're
+	// "thinking" on their own
+	if req.interaction == nil {
+		_ = b.discordSession.ChannelTyping(responseChannel, discordgo.WithContext(ctx))
+	}
 
-	if strings.Contains(strings.ToLower(sanitizedUserPrompt), "🎨") || strings.Contains(strings.ToLower(sanitizedUserPrompt), "draw me a picture of") {
-		// Strip the prompt prefix out of the message
-		sanitizedUserPrompt = strings.ReplaceAll(strings.ToLower(m.Content), "draw me a picture of", "")
-		err = b.handleImageMessage(ctx, responseChannel, sanitizedUserPrompt, m)
+	if len(options.audio) > 0 {
+		prompt, err = b.withTranscript(ctx, req, reply, prompt, options.audio)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			logger.ErrorContext(ctx, "failed to transcribe audio", slog.Any("error", err))
+			_ = sendText(ctx, reply, "Sorry, I couldn't make out what you said")
+			return
+		}
+	}
+
+	// Moderation fails open, an outage shouldn't take the whole bot down with it
+	verdict, err := b.moderate(ctx, req, prompt)
+	if err != nil {
+		span.RecordError(err)
+		logger.WarnContext(ctx, "failed to moderate prompt, allowing it", slog.Any("error", err))
+	}
+	if verdict != nil {
+		logger.InfoContext(ctx, "prompt blocked by moderation", slog.String("categories", verdict.String()))
+		span.SetAttributes(attribute.Bool("moderated", true))
+		b.auditModeration(ctx, req, "moderation.prompt_blocked", prompt, verdict)
+		_ = sendText(ctx, reply, persona.Refusal)
+		span.SetStatus(codes.Ok, "Success")
+		return
+	}
+
+	if options.image {
+		err = b.handleImageMessage(ctx, reply, responseChannel, prompt, settings, req)
 		if err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			_, discordErr := b.discordSession.ChannelMessageSend(responseChannel, fmt.Sprintf("I fucked that up and threw it away. Sorry. (%s)", err.Error()), discordgo.WithContext(ctx))
+			discordErr := sendText(ctx, reply, fmt.Sprintf("I fucked that up and threw it away. Sorry. (%s)", err.Error()))
 			if discordErr != nil {
 				span.RecordError(err)
 				logger.ErrorContext(ctx, "Failed to notify discord channel of the error", slog.Any("error", err))
@@ -131,26 +314,95 @@ func (b *AIBot) messageCreate(s *discordgo.Session, m *discordgo.MessageCreate)
 			return
 		}
 	} else {
-		err = b.handleCompletionPrompt(ctx, responseChannel, sanitizedUserPrompt, threadPromptContext, m)
+		var responseText string
+		responseText, err = b.handleCompletionPrompt(ctx, reply, responseChannel, prompt, options.images, threadPromptContext, settings, persona, req)
 		if err != nil {
 			span.RecordError(err)
 			span.SetStatus(codes.Error, err.Error())
-			_, discordErr := b.discordSession.ChannelMessageSend(responseChannel, "Whoops something went wrong processing that", discordgo.WithContext(ctx))
+			if errors.Is(err, errReported) {
+				return
+			}
+			discordErr := sendText(ctx, reply, "Whoops something went wrong processing that")
 			if discordErr != nil {
 				span.RecordError(err)
 				logger.ErrorContext(ctx, "Failed to notify discord channel of the error", slog.Any("error", err))
 			}
 			return
 		}
+
+		if options.speak && responseText != "" {
+			err = b.handleSpeechMessage(ctx, reply, responseText, persona, req)
+			if err != nil {
+				// The reply was already written down, so failing to say it isn't worth more than a mention
+				span.RecordError(err)
+				logger.ErrorContext(ctx, "failed to read the reply out loud", slog.Any("error", err))
+				_ = sendText(ctx, reply, "I lost my voice, you'll have to read that one")
+			}
+		}
 	}
 	span.SetStatus(codes.Ok, "Success")
 }
 
-func (b *AIBot) ReadyHandler(_ *discordgo.Session, _ *discordgo.Ready) {
-	slog.Default().WithGroup("ReadyHandler").Info("Connection state ready, Registering intents")
+// messageKind is the kind of message a prompt is counted as in metrics
+func (b *AIBot) messageKind(req *request, options promptOptions) string {
+	if options.image {
+		return imageMessage
+	}
+	if ch, err := b.discordSession.State.Channel(req.channelID); options.threaded || (err == nil && ch.IsThread()) {
+		return threadMessage
+	}
+	return chatMessage
+}
+
+// generationSettings resolves the generation settings for the channel a request was made in. In a thread, the persona
+// stored with the thread answers, which is returned as threadPersona if there is one
+func (b *AIBot) generationSettings(ctx context.Context, req *request) (settings GenerationSettings, threadPersona string) {
+	var parentID string
+	ch, err := b.discordSession.State.Channel(req.channelID)
+	inThread := err == nil && ch.IsThread()
+	if inThread {
+		parentID = ch.ParentID
+	}
+	settings = b.generation.Resolve(req.guildID, parentID, req.channelID)
+
+	if inThread {
+		threadPersona, err = b.storage.GetThreadPersona(ctx, req.channelID)
+		if err != nil {
+			// The channel's persona will do
+			slog.Default().WithGroup("generationSettings").WarnContext(ctx, "failed to load the thread's persona", slog.Any("error", err))
+		}
+		if b.personaSet().Has(threadPersona) {
+			settings.Persona = threadPersona
+		}
+	}
+
+	persona := b.personaSet().Get(settings.Persona)
+	settings.Persona = persona.ID
+	if persona.Model != "" && !b.generation.modelOverridden(req.guildID, parentID, req.channelID) {
+		settings.Model = persona.Model
+	}
+	return settings, threadPersona
+}
+
+// ReadyHandler registers the slash commands the first time the bot connects. Ready is sent again every time the
+// gateway reconnects, and by then the commands are already there. Failing to register is retried on the next Ready
+func (b *AIBot) ReadyHandler(s *discordgo.Session, r *discordgo.Ready) {
+	logger := slog.Default().WithGroup("ReadyHandler")
+	if b.commandsReady.Load() {
+		logger.Info("Connection state ready again, slash commands are already registered")
+		return
+	}
+	logger.Info("Connection state ready, Registering intents")
+
+	err := b.registerCommands(s, r)
+	if err != nil {
+		logger.Error("Failed to register slash commands", slog.Any("error", err))
+		return
+	}
+	b.commandsReady.Store(true)
 }
 
-func (b *AIBot) handleImageMessage(ctx context.Context, responseChannel string, prompt string, m *discordgo.MessageCreate) error {
+func (b *AIBot) handleImageMessage(ctx context.Context, reply responder, responseChannel string, prompt string, settings GenerationSettings, req *request) error {
 	var err error
 	logger := slog.Default().WithGroup("handleImageMessage")
 
@@ -158,7 +410,7 @@ func (b *AIBot) handleImageMessage(ctx context.Context, responseChannel string,
 	defer span.End()
 
 	// Record the prompt to our thread context
-	err = b.storage.AddThreadMessage(ctx, responseChannel, fmt.Sprintf("%s (%s) on %s", m.Author.Username, m.Author.ID, m.GuildID), prompt)
+	err = b.storage.AddThreadMessage(ctx, responseChannel, req.source(), prompt)
 	if err != nil {
 		return fmt.Errorf("failed to record drawing prompt: %w", err)
 	}
@@ -167,22 +419,36 @@ func (b *AIBot) handleImageMessage(ctx context.Context, responseChannel string,
 	imageRequest := gpt.ImageRequest{
 		Prompt:         prompt,
 		N:              1,
-		User:           m.Author.ID,
-		Size:           gpt.CreateImageSize1024x1024,
+		User:           req.author.ID,
+		Size:           settings.ImageSize,
+		Quality:        settings.ImageQuality,
 		ResponseFormat: gpt.CreateImageResponseFormatURL,
-		Model:          gpt.CreateImageModelDallE3,
+		Model:          settings.ImageModel,
 	}
-	span.SetAttributes(
-		attribute.String("model", imageRequest.Model),
-		attribute.String("size", imageRequest.Size),
-	)
-	responseImage, err := b.openapiClient.CreateImage(ctx, imageRequest)
+	span.SetAttributes(settings.imageAttributes()...)
+	started := time.Now()
+	callCtx, callSpan, served := startGenAISpan(ctx, semconv.GenAIOperationNameGenerateContent, settings.ImageModel, semconv.GenAIOutputTypeImage)
+	responseImage, err := b.provider.CreateImage(callCtx, imageRequest)
+	b.health.RecordOpenAI(err)
+	metrics.recordOpenAI(ctx, imageFeature, served.ModelOr(settings.ImageModel), started, err)
+	if err == nil && len(responseImage.Data) > 0 {
+		b.content.recordImageContent(callSpan, prompt, responseImage.Data[0])
+	}
+	endGenAISpan(callSpan, err)
 	if err != nil {
 		return fmt.Errorf("failed to get image from openai: %w", err)
 	}
+	// The picture is priced by the model that drew it
+	settings.ImageModel = served.ModelOr(settings.ImageModel)
+	b.usage.Record(ctx, req, imagePriceKey(settings), storage.UsageRecord{
+		Provider: served.Provider,
+		Model:    settings.ImageModel,
+		Feature:  imageFeature,
+		Units:    float64(len(responseImage.Data)),
+	})
 
 	// Retrieve the image from openai
-	imageReader, imageLength, err := b.imageStorage.GetImageFromURL(ctx, responseImage.Data[0].URL)
+	imageReader, imageLength, err := storage.GetFileFromURL(ctx, responseImage.Data[0].URL)
 	if err != nil {
 		return fmt.Errorf("failed to store retrieved image: %w", err)
 	}
@@ -191,54 +457,57 @@ func (b *AIBot) handleImageMessage(ctx context.Context, responseChannel string,
 	defer func() {
 		closeErr := imageReader.Close()
 		if closeErr != nil {
-			span.RecordError(err)
+			span.RecordError(closeErr)
 			logger.ErrorContext(ctx, "failed to close image request body", slog.Any("error", closeErr))
 		}
 	}()
 
-	// Tee the image reading stream, so that we can upload it to discord and S3 at the same time
+	// Tee the image reading stream, so that we can upload it to discord and image storage at the same time
 	pipeReader, pipeWriter := io.Pipe()
 	imageTeeReader := io.TeeReader(imageReader, pipeWriter)
 
-	// Record the image to S3, and our thread context
+	// Record the image to image storage, and our thread context
 	go func() {
 		defer func() {
 			pipeErr := pipeWriter.Close()
 			if pipeErr != nil {
-				span.RecordError(err)
+				span.RecordError(pipeErr)
 				logger.ErrorContext(ctx, "failed to close the pipeWriter", slog.Any("error", pipeErr))
 			}
 		}()
 
-		imageKey, err := b.imageStorage.StoreImage(ctx, m.GuildID, imageTeeReader, imageLength)
+		imageKey, err := b.imageStorage.StoreImage(ctx, req.guildID, imageTeeReader, imageLength, "image/png")
 		if err != nil {
 			span.RecordError(err)
-			logger.ErrorContext(ctx, "failed to store a copy of the image in S3", slog.Any("error", err))
+			logger.ErrorContext(ctx, "failed to store a copy of the image", slog.Any("error", err))
+			// Keep draining the stream so the discord upload can finish
+			_, _ = io.Copy(io.Discard, imageTeeReader)
 			return
 		}
 
-		imageUrl := fmt.Sprintf("https://sillybullshit.click/%s", imageKey)
+		imageUrl := b.imageStorage.PublicURL(imageKey)
 
 		// Record the image response to the thread context
 		err = b.storage.AddThreadMessage(ctx, responseChannel, "Bot", imageUrl)
 		if err != nil {
 			span.RecordError(err)
-			logger.ErrorContext(ctx, "failed to store a copy of the image in S3", slog.Any("error", err))
+			logger.ErrorContext(ctx, "failed to record the image in the thread context", slog.Any("error", err))
 		}
 	}()
 
 	// Embed the image in a discord message, and send it
-	_, err = b.discordSession.ChannelMessageSendComplex(responseChannel, &discordgo.MessageSend{
+	_, err = reply.Send(ctx, &discordgo.MessageSend{
 		Content:   "a picture I drawed",
-		Reference: m.Reference(),
-		File: &discordgo.File{
+		Reference: req.reference(),
+		Files: []*discordgo.File{{
 			Name:        "danbot-drawing.png",
 			ContentType: "image/png",
 			Reader:      pipeReader,
-		},
-	}, discordgo.WithContext(ctx))
-
+		}},
+	})
 	if err != nil {
+		// Unblock the archiving goroutine, which is waiting on discord to read the other end of the pipe
+		_ = pipeReader.CloseWithError(err)
 		return fmt.Errorf("failed to send embedded image to discord: %w", err)
 	}
 
@@ -246,8 +515,9 @@ func (b *AIBot) handleImageMessage(ctx context.Context, responseChannel string,
 	return nil
 }
 
-// Handle a text completion prompt, including applying existing thread context and updating the stored state of that context
-func (b *AIBot) handleCompletionPrompt(ctx context.Context, responseChannel string, sanitizedUserPrompt string, threadPromptContext []gpt.ChatCompletionMessage, m *discordgo.MessageCreate) error {
+// Handle a text completion prompt, including applying existing thread context and updating the stored state of that
+// context. The reply's text is returned so it can be used again, like when it's read out loud
+func (b *AIBot) handleCompletionPrompt(ctx context.Context, reply responder, responseChannel string, sanitizedUserPrompt string, images []imageSource, threadPromptContext []gpt.ChatCompletionMessage, settings GenerationSettings, persona *persona, req *request) (string, error) {
 	var err error
 	logger := slog.Default().WithGroup("handleCompletionPrompt")
 	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "handleCompletionPrompt")
@@ -257,83 +527,232 @@ func (b *AIBot) handleCompletionPrompt(ctx context.Context, responseChannel stri
 		Role:    "user",
 		Content: sanitizedUserPrompt,
 	}
+
+	// Vision models get to see any images that came with the prompt, and those from earlier in the thread
+	var imageReferences []string
+	if settings.visionEnabled() {
+		var imageParts []gpt.ChatMessagePart
+		if len(images) > 0 {
+			imageParts, imageReferences = b.loadImages(ctx, req, images)
+		}
+		if len(imageParts) > 0 {
+			userMessage.MultiContent = append([]gpt.ChatMessagePart{{Type: gpt.ChatMessagePartTypeText, Text: sanitizedUserPrompt}}, imageParts...)
+			userMessage.Content = ""
+		}
+	} else {
+		threadPromptContext = withoutImages(threadPromptContext)
+	}
 	requestMessages := append(threadPromptContext, userMessage)
 
-	request := gpt.ChatCompletionRequest{
-		Model:    gpt.GPT3Dot5Turbo,
-		Messages: append(b.basePrompt, requestMessages...),
+	request := settings.chatRequest(slices.Concat(persona.render(ctx, b.promptVariables(req)), requestMessages))
+	request.StreamOptions = &gpt.StreamOptions{IncludeUsage: true}
+	span.SetAttributes(settings.chatAttributes()...)
+	span.SetAttributes(attribute.String("persona", persona.ID), attribute.String("prompt_version", persona.Version))
+	logger.InfoContext(ctx, "requesting a completion", slog.String("persona", persona.ID), slog.String("prompt_version", persona.Version), slog.String("model", request.Model))
+	// usage arrives in the last chunk of the stream, if the stream makes it that far
+	var usage *gpt.Usage
+	// served is the provider that answered the last attempt, whose model the usage is recorded under
+	served := &provider.Served{}
+
+	// Post a placeholder reply straight away, and fill it in as the completion streams back. When moderation is on what
+	// has streamed in is checked before each edit, so only what has passed is ever shown
+	var check func(ctx context.Context, text string) (*moderationVerdict, error)
+	if b.moderation.enabled {
+		check = func(ctx context.Context, text string) (*moderationVerdict, error) {
+			return b.moderate(ctx, req, text)
+		}
+	}
+	streamed := newStreamingReply(reply, b.format, b.editInterval, check)
+	err = streamed.Start(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to respond to discord channel: %w", err)
 	}
 
-	// Text completions seem to fail shockingly often, so we set them up to retry if necessary
-	var responseText string
+	// Text completions seem to fail shockingly often, so we set them up to retry if necessary. Once part of a reply has
+	// been shown we can't take it back though, so only failures before any of it is shown are retried
 	err = retry.Do(
-		func() error {
-			response, err := b.openapiClient.CreateChatCompletion(ctx, request)
+		func() (err error) {
+			started := time.Now()
+			callCtx, callSpan, attempt := startGenAISpan(ctx, semconv.GenAIOperationNameChat, request.Model, chatRequestAttributes(request)...)
+			served = attempt
+			var completion chatCompletionTrace
+			defer func() {
+				metrics.recordOpenAI(ctx, chatFeature, served.ModelOr(request.Model), started, err)
+				b.content.recordChatContent(callSpan, request.Messages, streamed.Text(), completion.finishReasons)
+				completion.end(callSpan, err)
+			}()
+
+			stream, err := b.provider.CreateChatCompletionStream(callCtx, request)
+			b.health.RecordOpenAI(err)
 			if err != nil {
 				logger.ErrorContext(ctx, "Failed to retrieve completion from OpenAI", slog.Any("error", err))
 				return err
 			}
-			responseText = response.Choices[0].Message.Content
-			if responseText == "" {
-				logger.WarnContext(ctx, "Empty response text from OpenAI", slog.Any("response", response))
+			defer stream.Close()
+
+			for {
+				response, err := stream.Recv()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					logger.ErrorContext(ctx, "Failed to receive completion stream from OpenAI", slog.Any("error", err))
+					if streamed.Shown() {
+						return retry.Unrecoverable(err)
+					}
+					streamed.Discard()
+					return err
+				}
+				completion.observeChunk(response)
+				if response.Usage != nil {
+					usage = response.Usage
+				}
+				if len(response.Choices) == 0 {
+					continue
+				}
+
+				err = streamed.Append(ctx, response.Choices[0].Delta.Content)
+				if err != nil {
+					// The stream can carry on, the next edit will catch the message up
+					span.RecordError(err)
+					logger.WarnContext(ctx, "Failed to update streaming reply", slog.Any("error", err))
+				}
+			}
+
+			if streamed.Text() == "" {
+				logger.WarnContext(ctx, "Empty response text from OpenAI")
 				return errors.New("Received an empty response from OpenAI")
 			}
 			return nil
 		},
 		retry.Attempts(3),
+		retry.LastErrorOnly(true),
 		retry.OnRetry(func(n uint, err error) {
 			span.AddEvent("retry creating chat completion", trace.WithAttributes(attribute.Int("retry", int(n))))
 			span.RecordError(err)
+			metrics.recordRetry(ctx, chatFeature, request.Model)
 		}),
 	)
+	responseText := streamed.Text()
+	b.recordChatUsage(ctx, req, request, served, usage, responseText)
+
+	// The end of a reply hasn't been checked yet, so the whole reply is checked once it's complete. Anything blocked,
+	// while streaming or now, is replaced with the refusal and never kept in the thread, even if the stream failed
+	verdict := streamed.Verdict()
+	if err == nil && verdict == nil {
+		var moderationErr error
+		verdict, moderationErr = b.moderate(ctx, req, responseText)
+		if moderationErr != nil {
+			span.RecordError(moderationErr)
+			logger.WarnContext(ctx, "failed to moderate reply, allowing it", slog.Any("error", moderationErr))
+		}
+	}
+	if verdict != nil {
+		logger.InfoContext(ctx, "reply blocked by moderation", slog.String("categories", verdict.String()))
+		span.SetAttributes(attribute.Bool("moderated", true))
+		b.auditModeration(ctx, req, "moderation.reply_blocked", responseText, verdict)
+		responseText = persona.Refusal
+		err = streamed.Replace(ctx, responseText)
+		if err != nil {
+			return "", fmt.Errorf("failed to retract blocked reply: %w", err)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get response from openai: %w", err)
+		failErr := streamed.Fail(ctx, "Whoops something went wrong processing that")
+		if failErr != nil {
+			span.RecordError(failErr)
+			return "", fmt.Errorf("failed to get response from openai: %w", err)
+		}
+		if responseText == "" {
+			return "", fmt.Errorf("%w: failed to get response from openai: %w", errReported, err)
+		}
 	}
 
 	// TODO It's weird that we're modifying the stored thread state here, but loaded it elsewhere
-	err = b.storage.AddThreadMessage(ctx, responseChannel, fmt.Sprintf("%s (%s) on %s", m.Author.Username, m.Author.ID, m.GuildID), "User: "+userMessage.Content)
-	if err != nil {
-		warnErr := fmt.Errorf("failed to record conversation message: %w", err)
+	storeErr := b.storage.AddThreadMessage(ctx, responseChannel, req.source(), "User: "+sanitizedUserPrompt, imageReferences...)
+	if storeErr != nil {
+		warnErr := fmt.Errorf("failed to record conversation message: %w", storeErr)
 		span.RecordError(warnErr)
 		logger.WarnContext(ctx, "non-fatal error updating thread context", slog.Any("error", warnErr))
 	}
 
-	err = b.storage.AddThreadMessage(ctx, responseChannel, "Bot", responseText)
-	if err != nil {
-		warnErr := fmt.Errorf("failed to record conversation message: %w", err)
+	// Even a reply that was cut short is part of the conversation now
+	storeErr = b.storage.AddThreadMessage(ctx, responseChannel, "Bot", responseText)
+	if storeErr != nil {
+		warnErr := fmt.Errorf("failed to record conversation message: %w", storeErr)
 		span.RecordError(warnErr)
 		logger.WarnContext(ctx, "non-fatal error updating thread context", slog.Any("error", warnErr))
 	}
 
-	_, err = b.discordSession.ChannelMessageSend(responseChannel, responseText, discordgo.WithContext(ctx))
 	if err != nil {
-		return fmt.Errorf("failed to respond to discord channel: %w", err)
+		return "", fmt.Errorf("%w: completion stream was interrupted: %w", errReported, err)
+	}
+	if verdict != nil {
+		span.SetStatus(codes.Ok, "Success")
+		return "", nil
+	}
+
+	err = streamed.Finish(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to respond to discord channel: %w", err)
 	}
 
 	span.SetStatus(codes.Ok, "Success")
-	return nil
+	return responseText, nil
 }
 
-// Create a new thread if requested, or load the context of a thread if already in one
-func (b *AIBot) handleThreading(ctx context.Context, s *discordgo.Session, m *discordgo.MessageCreate) (responseChannel string, threadContext []gpt.ChatCompletionMessage, errResponse error) {
+// recordChatUsage records the usage reported by a completion stream, or an estimate of it when the stream was cut
+// short before the usage arrived
+func (b *AIBot) recordChatUsage(ctx context.Context, req *request, request gpt.ChatCompletionRequest, served *provider.Served, usage *gpt.Usage, responseText string) {
+	model := served.ModelOr(request.Model)
+	if usage == nil {
+		if responseText == "" {
+			return
+		}
+		usage = &gpt.Usage{
+			PromptTokens:     b.threadContext.tokens.CountMessages(model, request.Messages),
+			CompletionTokens: b.threadContext.tokens.CountText(model, responseText),
+		}
+	}
+	b.usage.Record(ctx, req, model, storage.UsageRecord{
+		Provider:         served.Provider,
+		Model:            model,
+		Feature:          chatFeature,
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+	})
+}
+
+// Create a new thread if requested, or load the context of a thread if already in one. A thread without a persona
+// stored with it, threadPersona, is given the persona that's answering so it keeps talking to the same one
+func (b *AIBot) handleThreading(ctx context.Context, req *request, wantThreaded bool, settings GenerationSettings, threadPersona string) (responseChannel string, threadContext []gpt.ChatCompletionMessage, errResponse error) {
 	logger := slog.Default().WithGroup("handleThreading")
 	// Default to responding to the channel the message came from
-	responseChannel = m.ChannelID
+	responseChannel = req.channelID
 	isThreaded := false
-	wantThreaded := strings.Contains(m.Message.Content, "🧵")
 
 	// The current "channel" may already be a thread
-	if ch, err := s.State.Channel(m.ChannelID); err == nil && ch.IsThread() {
+	if ch, err := b.discordSession.State.Channel(req.channelID); err == nil && ch.IsThread() {
 		isThreaded = true
 		responseChannel = ch.ID
 	}
 
 	// But if the user requested a thread, but we're not in one yet, create it
 	if wantThreaded && !isThreaded {
-		ch, err := s.MessageThreadStartComplex(m.ChannelID, m.ID, &discordgo.ThreadStart{
-			Name:                fmt.Sprintf("Conversation with %s", m.Message.Author.Username),
+		threadStart := &discordgo.ThreadStart{
+			Name:                fmt.Sprintf("Conversation with %s", req.author.Username),
 			AutoArchiveDuration: 60,
-		}, discordgo.WithContext(ctx))
+		}
+
+		var ch *discordgo.Channel
+		var err error
+		if req.message != nil {
+			ch, err = b.discordSession.MessageThreadStartComplex(req.channelID, req.message.ID, threadStart, discordgo.WithContext(ctx))
+		} else {
+			// Slash commands don't have a message to hang the thread off of
+			threadStart.Type = discordgo.ChannelTypeGuildPublicThread
+			ch, err = b.discordSession.ThreadStartComplex(req.channelID, threadStart, discordgo.WithContext(ctx))
+		}
 		if err != nil {
 			errResponse = fmt.Errorf("failed to create discord conversation thread: %w", err)
 			return
@@ -344,20 +763,21 @@ func (b *AIBot) handleThreading(ctx context.Context, s *discordgo.Session, m *di
 
 	// If we are in a thread, we should load the thread's conversation context
 	if isThreaded {
-		var err error
-		threadContext, err = b.storage.GetThread(ctx, responseChannel)
+		if threadPersona == "" {
+			err := b.storage.PutThreadPersona(ctx, responseChannel, settings.Persona)
+			if err != nil {
+				logger.WarnContext(ctx, "Failed to store the thread's persona", slog.Any("error", err), slog.String("thread_id", responseChannel))
+			}
+		}
+
+		history, err := b.storage.GetThread(ctx, responseChannel, storage.ThreadQuery{Limit: b.historyLimit})
 		if err != nil {
 			// This doesn't have to be fatal, though it may be confusing
 			warnErr := fmt.Errorf("failed to load thread conversation context: %w", err)
 			logger.WarnContext(ctx, "Failed to load thread conversation context", slog.Any("error", warnErr), slog.String("thread_id", responseChannel))
 		}
+		// Fit the thread's history into our token budget, summarizing older parts of the conversation if necessary
+		threadContext = b.threadContext.Build(ctx, req, responseChannel, settings.Model, history)
 	}
 	return
 }
-
-func (b *AIBot) Shutdown() {
-	_, err := b.discordSession.ChannelMessageSend("1091532074495787049", "Here I go, shutting down again!")
-	_, span := otel.GetTracerProvider().Tracer("AIBot").Start(b.botCtx, "Shutdown")
-	span.RecordError(err)
-	span.End()
-}
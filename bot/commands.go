@@ -0,0 +1,384 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	gpt "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"openai-discord-bot/bot/storage"
+)
+
+// manageGuildPermission hides admin commands from members who can't manage the guild
+var manageGuildPermission int64 = discordgo.PermissionManageGuild
+
+// accessRuleOptions pick the feature and the scope of an access rule, leaving out the scope means the whole server
+var accessRuleOptions = []*discordgo.ApplicationCommandOption{
+	{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "feature",
+		Description: "What the rule applies to",
+		Required:    true,
+		Choices: []*discordgo.ApplicationCommandOptionChoice{
+			{Name: "Everything", Value: allFeatures},
+			{Name: "Chat", Value: chatFeature},
+			{Name: "Pictures", Value: imageFeature},
+		},
+	},
+	{
+		Type:         discordgo.ApplicationCommandOptionChannel,
+		Name:         channelRule,
+		Description:  "A channel, and the threads in it",
+		ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews, discordgo.ChannelTypeGuildForum, discordgo.ChannelTypeGuildVoice},
+	},
+	{
+		Type:         discordgo.ApplicationCommandOptionChannel,
+		Name:         categoryRule,
+		Description:  "Every channel in a category",
+		ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildCategory},
+	},
+	{
+		Type:        discordgo.ApplicationCommandOptionRole,
+		Name:        roleRule,
+		Description: "Members with a role, pick @everyone for everybody",
+	},
+	{
+		Type:        discordgo.ApplicationCommandOptionUser,
+		Name:        userRule,
+		Description: "A single member",
+	},
+}
+
+// commandFeatures are the features each command uses, which the access policy has to allow
+var commandFeatures = map[string]string{
+	"ask":     chatFeature,
+	"draw":    imageFeature,
+	"thread":  chatFeature,
+	"persona": chatFeature,
+}
+
+// privateCommands are answered so that only whoever used them can see the response
+var privateCommands = map[string]bool{
+	"usage":  true,
+	"access": true,
+}
+
+// commands are the slash commands registered when the bot connects, they offer the same features as @mentions
+var commands = []*discordgo.ApplicationCommand{
+	{
+		Name:        "ask",
+		Description: "Ask Danbot something",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "prompt",
+				Description: "What you want to ask",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "thread",
+				Description: "Continue the conversation in a new thread",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionAttachment,
+				Name:        "image",
+				Description: "An image to show Danbot",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "speak",
+				Description: "Have Danbot read the answer out loud",
+			},
+		},
+	},
+	{
+		Name:        "draw",
+		Description: "Ask Danbot to draw you a picture",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "prompt",
+				Description: "What you want a picture of",
+				Required:    true,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "size",
+				Description: "The size of the picture",
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "Square", Value: gpt.CreateImageSize1024x1024},
+					{Name: "Landscape", Value: gpt.CreateImageSize1792x1024},
+					{Name: "Portrait", Value: gpt.CreateImageSize1024x1792},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionBoolean,
+				Name:        "thread",
+				Description: "Post the picture in a new thread",
+			},
+		},
+	},
+	{
+		Name:        "thread",
+		Description: "Start a threaded conversation with Danbot, which remembers what was said",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "prompt",
+				Description: "Something to start the conversation with",
+			},
+		},
+	},
+	{
+		Name:        "reset",
+		Description: "Make Danbot forget the conversation so far in this thread",
+	},
+	{
+		Name:        "persona",
+		Description: "Pick who Danbot plays in this thread",
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "use",
+				Description: "Switch this thread to a different persona",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:         discordgo.ApplicationCommandOptionString,
+						Name:         "name",
+						Description:  "The persona to switch to",
+						Required:     true,
+						Autocomplete: true,
+					},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "List the personas",
+			},
+		},
+	},
+	{
+		Name:                     "usage",
+		Description:              "See what Danbot has cost this server today, this week and this month",
+		DefaultMemberPermissions: &manageGuildPermission,
+	},
+	{
+		Name:                     "access",
+		Description:              "Control where and by whom Danbot can be used in this server",
+		DefaultMemberPermissions: &manageGuildPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        allowEffect,
+				Description: "Allow a feature somewhere, or for someone",
+				Options:     accessRuleOptions,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        denyEffect,
+				Description: "Deny a feature somewhere, or for someone",
+				Options:     accessRuleOptions,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "remove",
+				Description: "Remove a rule",
+				Options:     accessRuleOptions,
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "list",
+				Description: "List the rules",
+			},
+		},
+	},
+}
+
+// registerCommands replaces the bot's global slash commands with the current set
+func (b *AIBot) registerCommands(s *discordgo.Session, r *discordgo.Ready) error {
+	appID := s.State.User.ID
+	if r.Application != nil && r.Application.ID != "" {
+		appID = r.Application.ID
+	}
+
+	_, err := s.ApplicationCommandBulkOverwrite(appID, "", commands)
+	if err != nil {
+		return fmt.Errorf("failed to overwrite application commands: %w", err)
+	}
+	return nil
+}
+
+// commandOptions indexes the options a slash command was invoked with by name
+func commandOptions(data discordgo.ApplicationCommandInteractionData) map[string]*discordgo.ApplicationCommandInteractionDataOption {
+	options := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(data.Options))
+	for _, option := range data.Options {
+		options[option.Name] = option
+	}
+	return options
+}
+
+func stringOption(options map[string]*discordgo.ApplicationCommandInteractionDataOption, name string) string {
+	if option, ok := options[name]; ok {
+		return option.StringValue()
+	}
+	return ""
+}
+
+func boolOption(options map[string]*discordgo.ApplicationCommandInteractionDataOption, name string) bool {
+	if option, ok := options[name]; ok {
+		return option.BoolValue()
+	}
+	return false
+}
+
+// attachmentOption returns the image attached to a command option, if any
+func attachmentOption(data discordgo.ApplicationCommandInteractionData, options map[string]*discordgo.ApplicationCommandInteractionDataOption, name string) []imageSource {
+	option, ok := options[name]
+	if !ok || data.Resolved == nil {
+		return nil
+	}
+	attachmentID, _ := option.Value.(string)
+	if image, ok := attachmentImage(data.Resolved.Attachments[attachmentID]); ok {
+		return []imageSource{image}
+	}
+	return nil
+}
+
+func (b *AIBot) interactionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	logger := slog.Default().WithGroup("interactionCreate")
+	if i.Type == discordgo.InteractionApplicationCommandAutocomplete {
+		b.autocomplete(s, i)
+		return
+	}
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+	data := i.ApplicationCommandData()
+	req := newInteractionRequest(i)
+
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(context.Background(), "interactionCreate")
+	span.SetAttributes(
+		attribute.String("command", data.Name),
+		attribute.String("user", req.author.ID),
+		attribute.String("guild", req.guildID),
+		attribute.String("channel", req.channelID),
+	)
+	defer span.End()
+
+	// Refuse commands that aren't allowed here before acknowledging them, so only the person who tried sees the refusal
+	if feature, ok := commandFeatures[data.Name]; ok && !b.allowed(ctx, req, feature) {
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "I'm not allowed to do that here",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		}, discordgo.WithContext(ctx))
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to refuse interaction", slog.Any("error", err))
+			span.RecordError(err)
+		}
+		return
+	}
+
+	// Acknowledge the command straight away, discord only allows 3 seconds for a response and OpenAI is rarely that quick
+	response := &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	}
+	if privateCommands[data.Name] {
+		// Spend is only shown to whoever asked for it
+		response.Data = &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral}
+	}
+	err := s.InteractionRespond(i.Interaction, response, discordgo.WithContext(ctx))
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to defer interaction response", slog.Any("error", err))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+
+	logger.InfoContext(ctx, "Processing Command", slog.String("command", data.Name))
+
+	options := commandOptions(data)
+	switch data.Name {
+	case "ask":
+		b.dispatchPrompt(ctx, req, stringOption(options, "prompt"), promptOptions{
+			threaded: boolOption(options, "thread"),
+			images:   attachmentOption(data, options, "image"),
+			speak:    boolOption(options, "speak"),
+		})
+	case "draw":
+		b.dispatchPrompt(ctx, req, stringOption(options, "prompt"), promptOptions{
+			threaded:  boolOption(options, "thread"),
+			image:     true,
+			imageSize: stringOption(options, "size"),
+		})
+	case "thread":
+		prompt := stringOption(options, "prompt")
+		if prompt == "" {
+			prompt = "Say hello, and ask what we should talk about"
+		}
+		b.dispatchPrompt(ctx, req, prompt, promptOptions{threaded: true})
+	case "reset":
+		// Resetting waits for anything already in progress in the thread, so it isn't undone by a late reply
+		b.dispatch(ctx, req, func(ctx context.Context) {
+			err := b.resetThread(ctx, req)
+			if err != nil {
+				logger.ErrorContext(ctx, "failed to reset thread", slog.Any("error", err))
+				span := trace.SpanFromContext(ctx)
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+		})
+	case "persona":
+		// Switching waits for anything already in progress in the thread, so the reply in flight isn't cut off mid-persona
+		b.dispatch(ctx, req, func(ctx context.Context) {
+			err := b.personaCommand(ctx, req, data)
+			if err != nil {
+				logger.ErrorContext(ctx, "failed to change persona", slog.Any("error", err))
+				span := trace.SpanFromContext(ctx)
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+		})
+	case "usage":
+		err = b.usageReport(ctx, req)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to report usage", slog.Any("error", err))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	case "access":
+		err = b.accessCommand(ctx, req, data)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to update access policy", slog.Any("error", err))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	default:
+		_ = sendText(ctx, b.responderFor(ctx, req, req.channelID), "I don't know how to do that")
+	}
+}
+
+// resetThread makes the bot forget the conversation in the current channel, by marking everything said so far as
+// summarized without keeping a summary
+func (b *AIBot) resetThread(ctx context.Context, req *request) error {
+	reply := b.responderFor(ctx, req, req.channelID)
+	err := b.storage.PutThreadSummary(ctx, req.channelID, storage.ThreadSummary{
+		SummarizedThrough: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		_ = sendText(ctx, reply, "Whoops something went wrong processing that")
+		return fmt.Errorf("failed to reset thread context: %w", err)
+	}
+
+	return sendText(ctx, reply, "Okay, I've forgotten everything we talked about in here")
+}
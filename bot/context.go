@@ -0,0 +1,356 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+	gpt "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+	"openai-discord-bot/bot/provider"
+	"openai-discord-bot/bot/storage"
+)
+
+func init() {
+	// Use the BPE files embedded in the loader package, rather than downloading them at runtime
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+}
+
+const summarizationPrompt = "You maintain a running summary of a Discord conversation. Combine the existing summary with the new " +
+	"messages into a short summary that keeps names, facts, decisions and open questions. Reply with only the summary."
+
+// maxUnsummarizedPages caps how far back a thread is paged when loading turns that haven't been summarized, so that the
+// first message to an old busy thread doesn't load, and summarize, its whole history. Older turns are dropped instead
+const maxUnsummarizedPages = 5
+
+// imageTokens is roughly what an image costs a vision model, the real cost depends on its size and level of detail
+const imageTokens = 765
+
+// messageText is the text of a message, whether it's a plain or multipart message
+func messageText(message gpt.ChatCompletionMessage) string {
+	if len(message.MultiContent) == 0 {
+		return message.Content
+	}
+
+	var text []string
+	for _, part := range message.MultiContent {
+		if part.Type == gpt.ChatMessagePartTypeText {
+			text = append(text, part.Text)
+		} else if part.Type == gpt.ChatMessagePartTypeImageURL {
+			text = append(text, "[image]")
+		}
+	}
+	return strings.Join(text, " ")
+}
+
+func countImages(message gpt.ChatCompletionMessage) int {
+	images := 0
+	for _, part := range message.MultiContent {
+		if part.Type == gpt.ChatMessagePartTypeImageURL {
+			images++
+		}
+	}
+	return images
+}
+
+// tokenCounter counts the tokens a model will see for a list of chat messages, caching the encoding for each model
+type tokenCounter struct {
+	mu        sync.Mutex
+	encodings map[string]*tiktoken.Tiktoken
+}
+
+func newTokenCounter() *tokenCounter {
+	return &tokenCounter{encodings: make(map[string]*tiktoken.Tiktoken)}
+}
+
+func (t *tokenCounter) encoding(model string) (*tiktoken.Tiktoken, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if enc, ok := t.encodings[model]; ok {
+		return enc, nil
+	}
+
+	// Models tiktoken doesn't know about are counted with the encoding shared by most current chat models
+	enc, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		enc, err = tiktoken.GetEncoding(tiktoken.MODEL_CL100K_BASE)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.encodings[model] = enc
+	return enc, nil
+}
+
+// CountMessages follows OpenAI's guidance for chat models, each message costs a few tokens of framing on top of its content
+func (t *tokenCounter) CountMessages(model string, messages []gpt.ChatCompletionMessage) int {
+	enc, err := t.encoding(model)
+	count := 0
+	for _, message := range messages {
+		text := messageText(message)
+		count += 3 + imageTokens*countImages(message)
+		if err != nil {
+			// Without an encoding fall back to the rough rule of thumb of 4 characters per token
+			count += (len(message.Role) + len(text) + len(message.Name)) / 4
+			continue
+		}
+		count += len(enc.EncodeOrdinary(message.Role)) + len(enc.EncodeOrdinary(text))
+		if message.Name != "" {
+			count += len(enc.EncodeOrdinary(message.Name)) + 1
+		}
+	}
+	return count
+}
+
+// CountText counts the tokens in a piece of text, like a completion
+func (t *tokenCounter) CountText(model string, text string) int {
+	enc, err := t.encoding(model)
+	if err != nil {
+		return len(text) / 4
+	}
+	return len(enc.EncodeOrdinary(text))
+}
+
+// contextBuilder assembles the conversation context sent along with a prompt. It keeps as many of the newest turns of a
+// thread as fit within tokenBudget, and folds older turns into a rolling summary that is kept in the conversation store
+type contextBuilder struct {
+	provider    provider.Provider
+	storage     storage.ThreadStore
+	usage       *usageMeter
+	health      *healthMonitor
+	tokens      *tokenCounter
+	tokenBudget int
+	// pageSize is how many messages are loaded at a time, when paging back through turns that haven't been summarized
+	pageSize int
+}
+
+func newContextBuilder(aiProvider provider.Provider, conversationStorage storage.ThreadStore, usage *usageMeter, health *healthMonitor, tokenBudget int, pageSize int) *contextBuilder {
+	if pageSize <= 0 {
+		pageSize = storage.DefaultThreadLimit
+	}
+	return &contextBuilder{
+		provider:    aiProvider,
+		storage:     conversationStorage,
+		usage:       usage,
+		health:      health,
+		tokens:      newTokenCounter(),
+		tokenBudget: tokenBudget,
+		pageSize:    pageSize,
+	}
+}
+
+// Build returns the context messages for a thread, summarizing older turns if the thread no longer fits in the budget.
+// history is the newest page of the thread, turns older than it that haven't been summarized yet are loaded too, so
+// that they're folded into the summary rather than lost. Failing to load or update the summary isn't fatal, the oldest
+// turns are dropped instead. Summarizing is charged to the requester whose message needed it
+func (c *contextBuilder) Build(ctx context.Context, req *request, threadId string, model string, history []storage.ThreadMessage) []gpt.ChatCompletionMessage {
+	logger := slog.Default().WithGroup("contextBuilder")
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "buildThreadContext")
+	defer span.End()
+
+	summary, err := c.storage.GetThreadSummary(ctx, threadId)
+	if err != nil {
+		span.RecordError(err)
+		logger.WarnContext(ctx, "failed to load thread summary", slog.Any("error", err), slog.String("thread_id", threadId))
+		summary = nil
+	}
+
+	history, err = c.withUnsummarized(ctx, threadId, history, summary)
+	if err != nil {
+		span.RecordError(err)
+		logger.WarnContext(ctx, "failed to load older thread messages, dropping them", slog.Any("error", err), slog.String("thread_id", threadId))
+	}
+
+	// Only turns newer than the summary still need to be sent verbatim
+	var pending []storage.ThreadMessage
+	for _, message := range history {
+		if summary == nil || message.MessageUnixTime > summary.SummarizedThrough {
+			pending = append(pending, message)
+		}
+	}
+
+	turns := storage.ChatMessages(pending)
+	if c.tokens.CountMessages(model, turns)+c.summaryTokens(model, summary) > c.tokenBudget {
+		// Keep the newest turns within half the budget, so that we aren't summarizing again on every following message
+		kept := c.newestWithin(model, turns, c.tokenBudget/2)
+		folded := pending[:len(pending)-len(kept)]
+		turns = kept
+		if len(folded) == 0 {
+			return c.assemble(ctx, model, history, summary, turns)
+		}
+
+		// Fold the oldest turns in first, a chunk at a time so that each summary call fits in the budget, saving the
+		// summary after every chunk so that a failure part way through doesn't lose the chunks already folded in
+		for remaining := folded; len(remaining) > 0; {
+			chunk := remaining[:c.oldestWithin(model, remaining, c.tokenBudget-c.summaryTokens(model, summary))]
+			remaining = remaining[len(chunk):]
+
+			updated, err := c.summarize(ctx, req, model, summary, storage.ChatMessages(chunk))
+			if err != nil {
+				span.RecordError(err)
+				logger.WarnContext(ctx, "failed to summarize older thread messages, dropping them", slog.Any("error", err), slog.String("thread_id", threadId))
+				break
+			}
+			summary = &storage.ThreadSummary{
+				Summary:           updated,
+				SummarizedThrough: chunk[len(chunk)-1].MessageUnixTime,
+			}
+			err = c.storage.PutThreadSummary(ctx, threadId, *summary)
+			if err != nil {
+				span.RecordError(err)
+				logger.WarnContext(ctx, "failed to store thread summary", slog.Any("error", err), slog.String("thread_id", threadId))
+			}
+		}
+		span.SetAttributes(attribute.Int("folded_turns", len(folded)))
+	}
+
+	return c.assemble(ctx, model, history, summary, turns)
+}
+
+// withUnsummarized pages back from the oldest message in history until it reaches the turns the summary covers, the
+// start of the thread, or maxUnsummarizedPages. A page that isn't full is the start of the thread, so threads that fit
+// in one page aren't queried again. On failure history is returned with as many of the older turns as were loaded
+func (c *contextBuilder) withUnsummarized(ctx context.Context, threadId string, history []storage.ThreadMessage, summary *storage.ThreadSummary) ([]storage.ThreadMessage, error) {
+	var summarizedThrough int64
+	if summary != nil {
+		summarizedThrough = summary.SummarizedThrough
+	}
+
+	page := history
+	for pages := 0; pages < maxUnsummarizedPages && len(page) >= c.pageSize && page[0].MessageUnixTime > summarizedThrough; pages++ {
+		older, err := c.storage.GetThread(ctx, threadId, storage.ThreadQuery{Limit: c.pageSize, Before: page[0].MessageUnixTime})
+		if err != nil {
+			return history, fmt.Errorf("failed to load thread messages before %d: %w", page[0].MessageUnixTime, err)
+		}
+		history = slices.Concat(older, history)
+		page = older
+	}
+	return history, nil
+}
+
+// assemble puts the summary, if there is one, ahead of the verbatim turns
+func (c *contextBuilder) assemble(ctx context.Context, model string, history []storage.ThreadMessage, summary *storage.ThreadSummary, turns []gpt.ChatCompletionMessage) []gpt.ChatCompletionMessage {
+	var threadContext []gpt.ChatCompletionMessage
+	if hasSummary(summary) {
+		threadContext = append(threadContext, summaryMessage(summary))
+	}
+	threadContext = append(threadContext, turns...)
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.Int("history_turns", len(history)),
+		attribute.Int("context_turns", len(turns)),
+		attribute.Int("context_tokens", c.tokens.CountMessages(model, threadContext)),
+		attribute.Bool("summarized", hasSummary(summary)),
+	)
+	span.SetStatus(codes.Ok, "Success")
+	return threadContext
+}
+
+// hasSummary is false for threads which were reset, those only record where the forgotten history ends
+func hasSummary(summary *storage.ThreadSummary) bool {
+	return summary != nil && summary.Summary != ""
+}
+
+func summaryMessage(summary *storage.ThreadSummary) gpt.ChatCompletionMessage {
+	return gpt.ChatCompletionMessage{
+		Role:    gpt.ChatMessageRoleSystem,
+		Content: "Summary of the earlier conversation in this thread: " + summary.Summary,
+	}
+}
+
+func (c *contextBuilder) summaryTokens(model string, summary *storage.ThreadSummary) int {
+	if !hasSummary(summary) {
+		return 0
+	}
+	return c.tokens.CountMessages(model, []gpt.ChatCompletionMessage{summaryMessage(summary)})
+}
+
+// newestWithin returns the longest suffix of turns that fits within budget tokens
+func (c *contextBuilder) newestWithin(model string, turns []gpt.ChatCompletionMessage, budget int) []gpt.ChatCompletionMessage {
+	used := 0
+	for i := len(turns) - 1; i >= 0; i-- {
+		used += c.tokens.CountMessages(model, turns[i:i+1])
+		if used > budget {
+			return turns[i+1:]
+		}
+	}
+	return turns
+}
+
+// oldestWithin returns how many of the oldest messages fit within budget tokens, which is always at least one so that
+// a message longer than the budget is still summarized on its own
+func (c *contextBuilder) oldestWithin(model string, messages []storage.ThreadMessage, budget int) int {
+	used := 0
+	for i, message := range messages {
+		used += c.tokens.CountMessages(model, storage.ChatMessages([]storage.ThreadMessage{message}))
+		if used > budget {
+			return max(i, 1)
+		}
+	}
+	return len(messages)
+}
+
+// summarize asks the model to fold turns into the existing summary
+func (c *contextBuilder) summarize(ctx context.Context, req *request, model string, summary *storage.ThreadSummary, turns []gpt.ChatCompletionMessage) (string, error) {
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "summarizeThread")
+	defer span.End()
+
+	var transcript strings.Builder
+	if hasSummary(summary) {
+		transcript.WriteString("Existing summary:\n" + summary.Summary + "\n\n")
+	}
+	transcript.WriteString("New messages:\n")
+	for _, turn := range turns {
+		transcript.WriteString(turn.Role + ": " + messageText(turn) + "\n")
+	}
+
+	request := gpt.ChatCompletionRequest{
+		Model: model,
+		Messages: []gpt.ChatCompletionMessage{
+			{Role: gpt.ChatMessageRoleSystem, Content: summarizationPrompt},
+			{Role: gpt.ChatMessageRoleUser, Content: transcript.String()},
+		},
+	}
+	started := time.Now()
+	callCtx, callSpan, served := startGenAISpan(ctx, semconv.GenAIOperationNameChat, model, chatRequestAttributes(request)...)
+	response, err := c.provider.CreateChatCompletion(callCtx, request)
+	c.health.RecordOpenAI(err)
+	metrics.recordOpenAI(ctx, summaryFeature, served.ModelOr(model), started, err)
+	var completion chatCompletionTrace
+	if err == nil {
+		completion.observeResponse(response)
+	}
+	completion.end(callSpan, err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return "", fmt.Errorf("failed to summarize thread: %w", err)
+	}
+	c.usage.Record(ctx, req, served.ModelOr(model), storage.UsageRecord{
+		Provider:         served.Provider,
+		Model:            served.ModelOr(model),
+		Feature:          summaryFeature,
+		PromptTokens:     response.Usage.PromptTokens,
+		CompletionTokens: response.Usage.CompletionTokens,
+	})
+	if len(response.Choices) == 0 || response.Choices[0].Message.Content == "" {
+		err = fmt.Errorf("received an empty thread summary")
+		span.SetStatus(codes.Error, err.Error())
+		return "", err
+	}
+
+	span.SetAttributes(attribute.Int("summarized_turns", len(turns)))
+	span.SetStatus(codes.Ok, "Success")
+	return response.Choices[0].Message.Content, nil
+}
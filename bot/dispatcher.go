@@ -0,0 +1,177 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	errQueueFull        = errors.New("the work queue is full")
+	errDispatcherClosed = errors.New("the dispatcher is no longer accepting work")
+)
+
+// dispatcher runs jobs in the order they were submitted for each key, while jobs for different keys run in parallel on
+// at most workers goroutines at a time. At most queueSize jobs can be waiting to run, beyond that submissions are refused
+type dispatcher struct {
+	workers   chan struct{}
+	queueSize int
+
+	mu sync.Mutex
+	// pending holds the jobs waiting for each key, a key is present while a goroutine is working through its jobs
+	pending map[string][]func()
+	queued  int
+	closed  bool
+	// unfinished counts the jobs that have been accepted and haven't finished running
+	unfinished sync.WaitGroup
+}
+
+func newDispatcher(workers int, queueSize int) *dispatcher {
+	return &dispatcher{
+		workers:   make(chan struct{}, max(workers, 1)),
+		queueSize: queueSize,
+		pending:   make(map[string][]func()),
+	}
+}
+
+// Submit queues job to run after any earlier jobs for key. The job is refused if the queue is full, or the dispatcher
+// has been closed
+func (d *dispatcher) Submit(key string, job func()) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return errDispatcherClosed
+	}
+	if d.queued >= d.queueSize {
+		return errQueueFull
+	}
+	d.queued++
+	d.unfinished.Add(1)
+
+	jobs, running := d.pending[key]
+	d.pending[key] = append(jobs, job)
+	if !running {
+		go d.run(key)
+	}
+	return nil
+}
+
+// Close stops the dispatcher accepting new jobs, jobs that were already accepted still run
+func (d *dispatcher) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+}
+
+// Wait blocks until every accepted job has finished, or ctx is done. It should only be called after Close, otherwise
+// new jobs can keep it waiting forever
+func (d *dispatcher) Wait(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		d.unfinished.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for unfinished jobs, %d of them not yet started: %w", d.Queued(), ctx.Err())
+	}
+}
+
+// Queued is how many jobs are waiting to run
+func (d *dispatcher) Queued() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.queued
+}
+
+// Active is how many keys have jobs running or waiting to run
+func (d *dispatcher) Active() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+// run works through the jobs for key one at a time, taking a worker for each
+func (d *dispatcher) run(key string) {
+	for {
+		d.mu.Lock()
+		jobs := d.pending[key]
+		if len(jobs) == 0 {
+			delete(d.pending, key)
+			d.mu.Unlock()
+			return
+		}
+		job := jobs[0]
+		d.pending[key] = jobs[1:]
+		d.mu.Unlock()
+
+		d.workers <- struct{}{}
+		d.mu.Lock()
+		d.queued--
+		d.mu.Unlock()
+
+		d.runJob(key, job)
+		<-d.workers
+	}
+}
+
+// runJob keeps a panicking job from taking its worker, and the jobs queued behind it, down with it
+func (d *dispatcher) runJob(key string, job func()) {
+	defer d.unfinished.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Default().WithGroup("dispatcher").Error("job panicked", slog.String("key", key), slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+		}
+	}()
+	job()
+}
+
+// dispatch runs handle on the worker pool, after any earlier work in the same channel so that a thread's messages are
+// handled one at a time. If too much work is already waiting, or the bot is shutting down, the requester is told to
+// try again later instead
+func (b *AIBot) dispatch(ctx context.Context, req *request, handle func(ctx context.Context)) {
+	queuedAt := time.Now()
+	err := b.dispatcher.Submit(req.channelID, func() {
+		ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "dispatch")
+		defer span.End()
+		span.SetAttributes(attribute.Int64("queue_wait_ms", time.Since(queuedAt).Milliseconds()))
+		handle(ctx)
+	})
+	if err == nil {
+		return
+	}
+
+	slog.Default().WithGroup("dispatch").WarnContext(ctx, "turning a request away", slog.Any("error", err), slog.String("channel", req.channelID))
+	refusal := "I'm swamped right now, give me a minute and try again"
+	if errors.Is(err, errDispatcherClosed) {
+		refusal = "I'm just about to restart, give me a minute and try again"
+	}
+	_ = sendText(ctx, b.responderFor(ctx, req, req.channelID), refusal)
+}
+
+// dispatchPrompt handles a prompt on the worker pool. Rate limits are checked first, so that requests over the limit
+// never take up room in the queue
+func (b *AIBot) dispatchPrompt(ctx context.Context, req *request, prompt string, options promptOptions) {
+	// Pictures cost a lot more than replies, so they're limited separately
+	limitKind := chatLimit
+	if options.image {
+		limitKind = imageLimit
+	}
+	if !b.checkRateLimit(ctx, req, limitKind) {
+		return
+	}
+
+	b.dispatch(ctx, req, func(ctx context.Context) {
+		b.handlePrompt(ctx, req, prompt, options)
+	})
+}
@@ -0,0 +1,169 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitFor closes the dispatcher and waits for its jobs, failing the test if they don't finish promptly
+func waitFor(t *testing.T, d *dispatcher) {
+	t.Helper()
+	d.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Wait(ctx); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+}
+
+func TestDispatcherOrdersJobsPerKey(t *testing.T) {
+	d := newDispatcher(4, 1000)
+
+	var mu sync.Mutex
+	ran := make(map[string][]int)
+	for i := range 100 {
+		for _, key := range []string{"a", "b", "c"} {
+			err := d.Submit(key, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				ran[key] = append(ran[key], i)
+			})
+			if err != nil {
+				t.Fatalf("Submit() error = %v", err)
+			}
+		}
+	}
+	waitFor(t, d)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if len(ran[key]) != 100 || !slices.IsSorted(ran[key]) {
+			t.Errorf("jobs for %q ran in the order %v, want all 100 in the order they were submitted", key, ran[key])
+		}
+	}
+	if d.Active() != 0 || d.Queued() != 0 {
+		t.Errorf("Active(), Queued() = %d, %d, want nothing left once every job has run", d.Active(), d.Queued())
+	}
+}
+
+func TestDispatcherLimitsWorkers(t *testing.T) {
+	const workers = 3
+	d := newDispatcher(workers, 100)
+
+	var running, most atomic.Int32
+	for i := range 20 {
+		err := d.Submit(strconv.Itoa(i), func() {
+			now := running.Add(1)
+			for {
+				seen := most.Load()
+				if now <= seen || most.CompareAndSwap(seen, now) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+		})
+		if err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+	}
+	waitFor(t, d)
+
+	if most.Load() > workers {
+		t.Errorf("%d jobs ran at once, want at most %d", most.Load(), workers)
+	}
+}
+
+func TestDispatcherQueueFull(t *testing.T) {
+	d := newDispatcher(1, 2)
+
+	// The only worker is taken by a job that doesn't finish until it's released
+	started, release := make(chan struct{}), make(chan struct{})
+	if err := d.Submit("a", func() {
+		close(started)
+		<-release
+	}); err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	<-started
+
+	for _, key := range []string{"a", "b"} {
+		if err := d.Submit(key, func() {}); err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+	}
+	if err := d.Submit("c", func() {}); !errors.Is(err, errQueueFull) {
+		t.Errorf("Submit() error = %v, want %v", err, errQueueFull)
+	}
+	if d.Queued() != 2 {
+		t.Errorf("Queued() = %d, want the 2 waiting jobs", d.Queued())
+	}
+
+	// Once the queue drains there's room again
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Queued() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := d.Submit("c", func() {}); err != nil {
+		t.Errorf("Submit() error = %v once the queue drained", err)
+	}
+	waitFor(t, d)
+}
+
+func TestDispatcherRecoversFromPanics(t *testing.T) {
+	d := newDispatcher(1, 10)
+
+	var ran atomic.Bool
+	if err := d.Submit("a", func() { panic("oops") }); err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	if err := d.Submit("a", func() { ran.Store(true) }); err != nil {
+		t.Fatalf("Submit() error = %v", err)
+	}
+	waitFor(t, d)
+
+	if !ran.Load() {
+		t.Error("the job queued behind a panicking job didn't run")
+	}
+}
+
+func TestDispatcherCloseAndWait(t *testing.T) {
+	d := newDispatcher(1, 10)
+
+	release := make(chan struct{})
+	var ran atomic.Int32
+	for range 2 {
+		err := d.Submit("a", func() {
+			<-release
+			ran.Add(1)
+		})
+		if err != nil {
+			t.Fatalf("Submit() error = %v", err)
+		}
+	}
+
+	d.Close()
+	if err := d.Submit("a", func() {}); !errors.Is(err, errDispatcherClosed) {
+		t.Errorf("Submit() error = %v after Close, want %v", err, errDispatcherClosed)
+	}
+
+	// Jobs that are still running keep Wait waiting until it gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := d.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() error = %v, want it to give up", err)
+	}
+
+	// Jobs accepted before Close still run, and Wait returns once they have
+	close(release)
+	waitFor(t, d)
+	if ran.Load() != 2 {
+		t.Errorf("%d jobs ran, want both jobs accepted before Close", ran.Load())
+	}
+}
@@ -0,0 +1,181 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordMessageLimit is the longest message discord will accept. Lengths are measured in bytes, which is never less
+// than the number of characters discord counts
+const discordMessageLimit = 2000
+
+const codeFence = "```"
+
+// replyFormatter fits model output into discord messages, splitting long replies across several messages and
+// attaching replies longer than attachOver as a markdown file instead
+type replyFormatter struct {
+	limit      int
+	attachOver int
+}
+
+// Split breaks text into chunks that each fit in a message
+func (f replyFormatter) Split(text string) []string {
+	return splitReply(text, f.limit)
+}
+
+// Attach reports whether text is too long to be worth splitting into messages
+func (f replyFormatter) Attach(text string) bool {
+	return f.attachOver > 0 && len(text) > f.attachOver
+}
+
+// Send replies with text, split into as many messages as it needs or attached as a file
+func (f replyFormatter) Send(ctx context.Context, reply responder, text string) error {
+	if f.Attach(text) {
+		_, err := reply.Send(ctx, attachmentMessage(text))
+		return err
+	}
+
+	for _, chunk := range f.Split(text) {
+		if err := sendText(ctx, reply, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attachmentMessage carries text as a markdown file
+func attachmentMessage(text string) *discordgo.MessageSend {
+	return &discordgo.MessageSend{
+		Content: "That was a long one, so I wrote it down for you",
+		Files: []*discordgo.File{{
+			Name:        "reply.md",
+			ContentType: "text/markdown",
+			Reader:      strings.NewReader(text),
+		}},
+	}
+}
+
+// splitReply breaks text into chunks of at most limit bytes. It prefers to split between paragraphs, then between
+// lines, and avoids splitting fenced code blocks. A code block that won't fit in one chunk is closed at the end of
+// the chunk, and re-opened with the same language tag at the start of the next. Every chunk makes progress, so a limit
+// too small to fit a single character still ends, with chunks over the limit
+func splitReply(text string, limit int) []string {
+	var chunks []string
+	// openFence is the opening line of the code block the remaining text is inside of, if any
+	openFence := ""
+	for text != "" {
+		prefix := ""
+		if openFence != "" {
+			prefix = openFence + "\n"
+			// A language tag too long to repeat would leave no room for the code
+			if len(prefix) > limit/2 {
+				prefix = codeFence + "\n"
+			}
+		}
+		if len(prefix)+len(text) <= limit {
+			chunks = append(chunks, prefix+text)
+			break
+		}
+
+		// Leave room to close a code block the chunk ends inside of
+		budget := max(limit-len(prefix)-len("\n"+codeFence), 1)
+		cut := splitPoint(text, budget, openFence != "")
+		chunk := text[:cut]
+		openFence = fenceAfter(openFence, chunk)
+		if openFence != "" {
+			chunk = strings.TrimSuffix(chunk, "\n") + "\n" + codeFence
+		} else {
+			chunk = strings.TrimRight(chunk, "\n")
+		}
+		chunks = append(chunks, prefix+chunk)
+
+		text = text[cut:]
+		if openFence == "" {
+			// Blank lines between paragraphs would just be leading whitespace in the next message
+			text = strings.TrimLeft(text, "\n")
+		}
+	}
+	return chunks
+}
+
+// splitPoint picks where to end a chunk of at most budget bytes of text, which starts inside a code block if inFence.
+// The chunk is never empty
+func splitPoint(text string, budget int, inFence bool) int {
+	if len(text) <= budget {
+		return len(text)
+	}
+	paragraph, line, codeLine := 0, 0, 0
+	for pos := 0; pos < budget; {
+		end := strings.IndexByte(text[pos:], '\n')
+		if end < 0 || pos+end+1 > budget {
+			break
+		}
+		lineText := text[pos : pos+end]
+		pos += end + 1
+
+		opened := false
+		if strings.HasPrefix(strings.TrimSpace(lineText), codeFence) {
+			inFence = !inFence
+			opened = inFence
+		}
+		switch {
+		case opened:
+			// Ending a chunk straight after a code block opens would leave it with an empty block
+		case inFence:
+			codeLine = pos
+		case strings.TrimSpace(lineText) == "":
+			paragraph = pos
+		default:
+			line = pos
+		}
+	}
+
+	// Only settle for a line break if it doesn't leave the chunk mostly empty
+	switch {
+	case paragraph > budget/2:
+		return paragraph
+	case line > budget/2:
+		return line
+	case codeLine > 0:
+		return codeLine
+	case paragraph > 0:
+		return paragraph
+	case line > 0:
+		return line
+	}
+
+	// No line breaks at all, so fall back to a word break, and failing that any character boundary
+	if space := strings.LastIndexByte(text[:budget], ' '); space > budget/2 {
+		return space + 1
+	}
+	cut := budget
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if cut == 0 {
+		// Not even the first character fits, but it has to go somewhere
+		_, size := utf8.DecodeRuneInString(text)
+		return size
+	}
+	return cut
+}
+
+// fenceAfter follows the code fences in chunk, starting inside the block opened by openFence if it's set, and returns
+// the opening line of the block the chunk ends inside of
+func fenceAfter(openFence string, chunk string) string {
+	for _, line := range strings.Split(chunk, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, codeFence) {
+			continue
+		}
+		if openFence == "" {
+			openFence = trimmed
+		} else {
+			openFence = ""
+		}
+	}
+	return openFence
+}
@@ -0,0 +1,153 @@
+package bot
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+		// want is the exact chunks, when it's nil only the properties every split should have are checked
+		want []string
+		// rejoins means the chunks add back up to text, for text without line breaks to lose
+		rejoins bool
+	}{
+		{
+			name:  "fits",
+			text:  "Hello there",
+			limit: 20,
+			want:  []string{"Hello there"},
+		},
+		{
+			name:  "paragraphs",
+			text:  "First paragraph here\n\nSecond paragraph here",
+			limit: 30,
+			want:  []string{"First paragraph here", "Second paragraph here"},
+		},
+		{
+			name:  "lines",
+			text:  "one line\ntwo line\nthree line\nfour line",
+			limit: 24,
+			want:  []string{"one line\ntwo line", "three line\nfour line"},
+		},
+		{
+			name:  "words",
+			text:  "the quick brown fox jumps over the lazy dog",
+			limit: 20,
+			want:  []string{"the quick brown ", "fox jumps over ", "the lazy dog"},
+		},
+		{
+			name:  "code block split across chunks",
+			text:  "```go\nfmt.Println(1)\nfmt.Println(2)\nfmt.Println(3)\n```",
+			limit: 40,
+			want: []string{
+				"```go\nfmt.Println(1)\nfmt.Println(2)\n```",
+				"```go\nfmt.Println(3)\n```",
+			},
+		},
+		{
+			name:  "text before a code block",
+			text:  "Try this:\n```\nfirst()\nsecond()\n```\nDone",
+			limit: 24,
+		},
+		{
+			name:    "no whitespace",
+			text:    strings.Repeat("a", 25),
+			limit:   10,
+			rejoins: true,
+		},
+		{
+			name:    "multibyte runes",
+			text:    strings.Repeat("é", 30),
+			limit:   11,
+			rejoins: true,
+		},
+		{
+			name:    "multibyte runes and words",
+			text:    strings.Repeat("日本語 ", 20),
+			limit:   16,
+			rejoins: true,
+		},
+		{
+			name:  "code block with a first line longer than a chunk",
+			text:  "```go\n" + strings.Repeat("x := 1; ", 10) + "\n```",
+			limit: 30,
+		},
+		{
+			name:  "code block without whitespace",
+			text:  "```\n" + strings.Repeat("x", 60) + "\n```",
+			limit: 25,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitReply(tt.text, tt.limit)
+			if tt.want != nil && !slices.Equal(chunks, tt.want) {
+				t.Errorf("splitReply() = %q, want %q", chunks, tt.want)
+			}
+			if tt.rejoins && strings.Join(chunks, "") != tt.text {
+				t.Errorf("splitReply() = %q, which doesn't add back up to the text", chunks)
+			}
+
+			for _, chunk := range chunks {
+				if len(chunk) > tt.limit {
+					t.Errorf("chunk %q is %d bytes, over the limit of %d", chunk, len(chunk), tt.limit)
+				}
+				if !utf8.ValidString(chunk) {
+					t.Errorf("chunk %q splits a character", chunk)
+				}
+				if strings.TrimSpace(chunk) == "" {
+					t.Errorf("splitReply() = %q, which has an empty chunk", chunks)
+				}
+
+				fences := 0
+				var code []string
+				for _, line := range strings.Split(chunk, "\n") {
+					if strings.HasPrefix(strings.TrimSpace(line), codeFence) {
+						fences++
+					} else if fences%2 == 1 {
+						code = append(code, line)
+					}
+				}
+				if fences%2 != 0 {
+					t.Errorf("chunk %q leaves a code block open", chunk)
+				}
+				if fences > 0 && strings.TrimSpace(strings.Join(code, "")) == "" {
+					t.Errorf("chunk %q is an empty code block", chunk)
+				}
+			}
+		})
+	}
+}
+
+// TestSplitReplyAlwaysEnds splits text that can't be split well, which still has to make progress with every chunk
+func TestSplitReplyAlwaysEnds(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		limit int
+	}{
+		{name: "smaller than a character", text: "€€€", limit: 2},
+		{name: "smaller than a fence", text: "```go\ncode\n```", limit: 3},
+		{name: "zero", text: "hello", limit: 0},
+		{name: "language tag longer than a chunk", text: "```" + strings.Repeat("l", 40) + "\ncode\n```", limit: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitReply(tt.text, tt.limit)
+			if len(chunks) == 0 || len(chunks) > len(tt.text) {
+				t.Fatalf("splitReply() = %q, want at most a chunk per byte", chunks)
+			}
+			for _, chunk := range chunks {
+				if !utf8.ValidString(chunk) {
+					t.Errorf("chunk %q splits a character", chunk)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package bot
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"strings"
+
+	gpt "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+	"openai-discord-bot/bot/provider"
+)
+
+// contentEvent is the span event prompts and completions are recorded in, when content capture is turned on
+const contentEvent = "gen_ai.client.inference.operation.details"
+
+// contentCapture controls recording prompts and completions on spans. They're full of whatever people say to the bot,
+// so it's off unless TRACE_CONTENT is set
+type contentCapture struct {
+	enabled bool
+	// maxLength is the most characters of any one message that are recorded, longer messages are cut short
+	maxLength int
+}
+
+// The message formats from the GenAI semantic conventions, that prompts and completions are recorded in
+type (
+	genaiMessage struct {
+		Role         string      `json:"role"`
+		Parts        []genaiPart `json:"parts"`
+		FinishReason string      `json:"finish_reason,omitempty"`
+	}
+	genaiPart struct {
+		Type     string `json:"type"`
+		Content  string `json:"content,omitempty"`
+		Modality string `json:"modality,omitempty"`
+		URI      string `json:"uri,omitempty"`
+	}
+)
+
+// startGenAISpan starts a client span for a call to a provider, named and described the way the GenAI semantic
+// conventions ask for. The provider that serves the call fills in its name and the model it used, on the span and in
+// the returned Served
+func startGenAISpan(ctx context.Context, operation attribute.KeyValue, model string, attributes ...attribute.KeyValue) (context.Context, trace.Span, *provider.Served) {
+	ctx, served := provider.Track(ctx)
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, operation.Value.AsString()+" "+model,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(operation, semconv.GenAIRequestModel(model)),
+		trace.WithAttributes(attributes...),
+	)
+	return ctx, span, served
+}
+
+// chatRequestAttributes describes the settings a chat completion was requested with
+func chatRequestAttributes(request gpt.ChatCompletionRequest) []attribute.KeyValue {
+	attributes := []attribute.KeyValue{semconv.GenAIOutputTypeText}
+	if request.Temperature != 0 {
+		attributes = append(attributes, semconv.GenAIRequestTemperature(float64(request.Temperature)))
+	}
+	if request.TopP != 0 {
+		attributes = append(attributes, semconv.GenAIRequestTopP(float64(request.TopP)))
+	}
+	if request.MaxTokens != 0 {
+		attributes = append(attributes, semconv.GenAIRequestMaxTokens(request.MaxTokens))
+	}
+	if request.PresencePenalty != 0 {
+		attributes = append(attributes, semconv.GenAIRequestPresencePenalty(float64(request.PresencePenalty)))
+	}
+	if request.FrequencyPenalty != 0 {
+		attributes = append(attributes, semconv.GenAIRequestFrequencyPenalty(float64(request.FrequencyPenalty)))
+	}
+	return attributes
+}
+
+// chatCompletionTrace collects what a chat completion responded with, from either a whole response or the chunks of
+// a streamed one
+type chatCompletionTrace struct {
+	id            string
+	model         string
+	finishReasons []string
+	usage         *gpt.Usage
+}
+
+func (t *chatCompletionTrace) observeChunk(chunk gpt.ChatCompletionStreamResponse) {
+	t.id = cmp.Or(t.id, chunk.ID)
+	t.model = cmp.Or(t.model, chunk.Model)
+	if chunk.Usage != nil {
+		t.usage = chunk.Usage
+	}
+	for _, choice := range chunk.Choices {
+		if choice.FinishReason != "" {
+			t.finishReasons = append(t.finishReasons, string(choice.FinishReason))
+		}
+	}
+}
+
+func (t *chatCompletionTrace) observeResponse(response gpt.ChatCompletionResponse) {
+	t.id = response.ID
+	t.model = response.Model
+	t.usage = &response.Usage
+	for _, choice := range response.Choices {
+		t.finishReasons = append(t.finishReasons, string(choice.FinishReason))
+	}
+}
+
+// end records the response on span, and ends it
+func (t *chatCompletionTrace) end(span trace.Span, err error) {
+	defer span.End()
+	if t.id != "" {
+		span.SetAttributes(semconv.GenAIResponseID(t.id))
+	}
+	if t.model != "" {
+		span.SetAttributes(semconv.GenAIResponseModel(t.model))
+	}
+	if len(t.finishReasons) > 0 {
+		span.SetAttributes(semconv.GenAIResponseFinishReasons(t.finishReasons...))
+	}
+	if t.usage != nil {
+		span.SetAttributes(
+			semconv.GenAIUsageInputTokens(t.usage.PromptTokens),
+			semconv.GenAIUsageOutputTokens(t.usage.CompletionTokens),
+		)
+	}
+	endGenAISpan(span, err)
+}
+
+// endGenAISpan records how an OpenAI call went
+func endGenAISpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetAttributes(semconv.ErrorTypeKey.String(openaiErrorType(err)))
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.SetStatus(codes.Ok, "Success")
+}
+
+// recordChatContent records the messages sent to the model and what it replied with, if content capture is on
+func (c contentCapture) recordChatContent(span trace.Span, messages []gpt.ChatCompletionMessage, reply string, finishReasons []string) {
+	if !c.enabled {
+		return
+	}
+
+	var instructions []genaiPart
+	input := make([]genaiMessage, 0, len(messages))
+	for _, message := range messages {
+		if message.Role == gpt.ChatMessageRoleSystem {
+			instructions = append(instructions, genaiPart{Type: "text", Content: c.truncate(message.Content)})
+			continue
+		}
+		input = append(input, genaiMessage{Role: message.Role, Parts: c.messageParts(message)})
+	}
+
+	output := genaiMessage{Role: gpt.ChatMessageRoleAssistant, Parts: []genaiPart{{Type: "text", Content: c.truncate(reply)}}}
+	if len(finishReasons) > 0 {
+		output.FinishReason = finishReasons[0]
+	}
+
+	span.AddEvent(contentEvent, trace.WithAttributes(
+		semconv.GenAISystemInstructionsKey.String(marshalContent(instructions)),
+		semconv.GenAIInputMessagesKey.String(marshalContent(input)),
+		semconv.GenAIOutputMessagesKey.String(marshalContent([]genaiMessage{output})),
+	))
+}
+
+// recordImageContent records the prompt a picture was drawn from and where it ended up, if content capture is on
+func (c contentCapture) recordImageContent(span trace.Span, prompt string, image gpt.ImageResponseDataInner) {
+	if !c.enabled {
+		return
+	}
+
+	output := genaiMessage{Role: gpt.ChatMessageRoleAssistant, Parts: []genaiPart{{Type: "uri", Modality: "image", URI: image.URL}}}
+	if image.RevisedPrompt != "" {
+		// DALL·E 3 rewrites prompts before drawing them, which explains a lot of surprising pictures
+		output.Parts = append(output.Parts, genaiPart{Type: "text", Content: c.truncate(image.RevisedPrompt)})
+	}
+
+	span.AddEvent(contentEvent, trace.WithAttributes(
+		semconv.GenAIInputMessagesKey.String(marshalContent([]genaiMessage{{
+			Role:  gpt.ChatMessageRoleUser,
+			Parts: []genaiPart{{Type: "text", Content: c.truncate(prompt)}},
+		}})),
+		semconv.GenAIOutputMessagesKey.String(marshalContent([]genaiMessage{output})),
+	))
+}
+
+func (c contentCapture) messageParts(message gpt.ChatCompletionMessage) []genaiPart {
+	if len(message.MultiContent) == 0 {
+		return []genaiPart{{Type: "text", Content: c.truncate(message.Content)}}
+	}
+
+	parts := make([]genaiPart, 0, len(message.MultiContent))
+	for _, part := range message.MultiContent {
+		switch {
+		case part.Type == gpt.ChatMessagePartTypeText:
+			parts = append(parts, genaiPart{Type: "text", Content: c.truncate(part.Text)})
+		case part.ImageURL != nil:
+			uri := part.ImageURL.URL
+			// Downloaded images are sent inline, which is far too much to put on a span
+			if strings.HasPrefix(uri, "data:") {
+				uri = "data:(omitted)"
+			}
+			parts = append(parts, genaiPart{Type: "uri", Modality: "image", URI: uri})
+		}
+	}
+	return parts
+}
+
+func (c contentCapture) truncate(text string) string {
+	runes := []rune(text)
+	if c.maxLength <= 0 || len(runes) <= c.maxLength {
+		return text
+	}
+	return string(runes[:c.maxLength]) + "…"
+}
+
+func marshalContent(content any) string {
+	encoded, err := json.Marshal(content)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
@@ -0,0 +1,196 @@
+package bot
+
+import (
+	"fmt"
+	"math"
+
+	gpt "github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// GenerationSettings controls how replies and pictures are generated. Unset fields are inherited from a broader level
+// of configuration, and left to the API's defaults if nothing sets them
+type GenerationSettings struct {
+	// Persona is the ID of the persona that answers, its model is used unless Model is set for the guild or channel
+	Persona          string   `mapstructure:"persona"`
+	Model            string   `mapstructure:"model"`
+	Temperature      *float32 `mapstructure:"temperature"`
+	TopP             *float32 `mapstructure:"top_p"`
+	MaxTokens        *int     `mapstructure:"max_tokens"`
+	PresencePenalty  *float32 `mapstructure:"presence_penalty"`
+	FrequencyPenalty *float32 `mapstructure:"frequency_penalty"`
+	ImageModel       string   `mapstructure:"image_model"`
+	ImageSize        string   `mapstructure:"image_size"`
+	ImageQuality     string   `mapstructure:"image_quality"`
+	// Vision passes images shown to the bot along to the model, which has to support image input
+	Vision *bool `mapstructure:"vision"`
+}
+
+// GenerationConfig holds the default generation settings, and the overrides for specific guilds and channels
+type GenerationConfig struct {
+	Defaults GenerationSettings
+	Guilds   map[string]GenerationSettings `mapstructure:"guilds"`
+	Channels map[string]GenerationSettings `mapstructure:"channels"`
+}
+
+// loadGenerationConfig reads the default settings from CHAT_* and IMAGE_* settings, and any overrides from the
+// GENERATION_OVERRIDES section of the config file
+func loadGenerationConfig() (GenerationConfig, error) {
+	var generationConfig GenerationConfig
+	err := viper.UnmarshalKey("GENERATION_OVERRIDES", &generationConfig)
+	if err != nil {
+		return generationConfig, fmt.Errorf("failed to parse GENERATION_OVERRIDES: %w", err)
+	}
+
+	generationConfig.Defaults = GenerationSettings{
+		Persona:          viper.GetString("DEFAULT_PERSONA"),
+		Model:            viper.GetString("CHAT_MODEL"),
+		Temperature:      optionalFloat("CHAT_TEMPERATURE"),
+		TopP:             optionalFloat("CHAT_TOP_P"),
+		PresencePenalty:  optionalFloat("CHAT_PRESENCE_PENALTY"),
+		FrequencyPenalty: optionalFloat("CHAT_FREQUENCY_PENALTY"),
+		ImageModel:       viper.GetString("IMAGE_MODEL"),
+		ImageSize:        viper.GetString("IMAGE_SIZE"),
+		ImageQuality:     viper.GetString("IMAGE_QUALITY"),
+	}
+	if viper.IsSet("CHAT_VISION") {
+		vision := viper.GetBool("CHAT_VISION")
+		generationConfig.Defaults.Vision = &vision
+	}
+	if viper.IsSet("CHAT_MAX_TOKENS") {
+		maxTokens := viper.GetInt("CHAT_MAX_TOKENS")
+		generationConfig.Defaults.MaxTokens = &maxTokens
+	}
+	return generationConfig, nil
+}
+
+func optionalFloat(key string) *float32 {
+	if !viper.IsSet(key) {
+		return nil
+	}
+	value := float32(viper.GetFloat64(key))
+	return &value
+}
+
+// Resolve layers the overrides for a guild, a thread's parent channel, and the channel itself over the defaults
+func (g GenerationConfig) Resolve(guildID string, parentID string, channelID string) GenerationSettings {
+	settings := g.Defaults
+	settings = settings.merge(g.Guilds[guildID])
+	if parentID != "" {
+		settings = settings.merge(g.Channels[parentID])
+	}
+	return settings.merge(g.Channels[channelID])
+}
+
+// modelOverridden reports whether the guild, a thread's parent channel, or the channel sets a model, which a persona's
+// model doesn't replace
+func (g GenerationConfig) modelOverridden(guildID string, parentID string, channelID string) bool {
+	return g.Guilds[guildID].Model != "" || (parentID != "" && g.Channels[parentID].Model != "") ||
+		g.Channels[channelID].Model != ""
+}
+
+// merge returns a copy of s with every field that is set in override replaced
+func (s GenerationSettings) merge(override GenerationSettings) GenerationSettings {
+	if override.Persona != "" {
+		s.Persona = override.Persona
+	}
+	if override.Model != "" {
+		s.Model = override.Model
+	}
+	if override.Temperature != nil {
+		s.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		s.TopP = override.TopP
+	}
+	if override.MaxTokens != nil {
+		s.MaxTokens = override.MaxTokens
+	}
+	if override.PresencePenalty != nil {
+		s.PresencePenalty = override.PresencePenalty
+	}
+	if override.FrequencyPenalty != nil {
+		s.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if override.ImageModel != "" {
+		s.ImageModel = override.ImageModel
+	}
+	if override.ImageSize != "" {
+		s.ImageSize = override.ImageSize
+	}
+	if override.ImageQuality != "" {
+		s.ImageQuality = override.ImageQuality
+	}
+	if override.Vision != nil {
+		s.Vision = override.Vision
+	}
+	return s
+}
+
+func (s GenerationSettings) visionEnabled() bool {
+	return s.Vision != nil && *s.Vision
+}
+
+// chatRequest builds a completion request for messages using these settings
+func (s GenerationSettings) chatRequest(messages []gpt.ChatCompletionMessage) gpt.ChatCompletionRequest {
+	request := gpt.ChatCompletionRequest{
+		Model:    s.Model,
+		Messages: messages,
+	}
+	if s.Temperature != nil {
+		request.Temperature = nonZero(*s.Temperature)
+	}
+	if s.TopP != nil {
+		request.TopP = nonZero(*s.TopP)
+	}
+	if s.MaxTokens != nil {
+		request.MaxTokens = *s.MaxTokens
+	}
+	if s.PresencePenalty != nil {
+		request.PresencePenalty = *s.PresencePenalty
+	}
+	if s.FrequencyPenalty != nil {
+		request.FrequencyPenalty = *s.FrequencyPenalty
+	}
+	return request
+}
+
+// nonZero works around go-openai omitting zero values, which the API would treat as unset rather than as zero
+func nonZero(value float32) float32 {
+	if value == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return value
+}
+
+// chatAttributes records the resolved chat settings, so a trace shows what produced a given reply
+func (s GenerationSettings) chatAttributes() []attribute.KeyValue {
+	attributes := []attribute.KeyValue{attribute.String("model", s.Model)}
+	if s.Temperature != nil {
+		attributes = append(attributes, attribute.Float64("temperature", float64(*s.Temperature)))
+	}
+	if s.TopP != nil {
+		attributes = append(attributes, attribute.Float64("top_p", float64(*s.TopP)))
+	}
+	if s.MaxTokens != nil {
+		attributes = append(attributes, attribute.Int("max_tokens", *s.MaxTokens))
+	}
+	if s.PresencePenalty != nil {
+		attributes = append(attributes, attribute.Float64("presence_penalty", float64(*s.PresencePenalty)))
+	}
+	if s.FrequencyPenalty != nil {
+		attributes = append(attributes, attribute.Float64("frequency_penalty", float64(*s.FrequencyPenalty)))
+	}
+	attributes = append(attributes, attribute.Bool("vision", s.visionEnabled()))
+	return attributes
+}
+
+// imageAttributes records the resolved image settings
+func (s GenerationSettings) imageAttributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("model", s.ImageModel),
+		attribute.String("size", s.ImageSize),
+		attribute.String("quality", s.ImageQuality),
+	}
+}
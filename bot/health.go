@@ -0,0 +1,180 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"openai-discord-bot/bot/provider"
+)
+
+// maxOpenAIOutcomes caps how many recent OpenAI calls are remembered for working out the success rate
+const maxOpenAIOutcomes = 200
+
+// healthConfig controls when the bot reports itself unhealthy or not ready
+type healthConfig struct {
+	// gatewayGrace is how long the discord gateway can be disconnected, while discordgo reconnects, before the bot is
+	// unhealthy
+	gatewayGrace time.Duration
+	// openaiWindow is how far back OpenAI calls count towards the success rate
+	openaiWindow time.Duration
+	// openaiMinSuccessRate is the success rate below which the bot isn't ready
+	openaiMinSuccessRate float64
+}
+
+type openaiOutcome struct {
+	at time.Time
+	ok bool
+}
+
+// healthMonitor keeps track of the things the bot needs to work, the discord gateway, OpenAI, and conversation storage
+type healthMonitor struct {
+	healthConfig
+
+	mu             sync.Mutex
+	connected      bool
+	disconnectedAt time.Time
+	shuttingDown   bool
+	outcomes       []openaiOutcome
+}
+
+func newHealthMonitor(config healthConfig) *healthMonitor {
+	return &healthMonitor{
+		healthConfig: config,
+		// Not having connected yet counts as being disconnected since startup
+		disconnectedAt: time.Now(),
+	}
+}
+
+// GatewayConnected records the discord gateway (re)connecting
+func (h *healthMonitor) GatewayConnected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = true
+}
+
+// GatewayDisconnected records the discord gateway dropping
+func (h *healthMonitor) GatewayDisconnected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.connected {
+		h.connected = false
+		h.disconnectedAt = time.Now()
+	}
+}
+
+// ShuttingDown records that the bot has stopped taking on new work
+func (h *healthMonitor) ShuttingDown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shuttingDown = true
+}
+
+// RecordOpenAI records the outcome of an OpenAI call. Requests that OpenAI turned down, like a prompt that breaks
+// their content policy, still show it's working, so only errors that suggest OpenAI can't be used count as failures
+func (h *healthMonitor) RecordOpenAI(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.outcomes = append(h.outcomes, openaiOutcome{at: time.Now(), ok: !provider.Unavailable(err)})
+	if len(h.outcomes) > maxOpenAIOutcomes {
+		h.outcomes = h.outcomes[len(h.outcomes)-maxOpenAIOutcomes:]
+	}
+}
+
+// healthCheck is the state of one thing the bot depends on
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthReport is the state of everything the bot depends on
+type healthReport struct {
+	OK     bool                   `json:"ok"`
+	Checks map[string]healthCheck `json:"checks"`
+	Queued int                    `json:"queued"`
+}
+
+// gateway checks the discord gateway, which is allowed to be briefly disconnected when live is set
+func (h *healthMonitor) gateway(live bool) healthCheck {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.connected {
+		return healthCheck{OK: true}
+	}
+	down := time.Since(h.disconnectedAt).Round(time.Second)
+	return healthCheck{
+		OK:     live && down < h.gatewayGrace,
+		Detail: "disconnected for " + down.String(),
+	}
+}
+
+// openai checks the success rate of recent OpenAI calls. Without any recent calls there's nothing to go on, so it's
+// assumed to be fine
+func (h *healthMonitor) openai() healthCheck {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	since := time.Now().Add(-h.openaiWindow)
+	calls, succeeded := 0, 0
+	for _, outcome := range h.outcomes {
+		if outcome.at.Before(since) {
+			continue
+		}
+		calls++
+		if outcome.ok {
+			succeeded++
+		}
+	}
+	if calls == 0 {
+		return healthCheck{OK: true, Detail: "no recent calls"}
+	}
+	rate := float64(succeeded) / float64(calls)
+	return healthCheck{
+		OK:     rate >= h.openaiMinSuccessRate,
+		Detail: fmt.Sprintf("%.0f%% of %d recent calls succeeded", rate*100, calls),
+	}
+}
+
+func (h *healthMonitor) isShuttingDown() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.shuttingDown
+}
+
+// liveness is whether the bot is working at all, and should be restarted if not. Only a gateway connection that
+// hasn't come back counts, a broken dependency isn't fixed by restarting
+func (b *AIBot) liveness() healthReport {
+	gateway := b.health.gateway(true)
+	return healthReport{
+		OK:     gateway.OK,
+		Checks: map[string]healthCheck{"gateway": gateway},
+		Queued: b.dispatcher.Queued(),
+	}
+}
+
+// readiness is whether the bot can handle requests right now
+func (b *AIBot) readiness(ctx context.Context) healthReport {
+	checks := map[string]healthCheck{
+		"gateway": b.health.gateway(false),
+		"openai":  b.health.openai(),
+		"storage": {OK: true},
+	}
+	err := b.storage.Ping(ctx)
+	if err != nil {
+		checks["storage"] = healthCheck{OK: false, Detail: err.Error()}
+	}
+	if b.health.isShuttingDown() {
+		checks["lifecycle"] = healthCheck{OK: false, Detail: "shutting down"}
+	}
+
+	report := healthReport{OK: true, Checks: checks, Queued: b.dispatcher.Queued()}
+	for _, check := range checks {
+		report.OK = report.OK && check.OK
+	}
+	return report
+}
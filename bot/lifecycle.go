@@ -0,0 +1,122 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// lifecycleConfig controls how the bot starts up and shuts down
+type lifecycleConfig struct {
+	// shutdownTimeout is how long work that was already taken on gets to finish once the bot is asked to stop
+	shutdownTimeout time.Duration
+	// announcementChannels are told when the bot starts up and shuts down
+	announcementChannels []string
+	// watchPrompts reloads the personas whenever their prompt files change
+	watchPrompts bool
+}
+
+// Run connects to discord and handles events until ctx is done. It then stops taking on new work, and waits up to
+// SHUTDOWN_TIMEOUT for the work it already took on to finish before disconnecting
+func (b *AIBot) Run(ctx context.Context) error {
+	logger := slog.Default().WithGroup("Run")
+
+	// Health checks are served from before connecting, until all work in progress has finished
+	if b.server.address != "" {
+		serverCtx, stopServer := context.WithCancel(context.WithoutCancel(ctx))
+		served := make(chan struct{})
+		go func() {
+			defer close(served)
+			err := b.serve(serverCtx)
+			if err != nil {
+				logger.Error("health and admin server failed", slog.Any("error", err))
+			}
+		}()
+		defer func() {
+			stopServer()
+			<-served
+		}()
+	}
+
+	if b.lifecycle.watchPrompts {
+		go func() {
+			err := b.watchPrompts(ctx)
+			if err != nil {
+				logger.Error("stopped watching for prompt changes", slog.Any("error", err))
+			}
+		}()
+	}
+
+	b.discordSession.AddHandler(func(_ *discordgo.Session, _ *discordgo.Connect) { b.health.GatewayConnected() })
+	b.discordSession.AddHandler(func(_ *discordgo.Session, _ *discordgo.Disconnect) { b.health.GatewayDisconnected() })
+
+	// Handlers have to be added before connecting, or the first Ready event is missed
+	removeHandlers := []func(){
+		b.discordSession.AddHandler(b.ReadyHandler),
+		b.discordSession.AddHandler(b.messageCreate),
+		b.discordSession.AddHandler(b.interactionCreate),
+	}
+
+	err := b.discordSession.Open()
+	if err != nil {
+		return fmt.Errorf("failed to connect to discord: %w", err)
+	}
+	defer func() {
+		closeErr := b.discordSession.Close()
+		if closeErr != nil {
+			logger.Error("failed to close the discord connection", slog.Any("error", closeErr))
+		}
+	}()
+
+	b.announce(ctx, "Startup", "I'm back, not that anyone missed me")
+
+	<-ctx.Done()
+
+	// ctx is already done, but shutting down still needs somewhere to trace to
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(context.WithoutCancel(ctx), "Shutdown")
+	defer span.End()
+
+	// Stop listening first, so events arriving now go to whichever instance is replacing this one. Anything that got
+	// past the handlers is turned away by the dispatcher
+	logger.InfoContext(ctx, "shutting down, no longer taking on new work", slog.Int("queued", b.dispatcher.Queued()))
+	for _, remove := range removeHandlers {
+		remove()
+	}
+	b.dispatcher.Close()
+	b.health.ShuttingDown()
+
+	b.announce(ctx, "Shutdown", "Here I go, shutting down again!")
+
+	drainCtx, cancel := context.WithTimeout(ctx, b.lifecycle.shutdownTimeout)
+	defer cancel()
+	err = b.dispatcher.Wait(drainCtx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("failed to finish work in progress: %w", err)
+	}
+
+	logger.InfoContext(ctx, "finished all work in progress")
+	span.SetStatus(codes.Ok, "Success")
+	return nil
+}
+
+// announce posts a message to each of the announcement channels
+func (b *AIBot) announce(ctx context.Context, event string, message string) {
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "announce"+event)
+	defer span.End()
+
+	for _, channelID := range b.lifecycle.announcementChannels {
+		_, err := b.discordSession.ChannelMessageSend(channelID, message, discordgo.WithContext(ctx))
+		if err != nil {
+			span.RecordError(err)
+			slog.Default().WithGroup("announce").WarnContext(ctx, "failed to make an announcement", slog.Any("error", err), slog.String("channel", channelID))
+		}
+	}
+	span.SetStatus(codes.Ok, "Success")
+}
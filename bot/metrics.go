@@ -0,0 +1,176 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	gpt "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// The kinds of message counted by the messages metric
+const (
+	chatMessage   = "chat"
+	imageMessage  = "image"
+	threadMessage = "thread"
+)
+
+// botMetrics are the instruments the bot reports metrics through. They're made from the global meter provider, which
+// passes them on to the real provider once it's configured
+type botMetrics struct {
+	messages        metric.Int64Counter
+	openaiDuration  metric.Float64Histogram
+	discordDuration metric.Float64Histogram
+	tokens          metric.Int64Counter
+	cost            metric.Float64Counter
+	retries         metric.Int64Counter
+}
+
+var metrics = newBotMetrics()
+
+func newBotMetrics() *botMetrics {
+	meter := otel.GetMeterProvider().Meter("AIBot")
+	var m botMetrics
+	m.messages = instrument(meter.Int64Counter("bot.messages",
+		metric.WithDescription("Prompts handled, by type of message"),
+		metric.WithUnit("{message}")))
+	m.openaiDuration = instrument(meter.Float64Histogram("bot.openai.duration",
+		metric.WithDescription("How long OpenAI calls take, including reading a streamed response"),
+		metric.WithUnit("s")))
+	m.discordDuration = instrument(meter.Float64Histogram("bot.discord.duration",
+		metric.WithDescription("How long discord API requests take"),
+		metric.WithUnit("s")))
+	m.tokens = instrument(meter.Int64Counter("bot.openai.tokens",
+		metric.WithDescription("Tokens used, by model and whether they were prompt or completion tokens"),
+		metric.WithUnit("{token}")))
+	m.cost = instrument(meter.Float64Counter("bot.openai.cost",
+		metric.WithDescription("Estimated OpenAI spend"),
+		metric.WithUnit("USD")))
+	m.retries = instrument(meter.Int64Counter("bot.openai.retries",
+		metric.WithDescription("OpenAI calls retried after failing"),
+		metric.WithUnit("{retry}")))
+	return &m
+}
+
+// instrument logs instruments that couldn't be made, which still come back usable but record nothing
+func instrument[T any](instrument T, err error) T {
+	if err != nil {
+		slog.Default().WithGroup("metrics").Error("failed to create a metric instrument", slog.Any("error", err))
+	}
+	return instrument
+}
+
+// observeDispatcher reports how much work is queued, and how many channels and threads have work in progress
+func observeDispatcher(d *dispatcher) error {
+	meter := otel.GetMeterProvider().Meter("AIBot")
+	queued, err := meter.Int64ObservableGauge("bot.queue.depth",
+		metric.WithDescription("Requests waiting for a worker"),
+		metric.WithUnit("{request}"))
+	if err != nil {
+		return err
+	}
+	active, err := meter.Int64ObservableGauge("bot.threads.active",
+		metric.WithDescription("Channels and threads with requests in progress or waiting"),
+		metric.WithUnit("{thread}"))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, observer metric.Observer) error {
+		observer.ObserveInt64(queued, int64(d.Queued()))
+		observer.ObserveInt64(active, int64(d.Active()))
+		return nil
+	}, queued, active)
+	return err
+}
+
+// recordMessage counts a prompt being handled
+func (m *botMetrics) recordMessage(ctx context.Context, kind string, interaction bool) {
+	m.messages.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("type", kind),
+		attribute.Bool("slash_command", interaction),
+	))
+}
+
+// recordOpenAI records how long an OpenAI call took, and whether it failed
+func (m *botMetrics) recordOpenAI(ctx context.Context, operation string, model string, started time.Time, err error) {
+	attributes := []attribute.KeyValue{
+		attribute.String("operation", operation),
+		attribute.String("model", model),
+	}
+	if err != nil {
+		attributes = append(attributes, attribute.String("error", openaiErrorType(err)))
+	}
+	m.openaiDuration.Record(ctx, time.Since(started).Seconds(), metric.WithAttributes(attributes...))
+}
+
+// recordRetry counts an OpenAI call being retried
+func (m *botMetrics) recordRetry(ctx context.Context, operation string, model string) {
+	m.retries.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("operation", operation),
+		attribute.String("model", model),
+	))
+}
+
+// recordUsage counts the tokens and estimated cost of a call
+func (m *botMetrics) recordUsage(ctx context.Context, model string, feature string, promptTokens int, completionTokens int, cost float64) {
+	m.tokens.Add(ctx, int64(promptTokens), metric.WithAttributes(
+		attribute.String("model", model),
+		attribute.String("feature", feature),
+		attribute.String("type", "prompt"),
+	))
+	m.tokens.Add(ctx, int64(completionTokens), metric.WithAttributes(
+		attribute.String("model", model),
+		attribute.String("feature", feature),
+		attribute.String("type", "completion"),
+	))
+	m.cost.Add(ctx, cost, metric.WithAttributes(
+		attribute.String("model", model),
+		attribute.String("feature", feature),
+	))
+}
+
+// openaiErrorType sums up an OpenAI error without the detail that would make every error its own series
+func openaiErrorType(err error) string {
+	var apiErr *gpt.APIError
+	var requestErr *gpt.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		return strconv.Itoa(apiErr.HTTPStatusCode)
+	case errors.As(err, &requestErr):
+		return strconv.Itoa(requestErr.HTTPStatusCode)
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	default:
+		return "other"
+	}
+}
+
+// discordTransport times the requests the discord session makes
+type discordTransport struct {
+	next http.RoundTripper
+}
+
+func (t discordTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	started := time.Now()
+	response, err := t.next.RoundTrip(r)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(response.StatusCode)
+	}
+	// Paths are full of IDs, so only the method and status are recorded
+	metrics.discordDuration.Record(r.Context(), time.Since(started).Seconds(), metric.WithAttributes(
+		attribute.String("method", r.Method),
+		attribute.String("status", status),
+	))
+	return response, err
+}
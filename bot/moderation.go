@@ -0,0 +1,176 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	gpt "github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"openai-discord-bot/bot/provider"
+	"openai-discord-bot/bot/storage"
+)
+
+// defaultRefusal is what the bot says about blocked content when the prompt file doesn't set a refusal
+const defaultRefusal = "I'm not going to touch that one"
+
+// ModerationThresholds are the moderation category scores at or above which content is blocked, e.g.
+// "harassment": 0.5. Categories without a threshold are blocked whenever the moderation endpoint flags them, and a
+// threshold above 1 never blocks
+type ModerationThresholds map[string]float32
+
+// ModerationConfig holds the default moderation thresholds, and the overrides for specific guilds
+type ModerationConfig struct {
+	Thresholds ModerationThresholds            `mapstructure:"thresholds"`
+	Guilds     map[string]ModerationThresholds `mapstructure:"guilds"`
+}
+
+// moderationConfig controls the moderation stage, which checks prompts before they're acted on and replies before
+// they're kept
+type moderationConfig struct {
+	enabled bool
+	model   string
+	ModerationConfig
+}
+
+// loadModerationConfig reads MODERATION and MODERATION_MODEL, and thresholds from the MODERATION_THRESHOLDS section
+// of the config file
+func loadModerationConfig() (moderationConfig, error) {
+	config := moderationConfig{
+		enabled: viper.GetBool("MODERATION"),
+		model:   viper.GetString("MODERATION_MODEL"),
+	}
+	err := viper.UnmarshalKey("MODERATION_THRESHOLDS", &config.ModerationConfig)
+	if err != nil {
+		return config, fmt.Errorf("failed to parse MODERATION_THRESHOLDS: %w", err)
+	}
+	return config, nil
+}
+
+// thresholds layers a guild's thresholds over the defaults
+func (m moderationConfig) thresholds(guildID string) ModerationThresholds {
+	thresholds := maps.Clone(m.Thresholds)
+	if thresholds == nil {
+		thresholds = make(ModerationThresholds)
+	}
+	maps.Copy(thresholds, m.Guilds[guildID])
+	return thresholds
+}
+
+// moderationVerdict explains why content was blocked
+type moderationVerdict struct {
+	categories []string
+	scores     map[string]float32
+}
+
+func (v *moderationVerdict) String() string {
+	reasons := make([]string, 0, len(v.categories))
+	for _, category := range v.categories {
+		reasons = append(reasons, fmt.Sprintf("%s=%.2f", category, v.scores[category]))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// moderate checks text against the requester's guild thresholds, returning a verdict if it should be blocked, or nil
+// if it's fine
+func (b *AIBot) moderate(ctx context.Context, req *request, text string) (*moderationVerdict, error) {
+	if !b.moderation.enabled || strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "moderate")
+	defer span.End()
+	span.SetAttributes(attribute.String("model", b.moderation.model))
+
+	started := time.Now()
+	callCtx, served := provider.Track(ctx)
+	response, err := b.provider.Moderations(callCtx, gpt.ModerationRequest{
+		Model: b.moderation.model,
+		Input: text,
+	})
+	b.health.RecordOpenAI(err)
+	metrics.recordOpenAI(ctx, moderationFeature, served.ModelOr(b.moderation.model), started, err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, fmt.Errorf("failed to moderate content: %w", err)
+	}
+	b.usage.Record(ctx, req, served.ModelOr(b.moderation.model), storage.UsageRecord{
+		Provider: served.Provider,
+		Model:    served.ModelOr(b.moderation.model),
+		Feature:  moderationFeature,
+	})
+
+	thresholds := b.moderation.thresholds(req.guildID)
+	verdict := &moderationVerdict{scores: make(map[string]float32)}
+	for _, result := range response.Results {
+		flagged, scores, err := resultCategories(result)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+
+		for category, score := range scores {
+			threshold, ok := thresholds[category]
+			if (ok && score >= threshold) || (!ok && flagged[category]) {
+				verdict.scores[category] = max(verdict.scores[category], score)
+			}
+		}
+	}
+	verdict.categories = slices.Sorted(maps.Keys(verdict.scores))
+
+	span.SetAttributes(attribute.StringSlice("blocked_categories", verdict.categories))
+	span.SetStatus(codes.Ok, "Success")
+	if len(verdict.categories) == 0 {
+		return nil, nil
+	}
+	return verdict, nil
+}
+
+// resultCategories indexes a moderation result's flags and scores by category name, which is the JSON name of each
+// field of the result
+func resultCategories(result gpt.Result) (map[string]bool, map[string]float32, error) {
+	var flagged map[string]bool
+	var scores map[string]float32
+	if err := remarshal(result.Categories, &flagged); err != nil {
+		return nil, nil, fmt.Errorf("failed to read moderation result: %w", err)
+	}
+	if err := remarshal(result.CategoryScores, &scores); err != nil {
+		return nil, nil, fmt.Errorf("failed to read moderation result: %w", err)
+	}
+	return flagged, scores, nil
+}
+
+func remarshal(source any, target any) error {
+	encoded, err := json.Marshal(source)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, target)
+}
+
+// auditModeration records blocked content, so the guild's admins can see what was refused and why
+func (b *AIBot) auditModeration(ctx context.Context, req *request, action string, content string, verdict *moderationVerdict) {
+	err := b.storage.AddAuditRecord(ctx, storage.AuditRecord{
+		GuildId:    req.guildID,
+		RecordedAt: time.Now().UnixNano(),
+		ChannelId:  req.channelID,
+		UserId:     req.author.ID,
+		UserName:   req.author.Username,
+		Action:     action,
+		Detail:     verdict.String(),
+		Content:    content,
+	})
+	if err != nil {
+		slog.Default().WithGroup("auditModeration").ErrorContext(ctx, "failed to record moderation audit record", slog.Any("error", err))
+	}
+}
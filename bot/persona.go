@@ -0,0 +1,299 @@
+package bot
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/bwmarrin/discordgo"
+	gpt "github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"openai-discord-bot/bot/storage"
+)
+
+// persona is a personality the bot can play, loaded from a prompt file
+type persona struct {
+	// ID is how commands and config refer to the persona, the name of its prompt file without the extension
+	ID string `json:"-"`
+	// Version is a hash of the prompt file, which tells apart replies from before and after it was edited
+	Version string `json:"-"`
+	// Name is what the persona calls itself
+	Name string
+	// Description says what the persona is like, for picking one
+	Description string
+	// Model is the chat model the persona talks with, unless the guild or channel sets one
+	Model string
+	// Avatar is the URL of a picture of the persona
+	Avatar string
+	// Prompt starts every conversation with the persona
+	Prompt []gpt.ChatCompletionMessage
+	// Voice is the voice replies are read out loud in
+	Voice gpt.SpeechVoice
+	// Refusal is what's said instead of replying to, or with, something moderation blocked
+	Refusal string
+
+	// templates are the prompt messages that use variables, at the same index as in Prompt
+	templates []*template.Template
+}
+
+// parsePersona checks a prompt file, filling in defaults for anything it leaves out
+func parsePersona(name string, contents []byte) (*persona, error) {
+	p := &persona{}
+	err := json.Unmarshal(contents, p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse prompt file %s: %w", name, err)
+	}
+	p.ID = strings.TrimSuffix(name, path.Ext(name))
+	p.Version = promptVersion(contents)
+
+	if len(p.Prompt) == 0 {
+		return nil, fmt.Errorf("prompt file %s has no prompt messages", name)
+	}
+	for i, message := range p.Prompt {
+		if message.Role == "" || (message.Content == "" && len(message.MultiContent) == 0) {
+			return nil, fmt.Errorf("prompt file %s message %d needs both a role and content", name, i)
+		}
+	}
+
+	p.templates, err = parsePromptTemplates(name, p.Prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Name == "" {
+		p.Name = p.ID
+	}
+	if p.Voice == "" {
+		p.Voice = gpt.SpeechVoice(viper.GetString("SPEECH_VOICE"))
+	}
+	if p.Refusal == "" {
+		p.Refusal = defaultRefusal
+	}
+	return p, nil
+}
+
+// promptVersion is a short hash identifying prompt file contents
+func promptVersion(contents ...[]byte) string {
+	hash := sha256.New()
+	for _, c := range contents {
+		hash.Write(c)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+// personaSet is every persona in the prompt store
+type personaSet struct {
+	personas map[string]*persona
+	// fallback is the persona used when nothing picks one, or the one picked no longer exists
+	fallback string
+	// version is a hash of every prompt file, which changes whenever any of them do
+	version string
+}
+
+// loadPersonas loads every persona in the prompt store. Any broken prompt file fails the whole set, so that a bad edit
+// is noticed rather than a persona quietly going missing
+func loadPersonas(ctx context.Context, prompts storage.PromptStore, fallback string) (*personaSet, error) {
+	files, err := prompts.ReadPrompts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &personaSet{personas: make(map[string]*persona, len(files)), fallback: fallback}
+	names := slices.Sorted(maps.Keys(files))
+	versions := make([][]byte, 0, len(names))
+	for _, name := range names {
+		p, err := parsePersona(name, files[name])
+		if err != nil {
+			return nil, err
+		}
+		set.personas[p.ID] = p
+		versions = append(versions, []byte(name+"@"+p.Version+"\n"))
+	}
+	set.version = promptVersion(versions...)
+
+	if _, ok := set.personas[fallback]; !ok {
+		return nil, fmt.Errorf("the default persona %q has no prompt file", fallback)
+	}
+	return set, nil
+}
+
+// Get returns the persona with id, or the default persona if there isn't one
+func (s *personaSet) Get(id string) *persona {
+	if p, ok := s.personas[id]; ok {
+		return p
+	}
+	return s.personas[s.fallback]
+}
+
+// Has reports whether there's a persona with id
+func (s *personaSet) Has(id string) bool {
+	_, ok := s.personas[id]
+	return ok
+}
+
+// Sorted lists the personas by ID
+func (s *personaSet) Sorted() []*persona {
+	personas := make([]*persona, 0, len(s.personas))
+	for _, p := range s.personas {
+		personas = append(personas, p)
+	}
+	slices.SortFunc(personas, func(a, b *persona) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return personas
+}
+
+// personaSet is the personas currently in use
+func (b *AIBot) personaSet() *personaSet {
+	return b.personas.Load()
+}
+
+// ReloadPersonas re-reads the prompt store. The personas in use are only replaced if every prompt file loads, so a
+// broken edit leaves the bot as it was. Requests already in progress carry on with the personas they started with
+func (b *AIBot) ReloadPersonas(ctx context.Context) error {
+	logger := slog.Default().WithGroup("ReloadPersonas")
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "ReloadPersonas")
+	defer span.End()
+
+	current := b.personas.Load()
+	span.SetAttributes(attribute.String("previous_version", current.version))
+	personas, err := loadPersonas(ctx, b.prompts, current.fallback)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("kept prompt version %s: %w", current.version, err)
+	}
+	span.SetAttributes(attribute.String("prompt_version", personas.version))
+
+	if personas.version == current.version {
+		logger.DebugContext(ctx, "the prompts haven't changed", slog.String("prompt_version", current.version))
+		span.SetStatus(codes.Ok, "Success")
+		return nil
+	}
+	b.personas.Store(personas)
+
+	logger.InfoContext(ctx, "reloaded the personas",
+		slog.String("previous_version", current.version),
+		slog.String("prompt_version", personas.version),
+		slog.Int("personas", len(personas.personas)),
+	)
+	span.SetStatus(codes.Ok, "Success")
+	return nil
+}
+
+// watchPrompts reloads the personas whenever the prompt store changes, until ctx is done
+func (b *AIBot) watchPrompts(ctx context.Context) error {
+	return b.prompts.WatchPrompts(ctx, func() {
+		err := b.ReloadPersonas(ctx)
+		if err != nil {
+			slog.Default().WithGroup("watchPrompts").ErrorContext(ctx, "failed to reload the personas", slog.Any("error", err))
+		}
+	})
+}
+
+// personaCommand lets a thread switch persona with /persona use, and see the personas there are with /persona list
+func (b *AIBot) personaCommand(ctx context.Context, req *request, data discordgo.ApplicationCommandInteractionData) error {
+	reply := b.responderFor(ctx, req, req.channelID)
+	if len(data.Options) == 0 {
+		return sendText(ctx, reply, "I don't know how to do that")
+	}
+	subcommand := data.Options[0]
+	personas := b.personaSet()
+
+	if subcommand.Name == "list" {
+		settings, _ := b.generationSettings(ctx, req)
+		lines := make([]string, 0, len(personas.personas))
+		for _, p := range personas.Sorted() {
+			line := fmt.Sprintf("- **%s** (`%s`)", p.Name, p.ID)
+			if p.Description != "" {
+				line += ": " + p.Description
+			}
+			if p.ID == settings.Persona {
+				line += " ← talking here"
+			}
+			lines = append(lines, line)
+		}
+		return sendText(ctx, reply, strings.Join(lines, "\n"))
+	}
+
+	// Conversations outside of threads aren't remembered, so there's nowhere for the choice to stick
+	if ch, err := b.discordSession.State.Channel(req.channelID); err != nil || !ch.IsThread() {
+		return sendText(ctx, reply, "Personas can only be switched in threads, start one with /thread")
+	}
+
+	id := ""
+	if len(subcommand.Options) > 0 {
+		id = subcommand.Options[0].StringValue()
+	}
+	if !personas.Has(id) {
+		return sendText(ctx, reply, fmt.Sprintf("I don't know anyone called %q, /persona list shows who I can be", id))
+	}
+
+	err := b.storage.PutThreadPersona(ctx, req.channelID, id)
+	if err != nil {
+		_ = sendText(ctx, reply, "Whoops something went wrong processing that")
+		return fmt.Errorf("failed to store thread persona: %w", err)
+	}
+
+	// Bots can't change their name or avatar for a single message, so the persona introduces itself with an embed
+	p := personas.Get(id)
+	embed := &discordgo.MessageEmbed{
+		Title:       p.Name,
+		Description: p.Description,
+	}
+	if p.Avatar != "" {
+		embed.Thumbnail = &discordgo.MessageEmbedThumbnail{URL: p.Avatar}
+	}
+	_, err = reply.Send(ctx, &discordgo.MessageSend{
+		Content: "Okay, you're talking to someone else in here now",
+		Embeds:  []*discordgo.MessageEmbed{embed},
+	})
+	return err
+}
+
+// autocomplete suggests personas for /persona use, matching what's been typed so far against their IDs and names
+func (b *AIBot) autocomplete(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	data := i.ApplicationCommandData()
+	if data.Name != "persona" {
+		return
+	}
+
+	typed := ""
+	for _, subcommand := range data.Options {
+		for _, option := range subcommand.Options {
+			if option.Focused {
+				typed = strings.ToLower(option.StringValue())
+			}
+		}
+	}
+
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0)
+	for _, p := range b.personaSet().Sorted() {
+		if strings.Contains(strings.ToLower(p.ID), typed) || strings.Contains(strings.ToLower(p.Name), typed) {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: p.Name, Value: p.ID})
+		}
+	}
+	// Discord only shows the first 25 suggestions
+	if len(choices) > 25 {
+		choices = choices[:25]
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{Choices: choices},
+	})
+	if err != nil {
+		slog.Default().WithGroup("autocomplete").Error("failed to suggest personas", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,411 @@
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	gpt "github.com/sashabaranov/go-openai"
+)
+
+// anthropicVersion is the version of the Messages API requests are made against
+const anthropicVersion = "2023-06-01"
+
+// Anthropic is a Provider for Anthropic's Messages API. It can only chat, everything else is ErrUnsupported
+type Anthropic struct {
+	apiKey  string
+	baseURL string
+	// model is the Claude model every chat is had with, whichever model was asked for
+	model string
+	// maxTokens is the most a reply can be when the request doesn't say, the Messages API needs a limit
+	maxTokens  int
+	httpClient *http.Client
+}
+
+var _ Provider = (*Anthropic)(nil)
+
+func NewAnthropic(apiKey string, baseURL string, model string, maxTokens int, httpClient *http.Client) *Anthropic {
+	return &Anthropic{
+		apiKey:     apiKey,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		model:      model,
+		maxTokens:  maxTokens,
+		httpClient: httpClient,
+	}
+}
+
+func (a *Anthropic) Name() string {
+	return "anthropic"
+}
+
+// Model is always the configured Claude model, OpenAI's model names mean nothing to Anthropic
+func (a *Anthropic) Model(string) string {
+	return a.model
+}
+
+// The parts of the Messages API that are used
+type (
+	anthropicRequest struct {
+		Model         string             `json:"model"`
+		MaxTokens     int                `json:"max_tokens"`
+		System        string             `json:"system,omitempty"`
+		Messages      []anthropicMessage `json:"messages"`
+		Temperature   *float32           `json:"temperature,omitempty"`
+		TopP          *float32           `json:"top_p,omitempty"`
+		StopSequences []string           `json:"stop_sequences,omitempty"`
+		Stream        bool               `json:"stream,omitempty"`
+	}
+	anthropicMessage struct {
+		Role    string             `json:"role"`
+		Content []anthropicContent `json:"content"`
+	}
+	anthropicContent struct {
+		Type   string                `json:"type"`
+		Text   string                `json:"text,omitempty"`
+		Source *anthropicImageSource `json:"source,omitempty"`
+	}
+	anthropicImageSource struct {
+		Type      string `json:"type"`
+		MediaType string `json:"media_type,omitempty"`
+		Data      string `json:"data,omitempty"`
+		URL       string `json:"url,omitempty"`
+	}
+	anthropicResponse struct {
+		ID         string             `json:"id"`
+		Model      string             `json:"model"`
+		Content    []anthropicContent `json:"content"`
+		StopReason string             `json:"stop_reason"`
+		Usage      anthropicUsage     `json:"usage"`
+	}
+	anthropicUsage struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	}
+	anthropicError struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+)
+
+// anthropicOpeningTurn starts conversations that would otherwise start with the assistant, the Messages API wants the
+// user to go first
+const anthropicOpeningTurn = "(continuing an earlier conversation)"
+
+// anthropicRequestFor translates a chat completion request. System messages become the system prompt, and the rest
+// are grouped into turns, since the Messages API expects users and the assistant to take turns starting with the user.
+// Messages without any content are left out, the Messages API refuses empty text
+func (a *Anthropic) anthropicRequestFor(request gpt.ChatCompletionRequest, stream bool) anthropicRequest {
+	translated := anthropicRequest{
+		Model:         a.model,
+		MaxTokens:     max(request.MaxTokens, request.MaxCompletionTokens),
+		StopSequences: request.Stop,
+		Stream:        stream,
+	}
+	if translated.MaxTokens == 0 {
+		translated.MaxTokens = a.maxTokens
+	}
+	if request.Temperature != 0 {
+		// OpenAI's temperatures go up to 2, Anthropic's only to 1
+		temperature := min(request.Temperature, 1)
+		translated.Temperature = &temperature
+	}
+	if request.TopP != 0 {
+		translated.TopP = &request.TopP
+	}
+
+	var system []string
+	for _, message := range request.Messages {
+		if message.Role == gpt.ChatMessageRoleSystem || message.Role == gpt.ChatMessageRoleDeveloper {
+			if strings.TrimSpace(message.Content) != "" {
+				system = append(system, message.Content)
+			}
+			continue
+		}
+
+		role := "user"
+		if message.Role == gpt.ChatMessageRoleAssistant {
+			role = "assistant"
+		}
+		content := anthropicContentFor(message)
+		if len(content) == 0 {
+			continue
+		}
+		if last := len(translated.Messages) - 1; last >= 0 && translated.Messages[last].Role == role {
+			translated.Messages[last].Content = append(translated.Messages[last].Content, content...)
+			continue
+		}
+		translated.Messages = append(translated.Messages, anthropicMessage{Role: role, Content: content})
+	}
+	if len(translated.Messages) == 0 || translated.Messages[0].Role != "user" {
+		opening := anthropicMessage{Role: "user", Content: []anthropicContent{{Type: "text", Text: anthropicOpeningTurn}}}
+		translated.Messages = append([]anthropicMessage{opening}, translated.Messages...)
+	}
+	translated.System = strings.Join(system, "\n\n")
+	return translated
+}
+
+// anthropicContentFor translates a message into content blocks, leaving out text that's empty or only whitespace
+func anthropicContentFor(message gpt.ChatCompletionMessage) []anthropicContent {
+	if len(message.MultiContent) == 0 {
+		if strings.TrimSpace(message.Content) == "" {
+			return nil
+		}
+		return []anthropicContent{{Type: "text", Text: message.Content}}
+	}
+
+	content := make([]anthropicContent, 0, len(message.MultiContent))
+	for _, part := range message.MultiContent {
+		switch {
+		case part.Type == gpt.ChatMessagePartTypeText:
+			if strings.TrimSpace(part.Text) != "" {
+				content = append(content, anthropicContent{Type: "text", Text: part.Text})
+			}
+		case part.ImageURL != nil:
+			content = append(content, anthropicContent{Type: "image", Source: anthropicImageSourceFor(part.ImageURL.URL)})
+		}
+	}
+	return content
+}
+
+// anthropicImageSourceFor passes images on as they came, inline images are data: URIs which Anthropic wants split up
+func anthropicImageSourceFor(url string) *anthropicImageSource {
+	header, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !strings.HasPrefix(url, "data:") || !ok {
+		return &anthropicImageSource{Type: "url", URL: url}
+	}
+	return &anthropicImageSource{
+		Type:      "base64",
+		MediaType: strings.TrimSuffix(header, ";base64"),
+		Data:      data,
+	}
+}
+
+// finishReason translates why Anthropic stopped into OpenAI's terms
+func finishReason(stopReason string) gpt.FinishReason {
+	switch stopReason {
+	case "":
+		return ""
+	case "max_tokens":
+		return gpt.FinishReasonLength
+	case "tool_use":
+		return gpt.FinishReasonToolCalls
+	case "refusal":
+		return gpt.FinishReasonContentFilter
+	default:
+		return gpt.FinishReasonStop
+	}
+}
+
+// send posts a request to the Messages API, returning the response if it succeeded
+func (a *Anthropic) send(ctx context.Context, body anthropicRequest) (*http.Response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode anthropic request: %w", err)
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, a.baseURL+"/messages", bytes.NewReader(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create anthropic request: %w", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("X-Api-Key", a.apiKey)
+	httpRequest.Header.Set("Anthropic-Version", anthropicVersion)
+
+	response, err := a.httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		defer response.Body.Close()
+		return nil, anthropicAPIError(response)
+	}
+	return response, nil
+}
+
+// anthropicAPIError describes a failed request as a *gpt.APIError, so it's handled like an error from OpenAI
+func anthropicAPIError(response *http.Response) error {
+	apiErr := &gpt.APIError{
+		HTTPStatus:     response.Status,
+		HTTPStatusCode: response.StatusCode,
+		Message:        response.Status,
+	}
+	var body anthropicError
+	if json.NewDecoder(response.Body).Decode(&body) == nil && body.Error.Message != "" {
+		apiErr.Type = body.Error.Type
+		apiErr.Message = body.Error.Message
+	}
+	return apiErr
+}
+
+func (a *Anthropic) CreateChatCompletion(ctx context.Context, request gpt.ChatCompletionRequest) (gpt.ChatCompletionResponse, error) {
+	response, err := a.send(ctx, a.anthropicRequestFor(request, false))
+	if err != nil {
+		return gpt.ChatCompletionResponse{}, err
+	}
+	defer response.Body.Close()
+
+	var body anthropicResponse
+	err = json.NewDecoder(response.Body).Decode(&body)
+	if err != nil {
+		return gpt.ChatCompletionResponse{}, fmt.Errorf("failed to decode anthropic response: %w", err)
+	}
+
+	var text strings.Builder
+	for _, content := range body.Content {
+		if content.Type == "text" {
+			text.WriteString(content.Text)
+		}
+	}
+	return gpt.ChatCompletionResponse{
+		ID:    body.ID,
+		Model: body.Model,
+		Choices: []gpt.ChatCompletionChoice{{
+			Message:      gpt.ChatCompletionMessage{Role: gpt.ChatMessageRoleAssistant, Content: text.String()},
+			FinishReason: finishReason(body.StopReason),
+		}},
+		Usage: gpt.Usage{
+			PromptTokens:     body.Usage.InputTokens,
+			CompletionTokens: body.Usage.OutputTokens,
+			TotalTokens:      body.Usage.InputTokens + body.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+func (a *Anthropic) CreateChatCompletionStream(ctx context.Context, request gpt.ChatCompletionRequest) (ChatStream, error) {
+	response, err := a.send(ctx, a.anthropicRequestFor(request, true))
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(response.Body)
+	// Events are single lines of JSON, which can be long if the model is chatty
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return &anthropicStream{
+		body:         response.Body,
+		events:       scanner,
+		includeUsage: request.StreamOptions != nil && request.StreamOptions.IncludeUsage,
+	}, nil
+}
+
+// anthropicStream translates the server-sent events of a streamed message into chat completion chunks
+type anthropicStream struct {
+	body         io.ReadCloser
+	events       *bufio.Scanner
+	includeUsage bool
+
+	id    string
+	model string
+	usage anthropicUsage
+}
+
+// anthropicEvent is any of the events in a streamed message, each only fills in some of the fields
+type anthropicEvent struct {
+	Type    string            `json:"type"`
+	Message anthropicResponse `json:"message"`
+	Delta   struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (s *anthropicStream) Recv() (gpt.ChatCompletionStreamResponse, error) {
+	for s.events.Scan() {
+		data, ok := strings.CutPrefix(s.events.Text(), "data:")
+		if !ok {
+			continue
+		}
+
+		var event anthropicEvent
+		err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event)
+		if err != nil {
+			return gpt.ChatCompletionStreamResponse{}, fmt.Errorf("failed to decode anthropic event: %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			s.id, s.model = event.Message.ID, event.Message.Model
+			s.usage.InputTokens = event.Message.Usage.InputTokens
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" {
+				return s.chunk(gpt.ChatCompletionStreamChoiceDelta{Content: event.Delta.Text}, ""), nil
+			}
+		case "message_delta":
+			s.usage.OutputTokens = event.Usage.OutputTokens
+			if event.Delta.StopReason != "" {
+				return s.chunk(gpt.ChatCompletionStreamChoiceDelta{}, finishReason(event.Delta.StopReason)), nil
+			}
+		case "message_stop":
+			if !s.includeUsage {
+				return gpt.ChatCompletionStreamResponse{}, io.EOF
+			}
+			s.includeUsage = false
+			// Like OpenAI, the usage comes in a last chunk without any choices
+			return gpt.ChatCompletionStreamResponse{
+				ID:    s.id,
+				Model: s.model,
+				Usage: &gpt.Usage{
+					PromptTokens:     s.usage.InputTokens,
+					CompletionTokens: s.usage.OutputTokens,
+					TotalTokens:      s.usage.InputTokens + s.usage.OutputTokens,
+				},
+			}, nil
+		case "error":
+			// Errors part way through a stream don't come with a status code, overloaded_error is the usual one
+			return gpt.ChatCompletionStreamResponse{}, &gpt.APIError{
+				Type:           event.Error.Type,
+				Message:        event.Error.Message,
+				HTTPStatusCode: http.StatusServiceUnavailable,
+			}
+		}
+	}
+
+	if err := s.events.Err(); err != nil {
+		return gpt.ChatCompletionStreamResponse{}, err
+	}
+	return gpt.ChatCompletionStreamResponse{}, io.EOF
+}
+
+func (s *anthropicStream) chunk(delta gpt.ChatCompletionStreamChoiceDelta, reason gpt.FinishReason) gpt.ChatCompletionStreamResponse {
+	return gpt.ChatCompletionStreamResponse{
+		ID:      s.id,
+		Model:   s.model,
+		Choices: []gpt.ChatCompletionStreamChoice{{Delta: delta, FinishReason: reason}},
+	}
+}
+
+func (s *anthropicStream) Close() error {
+	return s.body.Close()
+}
+
+func (a *Anthropic) CreateImage(context.Context, gpt.ImageRequest) (gpt.ImageResponse, error) {
+	return gpt.ImageResponse{}, ErrUnsupported
+}
+
+func (a *Anthropic) CreateEmbeddings(context.Context, gpt.EmbeddingRequest) (gpt.EmbeddingResponse, error) {
+	return gpt.EmbeddingResponse{}, ErrUnsupported
+}
+
+func (a *Anthropic) CreateTranscription(context.Context, gpt.AudioRequest) (gpt.AudioResponse, error) {
+	return gpt.AudioResponse{}, ErrUnsupported
+}
+
+func (a *Anthropic) CreateSpeech(context.Context, gpt.CreateSpeechRequest) (gpt.RawResponse, error) {
+	return gpt.RawResponse{}, ErrUnsupported
+}
+
+func (a *Anthropic) Moderations(context.Context, gpt.ModerationRequest) (gpt.ModerationResponse, error) {
+	return gpt.ModerationResponse{}, ErrUnsupported
+}
@@ -0,0 +1,352 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	gpt "github.com/sashabaranov/go-openai"
+)
+
+// newAnthropicServer starts a fake Messages API, which hands each request to handler after checking it's authenticated
+func newAnthropicServer(t *testing.T, handler func(w http.ResponseWriter, request anthropicRequest)) *Anthropic {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Api-Key") != "test-key" || r.Header.Get("Anthropic-Version") != anthropicVersion {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`)
+			return
+		}
+
+		var request anthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		handler(w, request)
+	}))
+	t.Cleanup(server.Close)
+	return NewAnthropic("test-key", server.URL+"/v1/", "claude-test", 256, server.Client())
+}
+
+func TestAnthropicChat(t *testing.T) {
+	var received anthropicRequest
+	anthropic := newAnthropicServer(t, func(w http.ResponseWriter, request anthropicRequest) {
+		received = request
+		_, _ = io.WriteString(w, `{
+			"id": "msg_1",
+			"model": "claude-test",
+			"content": [{"type": "text", "text": "Hello "}, {"type": "text", "text": "there"}],
+			"stop_reason": "max_tokens",
+			"usage": {"input_tokens": 12, "output_tokens": 5}
+		}`)
+	})
+
+	response, err := anthropic.CreateChatCompletion(context.Background(), gpt.ChatCompletionRequest{
+		Model:       "gpt-4o",
+		Temperature: 1.5,
+		Messages: []gpt.ChatCompletionMessage{
+			{Role: gpt.ChatMessageRoleSystem, Content: "Be nice"},
+			{Role: gpt.ChatMessageRoleSystem, Content: "Be brief"},
+			{Role: gpt.ChatMessageRoleUser, Content: "Hi"},
+			{Role: gpt.ChatMessageRoleUser, MultiContent: []gpt.ChatMessagePart{
+				{Type: gpt.ChatMessagePartTypeText, Text: "Look"},
+				{Type: gpt.ChatMessagePartTypeImageURL, ImageURL: &gpt.ChatMessageImageURL{URL: "data:image/png;base64,aGk="}},
+			}},
+			{Role: gpt.ChatMessageRoleAssistant, Content: "Nice"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateChatCompletion() error = %v", err)
+	}
+
+	if received.Model != "claude-test" || received.MaxTokens != 256 || received.Stream {
+		t.Errorf("request model, max_tokens, stream = %q, %d, %v", received.Model, received.MaxTokens, received.Stream)
+	}
+	if received.Temperature == nil || *received.Temperature != 1 {
+		t.Errorf("request temperature = %v, want 1", received.Temperature)
+	}
+	if received.System != "Be nice\n\nBe brief" {
+		t.Errorf("request system = %q", received.System)
+	}
+	if len(received.Messages) != 2 || received.Messages[0].Role != "user" || received.Messages[1].Role != "assistant" {
+		t.Fatalf("request messages = %+v, want a user turn then an assistant turn", received.Messages)
+	}
+	user := received.Messages[0].Content
+	if len(user) != 3 || user[0].Text != "Hi" || user[1].Text != "Look" || user[2].Type != "image" {
+		t.Fatalf("user turn = %+v", user)
+	}
+	if source := user[2].Source; source.Type != "base64" || source.MediaType != "image/png" || source.Data != "aGk=" {
+		t.Errorf("image source = %+v", source)
+	}
+
+	if response.ID != "msg_1" || response.Model != "claude-test" {
+		t.Errorf("response id, model = %q, %q", response.ID, response.Model)
+	}
+	if len(response.Choices) != 1 || response.Choices[0].Message.Content != "Hello there" {
+		t.Fatalf("response choices = %+v", response.Choices)
+	}
+	if response.Choices[0].FinishReason != gpt.FinishReasonLength {
+		t.Errorf("finish reason = %q, want %q", response.Choices[0].FinishReason, gpt.FinishReasonLength)
+	}
+	if response.Usage != (gpt.Usage{PromptTokens: 12, CompletionTokens: 5, TotalTokens: 17}) {
+		t.Errorf("usage = %+v", response.Usage)
+	}
+}
+
+// turns describes each message of a request as its role and content, e.g. "user: Hi, [image]"
+func turns(messages []anthropicMessage) []string {
+	described := make([]string, 0, len(messages))
+	for _, message := range messages {
+		var blocks []string
+		for _, block := range message.Content {
+			if block.Type == "image" {
+				blocks = append(blocks, "[image]")
+				continue
+			}
+			blocks = append(blocks, block.Text)
+		}
+		described = append(described, message.Role+": "+strings.Join(blocks, ", "))
+	}
+	return described
+}
+
+func TestAnthropicChatTurns(t *testing.T) {
+	image := gpt.ChatMessagePart{Type: gpt.ChatMessagePartTypeImageURL, ImageURL: &gpt.ChatMessageImageURL{URL: "https://example.com/cat.png"}}
+	tests := []struct {
+		name     string
+		messages []gpt.ChatCompletionMessage
+		want     []string
+	}{
+		{
+			name: "starts with the assistant",
+			messages: []gpt.ChatCompletionMessage{
+				{Role: gpt.ChatMessageRoleSystem, Content: "Be nice"},
+				{Role: gpt.ChatMessageRoleAssistant, Content: "Welcome to the thread"},
+				{Role: gpt.ChatMessageRoleUser, Content: "Hi"},
+			},
+			want: []string{"user: " + anthropicOpeningTurn, "assistant: Welcome to the thread", "user: Hi"},
+		},
+		{
+			name: "empty messages are left out",
+			messages: []gpt.ChatCompletionMessage{
+				{Role: gpt.ChatMessageRoleUser, Content: "Hi"},
+				{Role: gpt.ChatMessageRoleAssistant, Content: ""},
+				{Role: gpt.ChatMessageRoleUser, Content: "  \n"},
+				{Role: gpt.ChatMessageRoleUser, Content: "Anyone there?"},
+			},
+			want: []string{"user: Hi, Anyone there?"},
+		},
+		{
+			name: "empty text parts are left out",
+			messages: []gpt.ChatCompletionMessage{
+				{Role: gpt.ChatMessageRoleUser, MultiContent: []gpt.ChatMessagePart{{Type: gpt.ChatMessagePartTypeText, Text: ""}, image}},
+				{Role: gpt.ChatMessageRoleAssistant, Content: "A cat"},
+			},
+			want: []string{"user: [image]", "assistant: A cat"},
+		},
+		{
+			name: "an empty message leaves the assistant first",
+			messages: []gpt.ChatCompletionMessage{
+				{Role: gpt.ChatMessageRoleUser, MultiContent: []gpt.ChatMessagePart{{Type: gpt.ChatMessagePartTypeText, Text: " "}}},
+				{Role: gpt.ChatMessageRoleAssistant, Content: "Hello?"},
+				{Role: gpt.ChatMessageRoleUser, Content: "Hi"},
+			},
+			want: []string{"user: " + anthropicOpeningTurn, "assistant: Hello?", "user: Hi"},
+		},
+		{
+			name: "nothing but the system prompt",
+			messages: []gpt.ChatCompletionMessage{
+				{Role: gpt.ChatMessageRoleSystem, Content: "Be nice"},
+				{Role: gpt.ChatMessageRoleUser, Content: ""},
+			},
+			want: []string{"user: " + anthropicOpeningTurn},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received anthropicRequest
+			anthropic := newAnthropicServer(t, func(w http.ResponseWriter, request anthropicRequest) {
+				received = request
+				_, _ = io.WriteString(w, `{"id":"msg_1","model":"claude-test","content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn"}`)
+			})
+
+			_, err := anthropic.CreateChatCompletion(context.Background(), gpt.ChatCompletionRequest{Messages: tt.messages})
+			if err != nil {
+				t.Fatalf("CreateChatCompletion() error = %v", err)
+			}
+			if got := turns(received.Messages); !slices.Equal(got, tt.want) {
+				t.Errorf("request turns = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnthropicChatError(t *testing.T) {
+	anthropic := newAnthropicServer(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		w.WriteHeader(529)
+		_, _ = io.WriteString(w, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`)
+	})
+
+	_, err := anthropic.CreateChatCompletion(context.Background(), gpt.ChatCompletionRequest{
+		Messages: []gpt.ChatCompletionMessage{{Role: gpt.ChatMessageRoleUser, Content: "Hi"}},
+	})
+	var apiErr *gpt.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("CreateChatCompletion() error = %v, want a *gpt.APIError", err)
+	}
+	if apiErr.HTTPStatusCode != 529 || apiErr.Type != "overloaded_error" || apiErr.Message != "Overloaded" {
+		t.Errorf("error = %+v", apiErr)
+	}
+	if !Unavailable(err) {
+		t.Errorf("Unavailable(%v) = false, want true", err)
+	}
+}
+
+// streamEvents is a streamed message as the Messages API sends it
+const streamEvents = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_2","model":"claude-test","usage":{"input_tokens":9,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type":"ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"lo"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":4}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+func TestAnthropicChatStream(t *testing.T) {
+	tests := []struct {
+		name         string
+		includeUsage bool
+	}{
+		{name: "without usage"},
+		{name: "with usage", includeUsage: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			anthropic := newAnthropicServer(t, func(w http.ResponseWriter, request anthropicRequest) {
+				if !request.Stream {
+					t.Error("request wasn't streamed")
+				}
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = io.WriteString(w, streamEvents)
+			})
+
+			request := gpt.ChatCompletionRequest{Messages: []gpt.ChatCompletionMessage{{Role: gpt.ChatMessageRoleUser, Content: "Hi"}}}
+			if tt.includeUsage {
+				request.StreamOptions = &gpt.StreamOptions{IncludeUsage: true}
+			}
+			stream, err := anthropic.CreateChatCompletionStream(context.Background(), request)
+			if err != nil {
+				t.Fatalf("CreateChatCompletionStream() error = %v", err)
+			}
+			defer stream.Close()
+
+			var text strings.Builder
+			var reasons []gpt.FinishReason
+			var usage *gpt.Usage
+			for {
+				chunk, err := stream.Recv()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Recv() error = %v", err)
+				}
+				if chunk.ID != "msg_2" || chunk.Model != "claude-test" {
+					t.Errorf("chunk id, model = %q, %q", chunk.ID, chunk.Model)
+				}
+				for _, choice := range chunk.Choices {
+					text.WriteString(choice.Delta.Content)
+					if choice.FinishReason != "" {
+						reasons = append(reasons, choice.FinishReason)
+					}
+				}
+				if chunk.Usage != nil {
+					usage = chunk.Usage
+				}
+			}
+
+			if text.String() != "Hello" {
+				t.Errorf("streamed text = %q, want %q", text.String(), "Hello")
+			}
+			if len(reasons) != 1 || reasons[0] != gpt.FinishReasonStop {
+				t.Errorf("finish reasons = %v, want [%s]", reasons, gpt.FinishReasonStop)
+			}
+			switch {
+			case !tt.includeUsage && usage != nil:
+				t.Errorf("usage = %+v, want none", usage)
+			case tt.includeUsage && (usage == nil || *usage != gpt.Usage{PromptTokens: 9, CompletionTokens: 4, TotalTokens: 13}):
+				t.Errorf("usage = %+v", usage)
+			}
+		})
+	}
+}
+
+func TestAnthropicChatStreamError(t *testing.T) {
+	anthropic := newAnthropicServer(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, `event: message_start
+data: {"type":"message_start","message":{"id":"msg_3","model":"claude-test"}}
+
+event: error
+data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}
+
+`)
+	})
+
+	stream, err := anthropic.CreateChatCompletionStream(context.Background(), gpt.ChatCompletionRequest{
+		Messages: []gpt.ChatCompletionMessage{{Role: gpt.ChatMessageRoleUser, Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatalf("CreateChatCompletionStream() error = %v", err)
+	}
+	defer stream.Close()
+
+	_, err = stream.Recv()
+	var apiErr *gpt.APIError
+	if !errors.As(err, &apiErr) || apiErr.Type != "overloaded_error" {
+		t.Fatalf("Recv() error = %v, want an overloaded_error", err)
+	}
+	if !Unavailable(err) {
+		t.Errorf("Unavailable(%v) = false, want true", err)
+	}
+}
+
+func TestAnthropicUnsupported(t *testing.T) {
+	anthropic := NewAnthropic("test-key", "http://localhost", "claude-test", 256, http.DefaultClient)
+	_, err := anthropic.CreateImage(context.Background(), gpt.ImageRequest{})
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("CreateImage() error = %v, want ErrUnsupported", err)
+	}
+	if Unavailable(err) {
+		t.Error("an unsupported call counted as the provider being unavailable")
+	}
+}
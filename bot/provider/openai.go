@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"context"
+
+	gpt "github.com/sashabaranov/go-openai"
+)
+
+// OpenAI is a Provider for OpenAI, or any API go-openai can talk to like Azure OpenAI and OpenAI compatible servers
+type OpenAI struct {
+	client *gpt.Client
+}
+
+var _ Provider = (*OpenAI)(nil)
+
+func NewOpenAI(client *gpt.Client) *OpenAI {
+	return &OpenAI{client: client}
+}
+
+func (o *OpenAI) Name() string {
+	return "openai"
+}
+
+func (o *OpenAI) Model(requested string) string {
+	return requested
+}
+
+func (o *OpenAI) CreateChatCompletion(ctx context.Context, request gpt.ChatCompletionRequest) (gpt.ChatCompletionResponse, error) {
+	return o.client.CreateChatCompletion(ctx, request)
+}
+
+func (o *OpenAI) CreateChatCompletionStream(ctx context.Context, request gpt.ChatCompletionRequest) (ChatStream, error) {
+	stream, err := o.client.CreateChatCompletionStream(ctx, request)
+	if err != nil {
+		// A nil *gpt.ChatCompletionStream would make a ChatStream that isn't nil
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (o *OpenAI) CreateImage(ctx context.Context, request gpt.ImageRequest) (gpt.ImageResponse, error) {
+	return o.client.CreateImage(ctx, request)
+}
+
+func (o *OpenAI) CreateEmbeddings(ctx context.Context, request gpt.EmbeddingRequest) (gpt.EmbeddingResponse, error) {
+	return o.client.CreateEmbeddings(ctx, request)
+}
+
+func (o *OpenAI) CreateTranscription(ctx context.Context, request gpt.AudioRequest) (gpt.AudioResponse, error) {
+	return o.client.CreateTranscription(ctx, request)
+}
+
+func (o *OpenAI) CreateSpeech(ctx context.Context, request gpt.CreateSpeechRequest) (gpt.RawResponse, error) {
+	return o.client.CreateSpeech(ctx, request)
+}
+
+func (o *OpenAI) Moderations(ctx context.Context, request gpt.ModerationRequest) (gpt.ModerationResponse, error) {
+	return o.client.Moderations(ctx, request)
+}
@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	gpt "github.com/sashabaranov/go-openai"
+)
+
+// ErrUnsupported is returned by providers for calls they can't make, like drawing pictures with a model that only chats
+var ErrUnsupported = errors.New("not supported by this provider")
+
+// Provider makes calls to a generative AI API. Requests and responses use go-openai's types whatever the API, and
+// errors from the API are returned as *gpt.APIError, so that they can all be handled the same way
+type Provider interface {
+	// Name identifies the provider, using the gen_ai.provider.name values from the GenAI semantic conventions
+	Name() string
+	// Model is the model the provider calls when requested is asked for
+	Model(requested string) string
+	CreateChatCompletion(ctx context.Context, request gpt.ChatCompletionRequest) (gpt.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, request gpt.ChatCompletionRequest) (ChatStream, error)
+	CreateImage(ctx context.Context, request gpt.ImageRequest) (gpt.ImageResponse, error)
+	CreateEmbeddings(ctx context.Context, request gpt.EmbeddingRequest) (gpt.EmbeddingResponse, error)
+	CreateTranscription(ctx context.Context, request gpt.AudioRequest) (gpt.AudioResponse, error)
+	CreateSpeech(ctx context.Context, request gpt.CreateSpeechRequest) (gpt.RawResponse, error)
+	Moderations(ctx context.Context, request gpt.ModerationRequest) (gpt.ModerationResponse, error)
+}
+
+// ChatStream is a chat completion being streamed back, Recv returns io.EOF once it's finished
+type ChatStream interface {
+	Recv() (gpt.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+// Unavailable reports whether an error from a provider means it's down, unreachable, or not letting us in. Requests
+// that were turned down, like a prompt that breaks a content policy, or a call it doesn't support, still show the
+// provider is working
+func Unavailable(err error) bool {
+	if err == nil || errors.Is(err, ErrUnsupported) {
+		return false
+	}
+
+	status := 0
+	var apiErr *gpt.APIError
+	var requestErr *gpt.RequestError
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.HTTPStatusCode
+	case errors.As(err, &requestErr):
+		status = requestErr.HTTPStatusCode
+	default:
+		// No response at all
+		return true
+	}
+	return status >= http.StatusInternalServerError || status == http.StatusUnauthorized ||
+		status == http.StatusForbidden || status == http.StatusTooManyRequests
+}
+
+// Served is which provider served a call, and the model it used. The Router fills it in as it tries each provider, so
+// when every provider fails it's the last one that was tried
+type Served struct {
+	Provider string
+	Model    string
+}
+
+type servedKey struct{}
+
+// Track returns a context that calls made with record who served them in the returned Served
+func Track(ctx context.Context) (context.Context, *Served) {
+	served := &Served{}
+	return context.WithValue(ctx, servedKey{}, served), served
+}
+
+// ModelOr is the model that was used, or requested if the call wasn't served by a provider that said which
+func (s *Served) ModelOr(requested string) string {
+	if s.Model == "" {
+		return requested
+	}
+	return s.Model
+}
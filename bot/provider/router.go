@@ -0,0 +1,192 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	gpt "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errNoProvider is returned when none of the providers can make a call
+var errNoProvider = errors.New("no provider can make this call")
+
+// Router is a Provider that makes each call with the first of its providers that can. A provider that fails is failed
+// over from to the next, and one that keeps failing is left alone for a while, so that calls don't wait on it timing out
+type Router struct {
+	routes []*route
+	// failureThreshold is how many calls in a row can fail before a provider is left alone
+	failureThreshold int
+	// cooldown is how long a failing provider is left alone, before it's given another chance
+	cooldown time.Duration
+}
+
+var _ Provider = (*Router)(nil)
+
+func NewRouter(providers []Provider, failureThreshold int, cooldown time.Duration) *Router {
+	routes := make([]*route, 0, len(providers))
+	for _, p := range providers {
+		routes = append(routes, &route{provider: p})
+	}
+	return &Router{routes: routes, failureThreshold: failureThreshold, cooldown: cooldown}
+}
+
+// route is a provider, and the circuit breaker keeping track of whether it's working
+type route struct {
+	provider Provider
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// available reports whether the circuit is closed, or has been open long enough to try again
+func (r *route) available(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !now.Before(r.openUntil)
+}
+
+func (r *route) succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = 0
+	r.openUntil = time.Time{}
+}
+
+// failed records a failure, opening the circuit once there have been too many in a row. A provider that's given
+// another chance and fails again goes straight back to being left alone
+func (r *route) failed(threshold int, cooldown time.Duration) (opened bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+	if r.failures < threshold {
+		return false
+	}
+	r.openUntil = time.Now().Add(cooldown)
+	return true
+}
+
+// Model is the model the first provider that's likely to be tried calls
+func (r *Router) Model(requested string) string {
+	if len(r.routes) == 0 {
+		return requested
+	}
+	return r.candidates()[0].provider.Model(requested)
+}
+
+func (r *Router) Name() string {
+	names := make([]string, 0, len(r.routes))
+	for _, route := range r.routes {
+		names = append(names, route.provider.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// candidates are the routes to try, in order. When every circuit is open it's better to try them anyway than to fail
+// without trying
+func (r *Router) candidates() []*route {
+	now := time.Now()
+	candidates := make([]*route, 0, len(r.routes))
+	for _, route := range r.routes {
+		if route.available(now) {
+			candidates = append(candidates, route)
+		}
+	}
+	if len(candidates) == 0 {
+		return r.routes
+	}
+	return candidates
+}
+
+// routeCall makes a call with each provider in turn, until one of them succeeds, or fails in a way another provider
+// wouldn't fix. Each provider that's tried is recorded on the current span, and in the Served being tracked, so that
+// both end up describing the provider that answered, or the last one to fail
+func routeCall[T any](ctx context.Context, r *Router, operation string, model string, call func(Provider) (T, error)) (T, error) {
+	logger := slog.Default().WithGroup("Router")
+	span := trace.SpanFromContext(ctx)
+	served, _ := ctx.Value(servedKey{}).(*Served)
+
+	var zero T
+	err := errNoProvider
+	for _, route := range r.candidates() {
+		name := route.provider.Name()
+		if served != nil {
+			served.Provider, served.Model = name, route.provider.Model(model)
+		}
+		span.SetAttributes(semconv.GenAIProviderNameKey.String(name), semconv.GenAIRequestModel(route.provider.Model(model)))
+		result, callErr := call(route.provider)
+		if errors.Is(callErr, ErrUnsupported) {
+			if errors.Is(err, errNoProvider) {
+				err = callErr
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			return result, callErr
+		}
+		if !Unavailable(callErr) {
+			route.succeeded()
+			return result, callErr
+		}
+
+		err = callErr
+		opened := route.failed(r.failureThreshold, r.cooldown)
+		logger.WarnContext(ctx, "provider failed, trying the next one", slog.String("provider", name), slog.String("operation", operation), slog.Bool("circuit_open", opened), slog.Any("error", callErr))
+		span.AddEvent("failover", trace.WithAttributes(
+			attribute.String("provider", name),
+			attribute.Bool("circuit_open", opened),
+			attribute.String("error", callErr.Error()),
+		))
+	}
+	return zero, err
+}
+
+func (r *Router) CreateChatCompletion(ctx context.Context, request gpt.ChatCompletionRequest) (gpt.ChatCompletionResponse, error) {
+	return routeCall(ctx, r, "chat", request.Model, func(p Provider) (gpt.ChatCompletionResponse, error) {
+		return p.CreateChatCompletion(ctx, request)
+	})
+}
+
+// CreateChatCompletionStream only fails over while starting a stream, once part of a reply has arrived it's too late
+func (r *Router) CreateChatCompletionStream(ctx context.Context, request gpt.ChatCompletionRequest) (ChatStream, error) {
+	return routeCall(ctx, r, "chat", request.Model, func(p Provider) (ChatStream, error) {
+		return p.CreateChatCompletionStream(ctx, request)
+	})
+}
+
+func (r *Router) CreateImage(ctx context.Context, request gpt.ImageRequest) (gpt.ImageResponse, error) {
+	return routeCall(ctx, r, "image", request.Model, func(p Provider) (gpt.ImageResponse, error) {
+		return p.CreateImage(ctx, request)
+	})
+}
+
+func (r *Router) CreateEmbeddings(ctx context.Context, request gpt.EmbeddingRequest) (gpt.EmbeddingResponse, error) {
+	return routeCall(ctx, r, "embeddings", string(request.Model), func(p Provider) (gpt.EmbeddingResponse, error) {
+		return p.CreateEmbeddings(ctx, request)
+	})
+}
+
+func (r *Router) CreateTranscription(ctx context.Context, request gpt.AudioRequest) (gpt.AudioResponse, error) {
+	return routeCall(ctx, r, "transcription", request.Model, func(p Provider) (gpt.AudioResponse, error) {
+		return p.CreateTranscription(ctx, request)
+	})
+}
+
+func (r *Router) CreateSpeech(ctx context.Context, request gpt.CreateSpeechRequest) (gpt.RawResponse, error) {
+	return routeCall(ctx, r, "speech", string(request.Model), func(p Provider) (gpt.RawResponse, error) {
+		return p.CreateSpeech(ctx, request)
+	})
+}
+
+func (r *Router) Moderations(ctx context.Context, request gpt.ModerationRequest) (gpt.ModerationResponse, error) {
+	return routeCall(ctx, r, "moderation", request.Model, func(p Provider) (gpt.ModerationResponse, error) {
+		return p.Moderations(ctx, request)
+	})
+}
@@ -0,0 +1,221 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gpt "github.com/sashabaranov/go-openai"
+)
+
+// fakeOpenAI is an OpenAI API that answers every call with status, counting the calls made to it
+type fakeOpenAI struct {
+	status atomic.Int32
+	calls  atomic.Int32
+}
+
+func newFakeOpenAI(t *testing.T, status int) (*fakeOpenAI, *OpenAI) {
+	t.Helper()
+	fake := &fakeOpenAI{}
+	fake.status.Store(int32(status))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		status := int(fake.status.Load())
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			_, _ = io.WriteString(w, `{"error":{"message":"something went wrong","type":"server_error"}}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{
+			"id": "chatcmpl-1",
+			"model": "gpt-4o",
+			"choices": [{"index": 0, "message": {"role": "assistant", "content": "from openai"}, "finish_reason": "stop"}]
+		}`)
+	}))
+	t.Cleanup(server.Close)
+
+	config := gpt.DefaultConfig("test-token")
+	config.BaseURL = server.URL + "/v1"
+	config.HTTPClient = server.Client()
+	return fake, NewOpenAI(gpt.NewClientWithConfig(config))
+}
+
+// newFallback is an Anthropic provider that always answers, counting the calls made to it
+func newFallback(t *testing.T) (*atomic.Int32, *Anthropic) {
+	t.Helper()
+	calls := &atomic.Int32{}
+	return calls, newAnthropicServer(t, func(w http.ResponseWriter, _ anthropicRequest) {
+		calls.Add(1)
+		_, _ = io.WriteString(w, `{"id":"msg_1","model":"claude-test","content":[{"type":"text","text":"from anthropic"}],"stop_reason":"end_turn"}`)
+	})
+}
+
+// chat makes a chat completion through router, returning who answered it
+func chat(t *testing.T, router *Router) (string, Served, error) {
+	t.Helper()
+	ctx, served := Track(context.Background())
+	response, err := router.CreateChatCompletion(ctx, gpt.ChatCompletionRequest{
+		Model:    "gpt-4o",
+		Messages: []gpt.ChatCompletionMessage{{Role: gpt.ChatMessageRoleUser, Content: "Hi"}},
+	})
+	if err != nil || len(response.Choices) == 0 {
+		return "", *served, err
+	}
+	return response.Choices[0].Message.Content, *served, nil
+}
+
+func TestRouterFailover(t *testing.T) {
+	primary, openai := newFakeOpenAI(t, http.StatusServiceUnavailable)
+	fallbackCalls, anthropic := newFallback(t)
+	router := NewRouter([]Provider{openai, anthropic}, 3, time.Minute)
+
+	reply, served, err := chat(t, router)
+	if err != nil {
+		t.Fatalf("chat error = %v", err)
+	}
+	if reply != "from anthropic" {
+		t.Errorf("reply = %q, want the fallback's", reply)
+	}
+	if served != (Served{Provider: "anthropic", Model: "claude-test"}) {
+		t.Errorf("served = %+v, want anthropic's claude-test", served)
+	}
+	if primary.calls.Load() != 1 || fallbackCalls.Load() != 1 {
+		t.Errorf("calls = %d, %d, want each provider tried once", primary.calls.Load(), fallbackCalls.Load())
+	}
+
+	// Once the primary is back it answers again
+	primary.status.Store(http.StatusOK)
+	reply, served, err = chat(t, router)
+	if err != nil {
+		t.Fatalf("chat error = %v", err)
+	}
+	if reply != "from openai" || served != (Served{Provider: "openai", Model: "gpt-4o"}) {
+		t.Errorf("reply, served = %q, %+v, want openai's gpt-4o", reply, served)
+	}
+}
+
+func TestRouterDoesntFailOverRejectedRequests(t *testing.T) {
+	primary, openai := newFakeOpenAI(t, http.StatusBadRequest)
+	fallbackCalls, anthropic := newFallback(t)
+	router := NewRouter([]Provider{openai, anthropic}, 1, time.Minute)
+
+	for range 2 {
+		_, served, err := chat(t, router)
+		var apiErr *gpt.APIError
+		if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusBadRequest {
+			t.Fatalf("chat error = %v, want the primary's bad request", err)
+		}
+		if served.Provider != "openai" {
+			t.Errorf("served = %+v, want openai", served)
+		}
+	}
+	if primary.calls.Load() != 2 || fallbackCalls.Load() != 0 {
+		t.Errorf("calls = %d, %d, want only the primary tried, with its circuit left closed", primary.calls.Load(), fallbackCalls.Load())
+	}
+}
+
+func TestRouterCircuitBreaker(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	primary, openai := newFakeOpenAI(t, http.StatusServiceUnavailable)
+	fallbackCalls, anthropic := newFallback(t)
+	router := NewRouter([]Provider{openai, anthropic}, 2, cooldown)
+
+	// Failures below the threshold keep the primary in use
+	for range 2 {
+		if _, _, err := chat(t, router); err != nil {
+			t.Fatalf("chat error = %v", err)
+		}
+	}
+	if primary.calls.Load() != 2 {
+		t.Fatalf("primary calls = %d, want 2 before the circuit opens", primary.calls.Load())
+	}
+
+	// Open, the primary is left alone
+	_, served, err := chat(t, router)
+	if err != nil {
+		t.Fatalf("chat error = %v", err)
+	}
+	if primary.calls.Load() != 2 || served.Provider != "anthropic" {
+		t.Errorf("primary calls = %d, served = %+v, want the open circuit skipped", primary.calls.Load(), served)
+	}
+	if router.Model("gpt-4o") != "claude-test" {
+		t.Errorf("Model() = %q, want the fallback's while the circuit is open", router.Model("gpt-4o"))
+	}
+
+	// Half open after the cooldown, one more failure opens it again straight away
+	time.Sleep(cooldown + 10*time.Millisecond)
+	if _, _, err := chat(t, router); err != nil {
+		t.Fatalf("chat error = %v", err)
+	}
+	if primary.calls.Load() != 3 {
+		t.Errorf("primary calls = %d, want a second chance after the cooldown", primary.calls.Load())
+	}
+	if _, _, err := chat(t, router); err != nil {
+		t.Fatalf("chat error = %v", err)
+	}
+	if primary.calls.Load() != 3 {
+		t.Errorf("primary calls = %d, want the circuit open again after failing its second chance", primary.calls.Load())
+	}
+
+	// Half open again, and this time the primary has recovered, which closes the circuit
+	primary.status.Store(http.StatusOK)
+	time.Sleep(cooldown + 10*time.Millisecond)
+	for range 2 {
+		reply, _, err := chat(t, router)
+		if err != nil {
+			t.Fatalf("chat error = %v", err)
+		}
+		if reply != "from openai" {
+			t.Errorf("reply = %q, want the recovered primary's", reply)
+		}
+	}
+	if primary.calls.Load() != 5 || fallbackCalls.Load() != 5 {
+		t.Errorf("calls = %d, %d, want 5, 5", primary.calls.Load(), fallbackCalls.Load())
+	}
+}
+
+func TestRouterTriesEveryProviderWhenAllCircuitsAreOpen(t *testing.T) {
+	primary, openai := newFakeOpenAI(t, http.StatusServiceUnavailable)
+	secondary, backup := newFakeOpenAI(t, http.StatusServiceUnavailable)
+	router := NewRouter([]Provider{openai, backup}, 1, time.Minute)
+
+	for range 2 {
+		_, served, err := chat(t, router)
+		if !Unavailable(err) {
+			t.Fatalf("chat error = %v, want the last provider's failure", err)
+		}
+		if served.Provider != "openai" {
+			t.Errorf("served = %+v, want the last provider tried", served)
+		}
+	}
+	if primary.calls.Load() != 2 || secondary.calls.Load() != 2 {
+		t.Errorf("calls = %d, %d, want both tried even with their circuits open", primary.calls.Load(), secondary.calls.Load())
+	}
+}
+
+func TestRouterSkipsUnsupportedCalls(t *testing.T) {
+	fallbackCalls, anthropic := newFallback(t)
+	primary, openai := newFakeOpenAI(t, http.StatusOK)
+	router := NewRouter([]Provider{anthropic, openai}, 1, time.Minute)
+
+	ctx, served := Track(context.Background())
+	_, err := router.CreateImage(ctx, gpt.ImageRequest{Model: "dall-e-3", Prompt: "a cat"})
+	if err != nil {
+		t.Fatalf("CreateImage() error = %v", err)
+	}
+	if *served != (Served{Provider: "openai", Model: "dall-e-3"}) {
+		t.Errorf("served = %+v, want openai's dall-e-3", *served)
+	}
+	if primary.calls.Load() != 1 || fallbackCalls.Load() != 0 {
+		t.Errorf("calls = %d, %d, want the image drawn by openai", primary.calls.Load(), fallbackCalls.Load())
+	}
+	if !router.routes[0].available(time.Now()) {
+		t.Error("an unsupported call opened the circuit")
+	}
+}
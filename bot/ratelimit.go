@@ -0,0 +1,207 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"openai-discord-bot/bot/storage"
+)
+
+// rateLimitKind separates the limits on cheap chat replies from the limits on expensive pictures
+type rateLimitKind string
+
+const (
+	chatLimit  rateLimitKind = "chat"
+	imageLimit rateLimitKind = "image"
+)
+
+// rateLimitScope is who shares a bucket
+type rateLimitScope string
+
+const (
+	userScope    rateLimitScope = "user"
+	channelScope rateLimitScope = "channel"
+	guildScope   rateLimitScope = "guild"
+)
+
+var rateLimitScopes = []rateLimitScope{userScope, channelScope, guildScope}
+
+// rateLimit is a token bucket that holds up to burst requests, and regains one every interval
+type rateLimit struct {
+	burst    float64
+	interval time.Duration
+}
+
+func (l rateLimit) enabled() bool {
+	return l.burst > 0 && l.interval > 0
+}
+
+// refill works out how many tokens a bucket holds at now, buckets that were never used start out full
+func (l rateLimit) refill(bucket storage.RateBucket, now time.Time) float64 {
+	if bucket.UpdatedAt == 0 {
+		return l.burst
+	}
+	elapsed := now.Sub(time.UnixMilli(bucket.UpdatedAt))
+	return min(l.burst, bucket.Tokens+float64(elapsed)/float64(l.interval))
+}
+
+// errRateLimited is returned when a request has to wait for retryAfter before it's allowed
+type errRateLimited struct {
+	scope      rateLimitScope
+	retryAfter time.Duration
+}
+
+func (e *errRateLimited) Error() string {
+	return fmt.Sprintf("%s rate limit exceeded, retry after %s", e.scope, e.retryAfter)
+}
+
+// rateLimiter applies token bucket limits per user, channel and guild, keeping the buckets in the conversation store so
+// they hold across restarts and replicas. Members with one of the exempt roles aren't limited
+type rateLimiter struct {
+	store       storage.RateLimitStore
+	limits      map[rateLimitKind]map[rateLimitScope]rateLimit
+	exemptRoles []string
+	// now is the clock buckets are refilled by
+	now func() time.Time
+}
+
+// newRateLimiter reads the limits from RATE_LIMIT_<KIND>_<SCOPE>_BURST and RATE_LIMIT_<KIND>_<SCOPE>_INTERVAL settings,
+// e.g. RATE_LIMIT_IMAGE_GUILD_BURST. A limit without both is disabled
+func newRateLimiter(store storage.RateLimitStore) *rateLimiter {
+	limiter := &rateLimiter{
+		store:       store,
+		limits:      make(map[rateLimitKind]map[rateLimitScope]rateLimit),
+		exemptRoles: viper.GetStringSlice("RATE_LIMIT_EXEMPT_ROLES"),
+		now:         time.Now,
+	}
+	for _, kind := range []rateLimitKind{chatLimit, imageLimit} {
+		limiter.limits[kind] = make(map[rateLimitScope]rateLimit)
+		for _, scope := range rateLimitScopes {
+			prefix := strings.ToUpper(fmt.Sprintf("RATE_LIMIT_%s_%s_", kind, scope))
+			limiter.limits[kind][scope] = rateLimit{
+				burst:    viper.GetFloat64(prefix + "BURST"),
+				interval: viper.GetDuration(prefix + "INTERVAL"),
+			}
+		}
+	}
+	return limiter
+}
+
+// exempt reports whether the requester has a role that isn't rate limited
+func (r *rateLimiter) exempt(req *request) bool {
+	if req.member == nil {
+		return false
+	}
+	for _, role := range req.member.Roles {
+		if slices.Contains(r.exemptRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow takes a token from each of the request's buckets of kind, or returns an *errRateLimited without taking any if
+// one of them is empty
+func (r *rateLimiter) Allow(ctx context.Context, kind rateLimitKind, req *request) error {
+	if r.exempt(req) {
+		return nil
+	}
+
+	ids := map[rateLimitScope]string{
+		userScope:    req.author.ID,
+		channelScope: req.channelID,
+		guildScope:   req.guildID,
+	}
+	var keys []string
+	var limits []rateLimit
+	var scopes []rateLimitScope
+	for _, scope := range rateLimitScopes {
+		limit := r.limits[kind][scope]
+		if !limit.enabled() || ids[scope] == "" {
+			continue
+		}
+		keys = append(keys, fmt.Sprintf("%s#%s#%s", kind, scope, ids[scope]))
+		limits = append(limits, limit)
+		scopes = append(scopes, scope)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return r.store.UpdateRateBuckets(ctx, keys, func(buckets []storage.RateBucket) error {
+		now := r.now()
+		var limited *errRateLimited
+		for i, limit := range limits {
+			tokens := limit.refill(buckets[i], now)
+			if tokens >= 1 {
+				continue
+			}
+			retryAfter := time.Duration((1 - tokens) * float64(limit.interval))
+			if limited == nil || retryAfter > limited.retryAfter {
+				limited = &errRateLimited{scope: scopes[i], retryAfter: retryAfter}
+			}
+		}
+		if limited != nil {
+			return limited
+		}
+
+		for i, limit := range limits {
+			tokens := limit.refill(buckets[i], now) - 1
+			buckets[i] = storage.RateBucket{
+				Tokens:    tokens,
+				UpdatedAt: now.UnixMilli(),
+				ExpiresAt: now.Add(time.Duration((limit.burst - tokens) * float64(limit.interval))).Unix(),
+			}
+		}
+		return nil
+	})
+}
+
+// checkRateLimit tells the requester when they're being throttled, and when they can try again. Rate limiting fails
+// open, if the buckets can't be loaded the request is allowed
+func (b *AIBot) checkRateLimit(ctx context.Context, req *request, kind rateLimitKind) bool {
+	logger := slog.Default().WithGroup("checkRateLimit")
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "checkRateLimit")
+	defer span.End()
+	span.SetAttributes(attribute.String("kind", string(kind)))
+
+	err := b.rateLimiter.Allow(ctx, kind, req)
+	if err == nil {
+		span.SetStatus(codes.Ok, "Success")
+		return true
+	}
+
+	var limited *errRateLimited
+	if !errors.As(err, &limited) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		logger.ErrorContext(ctx, "failed to check rate limits", slog.Any("error", err))
+		return true
+	}
+
+	span.SetAttributes(
+		attribute.Bool("throttled", true),
+		attribute.String("scope", string(limited.scope)),
+		attribute.Int64("retry_after_ms", limited.retryAfter.Milliseconds()),
+	)
+	logger.InfoContext(ctx, "request throttled", slog.String("kind", string(kind)), slog.String("scope", string(limited.scope)), slog.String("user", req.author.ID))
+
+	// Discord renders timestamps as a relative time in the reader's own locale, round up so it's never too early
+	retryAt := time.Now().Add(limited.retryAfter + time.Second).Unix()
+	message := fmt.Sprintf("Slow down, I can't keep up! Try again <t:%d:R>", retryAt)
+	if limited.scope != userScope {
+		message = fmt.Sprintf("Everyone in this %s is keeping me too busy, try again <t:%d:R>", limited.scope, retryAt)
+	}
+	_ = sendText(ctx, b.responderFor(ctx, req, req.channelID), message)
+	span.SetStatus(codes.Ok, "Success")
+	return false
+}
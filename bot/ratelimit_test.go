@@ -0,0 +1,202 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"openai-discord-bot/bot/storage"
+)
+
+// ask is a request from user in a channel of guild, by a member with roles
+func ask(user string, channel string, guild string, roles ...string) *request {
+	req := &request{author: &discordgo.User{ID: user}, channelID: channel, guildID: guild}
+	if guild != "" {
+		req.member = &discordgo.Member{Roles: roles}
+	}
+	return req
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	type step struct {
+		// advance moves the clock on before the request
+		advance time.Duration
+		req     *request
+		kind    rateLimitKind
+		// limited is the scope that should refuse the request, or empty if it should be allowed
+		limited    rateLimitScope
+		retryAfter time.Duration
+	}
+	tests := []struct {
+		name        string
+		limits      map[rateLimitKind]map[rateLimitScope]rateLimit
+		exemptRoles []string
+		steps       []step
+	}{
+		{
+			name: "user bucket refills over time",
+			limits: map[rateLimitKind]map[rateLimitScope]rateLimit{
+				chatLimit: {userScope: {burst: 2, interval: 10 * time.Second}},
+			},
+			steps: []step{
+				{req: ask("alice", "general", "guild")},
+				{req: ask("alice", "general", "guild")},
+				{req: ask("alice", "general", "guild"), limited: userScope, retryAfter: 10 * time.Second},
+				{advance: 4 * time.Second, req: ask("alice", "general", "guild"), limited: userScope, retryAfter: 6 * time.Second},
+				{advance: 6 * time.Second, req: ask("alice", "general", "guild")},
+				{req: ask("alice", "general", "guild"), limited: userScope, retryAfter: 10 * time.Second},
+				// A bucket never holds more than its burst, however long it's left
+				{advance: time.Hour, req: ask("alice", "general", "guild")},
+				{req: ask("alice", "general", "guild")},
+				{req: ask("alice", "general", "guild"), limited: userScope, retryAfter: 10 * time.Second},
+				{req: ask("bob", "general", "guild")},
+			},
+		},
+		{
+			name: "channel bucket is shared by everyone in it",
+			limits: map[rateLimitKind]map[rateLimitScope]rateLimit{
+				chatLimit: {channelScope: {burst: 2, interval: time.Minute}},
+			},
+			steps: []step{
+				{req: ask("alice", "general", "guild")},
+				{req: ask("bob", "general", "guild")},
+				{req: ask("carol", "general", "guild"), limited: channelScope, retryAfter: time.Minute},
+				{req: ask("carol", "random", "guild")},
+				{advance: 30 * time.Second, req: ask("carol", "general", "guild"), limited: channelScope, retryAfter: 30 * time.Second},
+			},
+		},
+		{
+			name: "guild bucket is shared by every channel",
+			limits: map[rateLimitKind]map[rateLimitScope]rateLimit{
+				imageLimit: {guildScope: {burst: 2, interval: time.Minute}},
+			},
+			steps: []step{
+				{req: ask("alice", "general", "guild"), kind: imageLimit},
+				{req: ask("bob", "random", "guild"), kind: imageLimit},
+				{req: ask("carol", "art", "guild"), kind: imageLimit, limited: guildScope, retryAfter: time.Minute},
+				{req: ask("carol", "art", "other"), kind: imageLimit},
+				// Direct messages aren't in a guild, so only the other scopes apply to them
+				{req: ask("carol", "dm", ""), kind: imageLimit},
+			},
+		},
+		{
+			name: "refused requests don't take tokens from any bucket",
+			limits: map[rateLimitKind]map[rateLimitScope]rateLimit{
+				chatLimit: {
+					userScope:    {burst: 1, interval: 10 * time.Second},
+					channelScope: {burst: 2, interval: time.Minute},
+				},
+			},
+			steps: []step{
+				{req: ask("alice", "general", "guild")},
+				{req: ask("alice", "general", "guild"), limited: userScope, retryAfter: 10 * time.Second},
+				{req: ask("bob", "general", "guild")},
+				{req: ask("carol", "general", "guild"), limited: channelScope, retryAfter: time.Minute},
+			},
+		},
+		{
+			name: "the longest wait is reported",
+			limits: map[rateLimitKind]map[rateLimitScope]rateLimit{
+				chatLimit: {
+					userScope:    {burst: 1, interval: 10 * time.Second},
+					channelScope: {burst: 1, interval: time.Minute},
+					guildScope:   {burst: 1, interval: 30 * time.Second},
+				},
+			},
+			steps: []step{
+				{req: ask("alice", "general", "guild")},
+				{req: ask("alice", "general", "guild"), limited: channelScope, retryAfter: time.Minute},
+			},
+		},
+		{
+			name: "kinds are limited separately",
+			limits: map[rateLimitKind]map[rateLimitScope]rateLimit{
+				chatLimit:  {userScope: {burst: 1, interval: time.Minute}},
+				imageLimit: {userScope: {burst: 1, interval: time.Hour}},
+			},
+			steps: []step{
+				{req: ask("alice", "general", "guild"), kind: chatLimit},
+				{req: ask("alice", "general", "guild"), kind: imageLimit},
+				{req: ask("alice", "general", "guild"), kind: chatLimit, limited: userScope, retryAfter: time.Minute},
+				{req: ask("alice", "general", "guild"), kind: imageLimit, limited: userScope, retryAfter: time.Hour},
+			},
+		},
+		{
+			name: "exempt roles bypass every limit",
+			limits: map[rateLimitKind]map[rateLimitScope]rateLimit{
+				chatLimit: {
+					userScope:  {burst: 1, interval: time.Minute},
+					guildScope: {burst: 2, interval: time.Minute},
+				},
+			},
+			exemptRoles: []string{"moderator"},
+			steps: []step{
+				{req: ask("mod", "general", "guild", "member", "moderator")},
+				{req: ask("mod", "general", "guild", "member", "moderator")},
+				{req: ask("mod", "general", "guild", "member", "moderator")},
+				// Exempt requests don't use up the guild's tokens either
+				{req: ask("alice", "general", "guild", "member")},
+				{req: ask("bob", "general", "guild", "member")},
+				{req: ask("alice", "general", "guild", "member"), limited: userScope, retryAfter: time.Minute},
+			},
+		},
+		{
+			name: "disabled limits",
+			limits: map[rateLimitKind]map[rateLimitScope]rateLimit{
+				chatLimit: {
+					userScope:    {burst: 1},
+					channelScope: {interval: time.Minute},
+				},
+			},
+			steps: []step{
+				{req: ask("alice", "general", "guild")},
+				{req: ask("alice", "general", "guild")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := storage.NewBoltStorage(filepath.Join(t.TempDir(), "bot.db"))
+			if err != nil {
+				t.Fatalf("NewBoltStorage() error = %v", err)
+			}
+			defer store.Close()
+
+			clock := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+			limiter := &rateLimiter{
+				store:       store,
+				limits:      tt.limits,
+				exemptRoles: tt.exemptRoles,
+				now:         func() time.Time { return clock },
+			}
+
+			for i, step := range tt.steps {
+				clock = clock.Add(step.advance)
+				kind := step.kind
+				if kind == "" {
+					kind = chatLimit
+				}
+
+				err := limiter.Allow(context.Background(), kind, step.req)
+				var limited *errRateLimited
+				switch {
+				case step.limited == "" && err != nil:
+					t.Fatalf("step %d: Allow() error = %v, want it allowed", i, err)
+				case step.limited == "":
+					continue
+				case !errors.As(err, &limited):
+					t.Fatalf("step %d: Allow() error = %v, want the %s limit", i, err, step.limited)
+				}
+				if limited.scope != step.limited {
+					t.Errorf("step %d: limited by %s, want %s", i, limited.scope, step.limited)
+				}
+				if diff := (limited.retryAfter - step.retryAfter).Abs(); diff > time.Millisecond {
+					t.Errorf("step %d: retry after %s, want %s", i, limited.retryAfter, step.retryAfter)
+				}
+			}
+		})
+	}
+}
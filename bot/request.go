@@ -0,0 +1,165 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// request describes who asked the bot for something and where, whether it arrived as an @mention or a slash command
+type request struct {
+	author    *discordgo.User
+	member    *discordgo.Member
+	guildID   string
+	channelID string
+	// message is the message that mentioned the bot, it is nil for slash commands
+	message *discordgo.Message
+	// interaction is the slash command that was invoked, it is nil for mentions
+	interaction *discordgo.Interaction
+}
+
+func newMessageRequest(m *discordgo.MessageCreate) *request {
+	return &request{
+		author:    m.Author,
+		member:    m.Member,
+		guildID:   m.GuildID,
+		channelID: m.ChannelID,
+		message:   m.Message,
+	}
+}
+
+func newInteractionRequest(i *discordgo.InteractionCreate) *request {
+	author := i.User
+	if i.Member != nil {
+		author = i.Member.User
+	}
+	return &request{
+		author:      author,
+		member:      i.Member,
+		guildID:     i.GuildID,
+		channelID:   i.ChannelID,
+		interaction: i.Interaction,
+	}
+}
+
+// source identifies the author of a request in the stored conversation history
+func (r *request) source() string {
+	return fmt.Sprintf("%s (%s) on %s", r.author.Username, r.author.ID, r.guildID)
+}
+
+// reference points replies back at the message that mentioned the bot, slash command responses are already attached to
+// the command so they don't need one
+func (r *request) reference() *discordgo.MessageReference {
+	if r.message == nil {
+		return nil
+	}
+	return r.message.Reference()
+}
+
+// responder sends the bot's replies for a request
+type responder interface {
+	Send(ctx context.Context, message *discordgo.MessageSend) (*discordgo.Message, error)
+	Edit(ctx context.Context, messageID string, content string) (*discordgo.Message, error)
+	Delete(ctx context.Context, messageID string) error
+}
+
+// channelResponder replies with regular messages in a channel or thread
+type channelResponder struct {
+	session   *discordgo.Session
+	channelID string
+}
+
+func (c *channelResponder) Send(ctx context.Context, message *discordgo.MessageSend) (*discordgo.Message, error) {
+	return c.session.ChannelMessageSendComplex(c.channelID, message, discordgo.WithContext(ctx))
+}
+
+func (c *channelResponder) Edit(ctx context.Context, messageID string, content string) (*discordgo.Message, error) {
+	return c.session.ChannelMessageEdit(c.channelID, messageID, content, discordgo.WithContext(ctx))
+}
+
+func (c *channelResponder) Delete(ctx context.Context, messageID string) error {
+	return c.session.ChannelMessageDelete(c.channelID, messageID, discordgo.WithContext(ctx))
+}
+
+// interactionResponder replies to a deferred slash command, the first reply fills in the deferred response and any
+// further replies are sent as followup messages
+type interactionResponder struct {
+	session     *discordgo.Session
+	interaction *discordgo.Interaction
+
+	mu         sync.Mutex
+	originalID string
+}
+
+func (i *interactionResponder) Send(ctx context.Context, message *discordgo.MessageSend) (*discordgo.Message, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.originalID == "" {
+		response, err := i.session.InteractionResponseEdit(i.interaction, &discordgo.WebhookEdit{
+			Content:         &message.Content,
+			Files:           message.Files,
+			Embeds:          &message.Embeds,
+			AllowedMentions: message.AllowedMentions,
+		}, discordgo.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		i.originalID = response.ID
+		return response, nil
+	}
+
+	return i.session.FollowupMessageCreate(i.interaction, true, &discordgo.WebhookParams{
+		Content:         message.Content,
+		Files:           message.Files,
+		Embeds:          message.Embeds,
+		AllowedMentions: message.AllowedMentions,
+	}, discordgo.WithContext(ctx))
+}
+
+func (i *interactionResponder) Edit(ctx context.Context, messageID string, content string) (*discordgo.Message, error) {
+	i.mu.Lock()
+	isOriginal := messageID == i.originalID
+	i.mu.Unlock()
+
+	if isOriginal {
+		return i.session.InteractionResponseEdit(i.interaction, &discordgo.WebhookEdit{Content: &content}, discordgo.WithContext(ctx))
+	}
+	return i.session.FollowupMessageEdit(i.interaction, messageID, &discordgo.WebhookEdit{Content: &content}, discordgo.WithContext(ctx))
+}
+
+func (i *interactionResponder) Delete(ctx context.Context, messageID string) error {
+	i.mu.Lock()
+	isOriginal := messageID == i.originalID
+	i.mu.Unlock()
+
+	if isOriginal {
+		return i.session.InteractionResponseDelete(i.interaction, discordgo.WithContext(ctx))
+	}
+	return i.session.FollowupMessageDelete(i.interaction, messageID, discordgo.WithContext(ctx))
+}
+
+// responderFor picks how to reply to a request in responseChannel. Slash commands are answered through their
+// interaction, unless the conversation moved into a thread, in which case the reply is posted there
+func (b *AIBot) responderFor(ctx context.Context, req *request, responseChannel string) responder {
+	if req.interaction == nil {
+		return &channelResponder{session: b.discordSession, channelID: responseChannel}
+	}
+
+	interactionReply := &interactionResponder{session: b.discordSession, interaction: req.interaction}
+	if responseChannel == req.channelID {
+		return interactionReply
+	}
+
+	// Let the command know where the conversation went, so it isn't left "thinking"
+	_, _ = interactionReply.Send(ctx, &discordgo.MessageSend{Content: fmt.Sprintf("Continuing in <#%s>", responseChannel)})
+	return &channelResponder{session: b.discordSession, channelID: responseChannel}
+}
+
+// sendText is a shorthand for replying with a plain text message
+func sendText(ctx context.Context, reply responder, content string) error {
+	_, err := reply.Send(ctx, &discordgo.MessageSend{Content: content})
+	return err
+}
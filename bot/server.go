@@ -0,0 +1,143 @@
+package bot
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// serverConfig controls the optional HTTP server for health checks and admin endpoints
+type serverConfig struct {
+	// address is where the server listens, the server only runs if it's set
+	address string
+	// adminToken has to be presented as a bearer token to use the admin endpoints, which are only served if it's set
+	adminToken string
+	// logLevel is the level logs are written at, which the admin endpoints can change
+	logLevel *slog.LevelVar
+}
+
+// handler routes the health checks, and the admin endpoints when there's an admin token to protect them
+func (b *AIBot) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, b.liveness())
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+		defer cancel()
+		writeHealthReport(w, b.readiness(ctx))
+	})
+
+	if b.server.adminToken != "" {
+		mux.Handle("GET /admin/log-level", b.requireAdmin(b.getLogLevel))
+		mux.Handle("PUT /admin/log-level", b.requireAdmin(b.setLogLevel))
+		mux.Handle("POST /admin/reload-prompts", b.requireAdmin(b.reloadPersonas))
+	}
+
+	// Health checks are polled constantly, tracing them would drown out everything else
+	return otelhttp.NewHandler(mux, "AIBot", otelhttp.WithFilter(func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/admin/")
+	}))
+}
+
+// serve runs the HTTP server until ctx is done
+func (b *AIBot) serve(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              b.server.address,
+		Handler:           b.handler(),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		return fmt.Errorf("failed to serve on %s: %w", b.server.address, err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second*5)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		return fmt.Errorf("failed to shut down the server: %w", err)
+	}
+	return nil
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport) {
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// requireAdmin only lets requests bearing the admin token through
+func (b *AIBot) requireAdmin(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(b.server.adminToken)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "a valid admin token is required"})
+			return
+		}
+		next(w, r)
+	})
+}
+
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+func (b *AIBot) getLogLevel(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, logLevelBody{Level: b.server.logLevel.Level().String()})
+}
+
+// setLogLevel changes the log level, to one of slog's level names like "debug" or "warn"
+func (b *AIBot) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var body logLevelBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expected a body like {\"level\": \"debug\"}"})
+		return
+	}
+
+	var level slog.Level
+	err = level.UnmarshalText([]byte(body.Level))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	previous := b.server.logLevel.Level()
+	b.server.logLevel.Set(level)
+	slog.Default().WithGroup("setLogLevel").WarnContext(r.Context(), "log level changed", slog.String("from", previous.String()), slog.String("to", level.String()))
+	writeJSON(w, http.StatusOK, logLevelBody{Level: level.String()})
+}
+
+// reloadPersonas re-reads the prompts directory, reporting why if it couldn't be used
+func (b *AIBot) reloadPersonas(w http.ResponseWriter, r *http.Request) {
+	err := b.ReloadPersonas(r.Context())
+	if err != nil {
+		slog.Default().WithGroup("reloadPersonas").ErrorContext(r.Context(), "failed to reload the personas", slog.Any("error", err))
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
@@ -0,0 +1,126 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	gpt "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"openai-discord-bot/bot/provider"
+	"openai-discord-bot/bot/storage"
+)
+
+// speechTrigger in a message asks for the reply to be read out loud as well
+const speechTrigger = "🔊"
+
+// maxSpeechInput is the most text the speech endpoint accepts in one request
+const maxSpeechInput = 4096
+
+// speechConfig controls how replies are read out loud, the voice comes from the persona's prompt file
+type speechConfig struct {
+	model gpt.SpeechModel
+}
+
+// handleSpeechMessage reads a reply out loud, and uploads the recording as an audio attachment. Like drawn pictures,
+// a copy of the recording is kept in image storage
+func (b *AIBot) handleSpeechMessage(ctx context.Context, reply responder, text string, persona *persona, req *request) error {
+	var err error
+	logger := slog.Default().WithGroup("handleSpeechMessage")
+
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "handleSpeechMessage")
+	defer span.End()
+	voice := persona.Voice
+	span.SetAttributes(
+		attribute.String("model", string(b.speech.model)),
+		attribute.String("voice", string(voice)),
+	)
+
+	// Long replies are cut short rather than refused, the whole reply is still there to read
+	if len(text) > maxSpeechInput {
+		text = strings.ToValidUTF8(text[:maxSpeechInput], "")
+	}
+
+	started := time.Now()
+	callCtx, served := provider.Track(ctx)
+	speech, err := b.provider.CreateSpeech(callCtx, gpt.CreateSpeechRequest{
+		Model:          b.speech.model,
+		Input:          text,
+		Voice:          voice,
+		ResponseFormat: gpt.SpeechResponseFormatMp3,
+	})
+	b.health.RecordOpenAI(err)
+	metrics.recordOpenAI(ctx, speechFeature, served.ModelOr(string(b.speech.model)), started, err)
+	if err != nil {
+		return fmt.Errorf("failed to get speech from openai: %w", err)
+	}
+	b.usage.Record(ctx, req, served.ModelOr(string(b.speech.model)), storage.UsageRecord{
+		Provider: served.Provider,
+		Model:    served.ModelOr(string(b.speech.model)),
+		Feature:  speechFeature,
+		Units:    float64(utf8.RuneCountInString(text)),
+	})
+
+	defer func() {
+		closeErr := speech.Close()
+		if closeErr != nil {
+			span.RecordError(closeErr)
+			logger.ErrorContext(ctx, "failed to close speech response body", slog.Any("error", closeErr))
+		}
+	}()
+
+	// Speech is usually streamed back without a length, which image storage has to cope with
+	speechLength, parseErr := strconv.ParseInt(speech.Header().Get("Content-Length"), 10, 64)
+	if parseErr != nil {
+		speechLength = -1
+	}
+
+	// Tee the speech stream, so that we can upload it to discord and image storage at the same time
+	pipeReader, pipeWriter := io.Pipe()
+	speechTeeReader := io.TeeReader(speech, pipeWriter)
+
+	go func() {
+		defer func() {
+			pipeErr := pipeWriter.Close()
+			if pipeErr != nil {
+				span.RecordError(pipeErr)
+				logger.ErrorContext(ctx, "failed to close the pipeWriter", slog.Any("error", pipeErr))
+			}
+		}()
+
+		speechKey, err := b.imageStorage.StoreImage(ctx, req.guildID, speechTeeReader, speechLength, "audio/mpeg")
+		if err != nil {
+			span.RecordError(err)
+			logger.ErrorContext(ctx, "failed to store a copy of the speech", slog.Any("error", err))
+			// Keep draining the stream so the discord upload can finish
+			_, _ = io.Copy(io.Discard, speechTeeReader)
+			return
+		}
+		logger.DebugContext(ctx, "archived speech", slog.String("url", b.imageStorage.PublicURL(speechKey)))
+	}()
+
+	_, err = reply.Send(ctx, &discordgo.MessageSend{
+		Reference: req.reference(),
+		Files: []*discordgo.File{{
+			Name:        "danbot-says.mp3",
+			ContentType: "audio/mpeg",
+			Reader:      pipeReader,
+		}},
+	})
+	if err != nil {
+		// Unblock the archiving goroutine, which is waiting on discord to read the other end of the pipe
+		_ = pipeReader.CloseWithError(err)
+		return fmt.Errorf("failed to send speech to discord: %w", err)
+	}
+
+	span.SetStatus(codes.Ok, "Success")
+	return nil
+}
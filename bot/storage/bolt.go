@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	threadsBucket   = []byte("threads")
+	summariesBucket = []byte("summaries")
+	rateLimitBucket = []byte("rate_limits")
+	usageBucket     = []byte("usage")
+	auditBucket     = []byte("audit")
+	policiesBucket  = []byte("policies")
+	personasBucket  = []byte("personas")
+)
+
+// directMessagesKey stands in for the guild of records made in direct messages, which have no guild, bolt can't name a
+// bucket with an empty key
+const directMessagesKey = "direct-messages"
+
+// guildKey is the name of a guild's bucket
+func guildKey(guildId string) []byte {
+	if guildId == "" {
+		return []byte(directMessagesKey)
+	}
+	return []byte(guildId)
+}
+
+// BoltStorage is a ConversationStore backed by an embedded bbolt database file, so the bot can run without any cloud
+// resources, e.g. on a laptop or in CI
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+var _ ConversationStore = (*BoltStorage)(nil)
+
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt database %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{threadsBucket, summariesBucket, rateLimitBucket, usageBucket, auditBucket, policiesBucket, personasBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize bolt database: %w", err)
+	}
+
+	return &BoltStorage{db: db}, nil
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStorage) GetThread(_ context.Context, threadId string, query ThreadQuery) ([]ThreadMessage, error) {
+	var threadMessages []ThreadMessage
+	limit, before := query.limit(), query.before()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		thread := tx.Bucket(threadsBucket).Bucket([]byte(threadId))
+		if thread == nil {
+			return nil
+		}
+
+		// Keys are big endian sequence numbers, so walking the cursor backwards reads the newest messages first
+		c := thread.Cursor()
+		for k, v := c.Last(); k != nil && len(threadMessages) < limit; k, v = c.Prev() {
+			var message ThreadMessage
+			if err := json.Unmarshal(v, &message); err != nil {
+				return fmt.Errorf("failed to decode thread message: %w", err)
+			}
+			if message.MessageUnixTime >= before {
+				continue
+			}
+			threadMessages = append(threadMessages, message)
+		}
+		return nil
+	})
+	return chronological(threadMessages, limit), err
+}
+
+func (s *BoltStorage) AddThreadMessage(_ context.Context, threadId string, messageSource string, message string, images ...string) error {
+	messageRecord, err := json.Marshal(&ThreadMessage{
+		ThreadId:        threadId,
+		MessageUnixTime: time.Now().UnixMilli(),
+		MessageSource:   messageSource,
+		Message:         message,
+		Images:          images,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		thread, err := tx.Bucket(threadsBucket).CreateBucketIfNotExists([]byte(threadId))
+		if err != nil {
+			return err
+		}
+
+		seq, err := thread.NextSequence()
+		if err != nil {
+			return err
+		}
+		return thread.Put(sequenceKey(seq), messageRecord)
+	})
+}
+
+func (s *BoltStorage) GetThreadSummary(_ context.Context, threadId string) (*ThreadSummary, error) {
+	var summary *ThreadSummary
+	err := s.db.View(func(tx *bolt.Tx) error {
+		record := tx.Bucket(summariesBucket).Get([]byte(threadId))
+		if record == nil {
+			return nil
+		}
+		summary = &ThreadSummary{}
+		return json.Unmarshal(record, summary)
+	})
+	return summary, err
+}
+
+func (s *BoltStorage) PutThreadSummary(_ context.Context, threadId string, summary ThreadSummary) error {
+	record, err := json.Marshal(&summary)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(summariesBucket).Put([]byte(threadId), record)
+	})
+}
+
+func (s *BoltStorage) GetThreadPersona(_ context.Context, threadId string) (string, error) {
+	var persona string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		persona = string(tx.Bucket(personasBucket).Get([]byte(threadId)))
+		return nil
+	})
+	return persona, err
+}
+
+func (s *BoltStorage) PutThreadPersona(_ context.Context, threadId string, persona string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(personasBucket).Put([]byte(threadId), []byte(persona))
+	})
+}
+
+// UpdateRateBuckets runs update inside a single bolt transaction, which is already exclusive of any other update
+func (s *BoltStorage) UpdateRateBuckets(_ context.Context, keys []string, update func(buckets []RateBucket) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		rateLimits := tx.Bucket(rateLimitBucket)
+		buckets := make([]RateBucket, len(keys))
+		for i, key := range keys {
+			if record := rateLimits.Get([]byte(key)); record != nil {
+				if err := json.Unmarshal(record, &buckets[i]); err != nil {
+					return fmt.Errorf("failed to decode rate limit bucket: %w", err)
+				}
+			}
+		}
+
+		if err := update(buckets); err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			record, err := json.Marshal(&buckets[i])
+			if err != nil {
+				return err
+			}
+			if err = rateLimits.Put([]byte(key), record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) AddUsage(_ context.Context, usage UsageRecord) error {
+	record, err := json.Marshal(&usage)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		guild, err := tx.Bucket(usageBucket).CreateBucketIfNotExists(guildKey(usage.GuildId))
+		if err != nil {
+			return err
+		}
+
+		seq, err := guild.NextSequence()
+		if err != nil {
+			return err
+		}
+		return guild.Put(sequenceKey(seq), record)
+	})
+}
+
+func (s *BoltStorage) GetUsage(_ context.Context, guildId string, since time.Time) ([]UsageRecord, error) {
+	var records []UsageRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		guild := tx.Bucket(usageBucket).Bucket(guildKey(guildId))
+		if guild == nil {
+			return nil
+		}
+
+		// Records are added in the order they're made, so walk back from the newest until they're too old
+		c := guild.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var record UsageRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("failed to decode usage record: %w", err)
+			}
+			if record.RecordedAt < since.UnixNano() {
+				break
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	slices.Reverse(records)
+	return records, err
+}
+
+func (s *BoltStorage) AddAuditRecord(_ context.Context, record AuditRecord) error {
+	encoded, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		guild, err := tx.Bucket(auditBucket).CreateBucketIfNotExists(guildKey(record.GuildId))
+		if err != nil {
+			return err
+		}
+
+		seq, err := guild.NextSequence()
+		if err != nil {
+			return err
+		}
+		return guild.Put(sequenceKey(seq), encoded)
+	})
+}
+
+func (s *BoltStorage) GetAccessPolicy(_ context.Context, guildId string) (*AccessPolicy, error) {
+	var policy *AccessPolicy
+	err := s.db.View(func(tx *bolt.Tx) error {
+		record := tx.Bucket(policiesBucket).Get([]byte(guildId))
+		if record == nil {
+			return nil
+		}
+		policy = &AccessPolicy{}
+		return json.Unmarshal(record, policy)
+	})
+	return policy, err
+}
+
+// UpdateAccessPolicy runs update inside a single bolt transaction, which is already exclusive of any other update
+func (s *BoltStorage) UpdateAccessPolicy(_ context.Context, guildId string, update func(policy *AccessPolicy) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		policies := tx.Bucket(policiesBucket)
+		var policy AccessPolicy
+		if record := policies.Get([]byte(guildId)); record != nil {
+			if err := json.Unmarshal(record, &policy); err != nil {
+				return fmt.Errorf("failed to decode access policy: %w", err)
+			}
+		}
+
+		if err := update(&policy); err != nil {
+			return err
+		}
+
+		record, err := json.Marshal(&policy)
+		if err != nil {
+			return err
+		}
+		return policies.Put([]byte(guildId), record)
+	})
+}
+
+func (s *BoltStorage) Ping(_ context.Context) error {
+	// Fails once the database has been closed
+	return s.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltStorage(t *testing.T) (*BoltStorage, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bot.db")
+	s, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatalf("NewBoltStorage() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+	return s, path
+}
+
+// addMessages adds messages to a thread a couple of milliseconds apart, so that each has its own MessageUnixTime
+func addMessages(t *testing.T, s *BoltStorage, threadId string, messages ...string) {
+	t.Helper()
+	for _, message := range messages {
+		if err := s.AddThreadMessage(context.Background(), threadId, "user", message); err != nil {
+			t.Fatalf("AddThreadMessage() error = %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func messageTexts(messages []ThreadMessage) []string {
+	texts := make([]string, 0, len(messages))
+	for _, message := range messages {
+		texts = append(texts, message.Message)
+	}
+	return texts
+}
+
+func TestBoltGetThread(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestBoltStorage(t)
+	addMessages(t, s, "thread", "one", "two", "three", "four", "five")
+	addMessages(t, s, "other", "elsewhere")
+
+	all, err := s.GetThread(ctx, "thread", ThreadQuery{})
+	if err != nil {
+		t.Fatalf("GetThread() error = %v", err)
+	}
+	if want := []string{"one", "two", "three", "four", "five"}; !slices.Equal(messageTexts(all), want) {
+		t.Fatalf("GetThread() = %v, want %v", messageTexts(all), want)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].MessageUnixTime <= all[i-1].MessageUnixTime {
+			t.Errorf("message %d isn't newer than the one before it", i)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query ThreadQuery
+		want  []string
+	}{
+		{name: "limit keeps the newest", query: ThreadQuery{Limit: 2}, want: []string{"four", "five"}},
+		{name: "before", query: ThreadQuery{Before: all[3].MessageUnixTime}, want: []string{"one", "two", "three"}},
+		{name: "before and limit", query: ThreadQuery{Limit: 2, Before: all[3].MessageUnixTime}, want: []string{"two", "three"}},
+		{name: "before the first", query: ThreadQuery{Before: all[0].MessageUnixTime}, want: []string{}},
+		{name: "limit over the length", query: ThreadQuery{Limit: 50}, want: []string{"one", "two", "three", "four", "five"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := s.GetThread(ctx, "thread", tt.query)
+			if err != nil {
+				t.Fatalf("GetThread() error = %v", err)
+			}
+			if !slices.Equal(messageTexts(messages), tt.want) {
+				t.Errorf("GetThread() = %v, want %v", messageTexts(messages), tt.want)
+			}
+		})
+	}
+
+	// Paging back from the oldest message of each page reads the whole thread
+	var paged []string
+	query := ThreadQuery{Limit: 2}
+	for {
+		page, err := s.GetThread(ctx, "thread", query)
+		if err != nil {
+			t.Fatalf("GetThread() error = %v", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		paged = slices.Concat(messageTexts(page), paged)
+		query.Before = page[0].MessageUnixTime
+	}
+	if want := messageTexts(all); !slices.Equal(paged, want) {
+		t.Errorf("paged thread = %v, want %v", paged, want)
+	}
+
+	missing, err := s.GetThread(ctx, "missing", ThreadQuery{})
+	if err != nil || len(missing) != 0 {
+		t.Errorf("GetThread() of a missing thread = %v, %v, want nothing", missing, err)
+	}
+}
+
+func TestBoltRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s, path := newTestBoltStorage(t)
+
+	err := s.AddThreadMessage(ctx, "thread", "Bot", "a picture", "https://example.com/1.png", "https://example.com/2.png")
+	if err != nil {
+		t.Fatalf("AddThreadMessage() error = %v", err)
+	}
+	if err = s.PutThreadSummary(ctx, "thread", ThreadSummary{Summary: "they said hi", SummarizedThrough: 42}); err != nil {
+		t.Fatalf("PutThreadSummary() error = %v", err)
+	}
+	if err = s.PutThreadPersona(ctx, "thread", "pirate"); err != nil {
+		t.Fatalf("PutThreadPersona() error = %v", err)
+	}
+
+	// Everything is still there once the database is opened again
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	s, err = NewBoltStorage(path)
+	if err != nil {
+		t.Fatalf("NewBoltStorage() error = %v", err)
+	}
+	defer s.Close()
+
+	messages, err := s.GetThread(ctx, "thread", ThreadQuery{})
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("GetThread() = %v, %v, want the message", messages, err)
+	}
+	message := messages[0]
+	if message.ThreadId != "thread" || message.MessageSource != "Bot" || message.Message != "a picture" || len(message.Images) != 2 {
+		t.Errorf("message = %+v", message)
+	}
+
+	summary, err := s.GetThreadSummary(ctx, "thread")
+	if err != nil || summary == nil || *summary != (ThreadSummary{Summary: "they said hi", SummarizedThrough: 42}) {
+		t.Errorf("GetThreadSummary() = %+v, %v", summary, err)
+	}
+	if summary, err = s.GetThreadSummary(ctx, "missing"); err != nil || summary != nil {
+		t.Errorf("GetThreadSummary() of a missing thread = %+v, %v, want nil", summary, err)
+	}
+
+	persona, err := s.GetThreadPersona(ctx, "thread")
+	if err != nil || persona != "pirate" {
+		t.Errorf("GetThreadPersona() = %q, %v", persona, err)
+	}
+}
+
+func TestBoltUpdateRateBuckets(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestBoltStorage(t)
+	keys := []string{"user#1", "guild#1"}
+
+	err := s.UpdateRateBuckets(ctx, keys, func(buckets []RateBucket) error {
+		if len(buckets) != 2 || buckets[0] != (RateBucket{}) || buckets[1] != (RateBucket{}) {
+			t.Errorf("new buckets = %+v, want two unused buckets", buckets)
+		}
+		buckets[0] = RateBucket{Tokens: 1, UpdatedAt: 100, ExpiresAt: 200}
+		buckets[1] = RateBucket{Tokens: 2, UpdatedAt: 100}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateRateBuckets() error = %v", err)
+	}
+
+	// Buckets come back in the order of the keys
+	errRejected := errors.New("rejected")
+	err = s.UpdateRateBuckets(ctx, []string{"guild#1", "user#1"}, func(buckets []RateBucket) error {
+		if buckets[0].Tokens != 2 || buckets[1] != (RateBucket{Tokens: 1, UpdatedAt: 100, ExpiresAt: 200}) {
+			t.Errorf("stored buckets = %+v", buckets)
+		}
+		buckets[0].Tokens = 0
+		return errRejected
+	})
+	if !errors.Is(err, errRejected) {
+		t.Fatalf("UpdateRateBuckets() error = %v, want the update's error", err)
+	}
+
+	// Nothing was saved by the update that failed
+	err = s.UpdateRateBuckets(ctx, keys[1:], func(buckets []RateBucket) error {
+		if buckets[0].Tokens != 2 {
+			t.Errorf("bucket tokens = %v, want the rejected update discarded", buckets[0].Tokens)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateRateBuckets() error = %v", err)
+	}
+
+	// Concurrent updates don't lose each other's changes
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.UpdateRateBuckets(ctx, []string{"counter"}, func(buckets []RateBucket) error {
+				buckets[0].Tokens++
+				return nil
+			})
+			if err != nil {
+				t.Errorf("UpdateRateBuckets() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	err = s.UpdateRateBuckets(ctx, []string{"counter"}, func(buckets []RateBucket) error {
+		if buckets[0].Tokens != 20 {
+			t.Errorf("counter = %v, want 20", buckets[0].Tokens)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateRateBuckets() error = %v", err)
+	}
+}
+
+func TestBoltUpdateAccessPolicy(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestBoltStorage(t)
+
+	// Concurrent changes to a policy are all kept
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.UpdateAccessPolicy(ctx, "guild", func(policy *AccessPolicy) error {
+				policy.Rules = append(policy.Rules, AccessRule{Effect: "deny", Feature: "chat", Scope: "user", ID: strconv.Itoa(i)})
+				return nil
+			})
+			if err != nil {
+				t.Errorf("UpdateAccessPolicy() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	err := s.UpdateAccessPolicy(ctx, "guild", func(policy *AccessPolicy) error {
+		policy.Rules = nil
+		return errors.New("rejected")
+	})
+	if err == nil {
+		t.Fatal("UpdateAccessPolicy() succeeded when update failed")
+	}
+
+	policy, err := s.GetAccessPolicy(ctx, "guild")
+	if err != nil || policy == nil {
+		t.Fatalf("GetAccessPolicy() = %v, %v", policy, err)
+	}
+	if len(policy.Rules) != 10 {
+		t.Errorf("policy has %d rules, want all 10", len(policy.Rules))
+	}
+	if policy, err = s.GetAccessPolicy(ctx, "other"); err != nil || policy != nil {
+		t.Errorf("GetAccessPolicy() of a guild without one = %v, %v, want nil", policy, err)
+	}
+}
+
+func TestBoltUsage(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestBoltStorage(t)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		guildId string
+	}{
+		{name: "guild", guildId: "guild"},
+		{name: "direct messages", guildId: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, recordedAt := range []time.Time{now.Add(-2 * time.Hour), now} {
+				err := s.AddUsage(ctx, UsageRecord{GuildId: tt.guildId, RecordedAt: recordedAt.UnixNano(), UserId: strconv.Itoa(i), Model: "gpt-4o"})
+				if err != nil {
+					t.Fatalf("AddUsage() error = %v", err)
+				}
+			}
+
+			records, err := s.GetUsage(ctx, tt.guildId, now.Add(-3*time.Hour))
+			if err != nil {
+				t.Fatalf("GetUsage() error = %v", err)
+			}
+			if len(records) != 2 || records[0].UserId != "0" || records[1].UserId != "1" || records[0].GuildId != tt.guildId {
+				t.Errorf("GetUsage() = %+v, want both records oldest first", records)
+			}
+
+			records, err = s.GetUsage(ctx, tt.guildId, now.Add(-time.Hour))
+			if err != nil || len(records) != 1 || records[0].UserId != "1" {
+				t.Errorf("GetUsage() since an hour ago = %+v, %v, want the newest record", records, err)
+			}
+		})
+	}
+}
+
+func TestBoltAddAuditRecord(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestBoltStorage(t)
+
+	tests := []struct {
+		name    string
+		guildId string
+		bucket  string
+	}{
+		{name: "guild", guildId: "guild", bucket: "guild"},
+		{name: "direct messages", guildId: "", bucket: directMessagesKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, action := range []string{"moderation.prompt_blocked", "moderation.reply_blocked"} {
+				err := s.AddAuditRecord(ctx, AuditRecord{GuildId: tt.guildId, UserId: "user", Action: action})
+				if err != nil {
+					t.Fatalf("AddAuditRecord() error = %v", err)
+				}
+			}
+
+			// There's nothing to read audit records back with, so look in the bucket they're kept in
+			var actions []string
+			err := s.db.View(func(tx *bolt.Tx) error {
+				guild := tx.Bucket(auditBucket).Bucket([]byte(tt.bucket))
+				if guild == nil {
+					return errors.New("no audit bucket")
+				}
+				return guild.ForEach(func(_, v []byte) error {
+					var record AuditRecord
+					if err := json.Unmarshal(v, &record); err != nil {
+						return err
+					}
+					actions = append(actions, record.Action)
+					return nil
+				})
+			})
+			if err != nil {
+				t.Fatalf("reading audit records error = %v", err)
+			}
+			if want := []string{"moderation.prompt_blocked", "moderation.reply_blocked"}; !slices.Equal(actions, want) {
+				t.Errorf("audit actions = %v, want %v", actions, want)
+			}
+		})
+	}
+}
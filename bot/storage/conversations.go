@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"slices"
+	"time"
+
+	gpt "github.com/sashabaranov/go-openai"
+)
+
+// ConversationStore records the messages exchanged in a conversation thread, and loads them back as prompt context,
+// along with everything else the bot keeps track of per guild. Parts of the bot that only need some of it take the
+// smaller interfaces it's made up of
+type ConversationStore interface {
+	ThreadStore
+	RateLimitStore
+	UsageStore
+	AuditStore
+	AccessPolicyStore
+	// Ping checks that the store can be reached
+	Ping(ctx context.Context) error
+}
+
+// ThreadStore keeps the messages of conversation threads, and what's known about each thread
+type ThreadStore interface {
+	// GetThread loads the newest messages of a thread selected by query, in chronological order
+	GetThread(ctx context.Context, threadId string, query ThreadQuery) ([]ThreadMessage, error)
+	// AddThreadMessage records a message, along with the URLs of any images that were part of it
+	AddThreadMessage(ctx context.Context, threadId string, messageSource string, message string, images ...string) error
+	// GetThreadSummary returns the rolling summary of a thread's older messages, or nil if it hasn't been summarized
+	GetThreadSummary(ctx context.Context, threadId string) (*ThreadSummary, error)
+	PutThreadSummary(ctx context.Context, threadId string, summary ThreadSummary) error
+	// GetThreadPersona returns the persona a thread is talking to, or "" if it hasn't been given one
+	GetThreadPersona(ctx context.Context, threadId string) (string, error)
+	PutThreadPersona(ctx context.Context, threadId string, persona string) error
+}
+
+// RateLimitStore keeps rate limit buckets, shared between every replica of the bot
+type RateLimitStore interface {
+	// UpdateRateBuckets loads the rate limit buckets stored under keys, in the same order, and saves the changes update
+	// makes to them. The buckets are updated together, and update is called again if another replica changed them in
+	// the meantime. Nothing is saved if update returns an error, which is passed back to the caller
+	UpdateRateBuckets(ctx context.Context, keys []string, update func(buckets []RateBucket) error) error
+}
+
+// UsageStore keeps a record of every OpenAI call
+type UsageStore interface {
+	// AddUsage records the usage and cost of a single OpenAI call
+	AddUsage(ctx context.Context, usage UsageRecord) error
+	// GetUsage loads the usage records of a guild's calls made at or after since, oldest first
+	GetUsage(ctx context.Context, guildId string, since time.Time) ([]UsageRecord, error)
+}
+
+// AuditStore keeps the audit trail
+type AuditStore interface {
+	// AddAuditRecord records something the bot did on a guild's behalf, like refusing a request
+	AddAuditRecord(ctx context.Context, record AuditRecord) error
+}
+
+// AccessPolicyStore keeps each guild's access policy
+type AccessPolicyStore interface {
+	// GetAccessPolicy returns the rules for where and by whom the bot can be used in a guild, or nil if it has none
+	GetAccessPolicy(ctx context.Context, guildId string) (*AccessPolicy, error)
+	// UpdateAccessPolicy loads a guild's access policy, empty if it has none, and saves the changes update makes to it.
+	// update is called again if the policy was changed in the meantime, so that concurrent changes aren't lost. Nothing
+	// is saved if update returns an error, which is passed back to the caller
+	UpdateAccessPolicy(ctx context.Context, guildId string, update func(policy *AccessPolicy) error) error
+}
+
+// DefaultThreadLimit is how many messages GetThread loads when a ThreadQuery doesn't set a Limit
+const DefaultThreadLimit = 100
+
+// ThreadQuery selects a page of a thread's messages, counting back from the newest. To load the page before a result,
+// pass the MessageUnixTime of its first (oldest) message as Before
+type ThreadQuery struct {
+	// Limit is the most messages to load, DefaultThreadLimit if unset
+	Limit int
+	// Before only loads messages older than this unix millisecond time, if set
+	Before int64
+}
+
+func (q ThreadQuery) limit() int {
+	if q.Limit <= 0 {
+		return DefaultThreadLimit
+	}
+	return q.Limit
+}
+
+func (q ThreadQuery) before() int64 {
+	if q.Before <= 0 {
+		return math.MaxInt64
+	}
+	return q.Before
+}
+
+// chronological trims newest first results to limit messages, and puts them back in the order they were sent
+func chronological(newestFirst []ThreadMessage, limit int) []ThreadMessage {
+	if len(newestFirst) > limit {
+		newestFirst = newestFirst[:limit]
+	}
+	slices.Reverse(newestFirst)
+	return newestFirst
+}
+
+// ThreadMessage is a single stored turn of a conversation thread
+type ThreadMessage struct {
+	ThreadId        string   `dynamodbav:"thread_id" json:"thread_id"`
+	MessageUnixTime int64    `dynamodbav:"message_unix_time" json:"message_unix_time"`
+	MessageSource   string   `dynamodbav:"message_source,omitempty" json:"message_source,omitempty"`
+	Message         string   `json:"message"`
+	Images          []string `dynamodbav:"images,omitempty" json:"images,omitempty"`
+}
+
+// ChatMessage converts a stored thread message into a completion message, attributing anything not sent by the bot to the user.
+// Messages with images become multipart messages, so that vision models can still see the images later in a thread
+func (t ThreadMessage) ChatMessage() gpt.ChatCompletionMessage {
+	message := gpt.ChatCompletionMessage{
+		Content: t.Message,
+	}
+	if len(t.Images) > 0 {
+		message.Content = ""
+		message.MultiContent = []gpt.ChatMessagePart{{Type: gpt.ChatMessagePartTypeText, Text: t.Message}}
+		for _, image := range t.Images {
+			message.MultiContent = append(message.MultiContent, gpt.ChatMessagePart{
+				Type:     gpt.ChatMessagePartTypeImageURL,
+				ImageURL: &gpt.ChatMessageImageURL{URL: image, Detail: gpt.ImageURLDetailAuto},
+			})
+		}
+	}
+	if t.MessageSource == "Bot" {
+		message.Role = "assistant"
+	} else {
+		message.Role = "user"
+	}
+	return message
+}
+
+// ChatMessages converts a list of stored thread messages into completion messages
+func ChatMessages(threadMessages []ThreadMessage) []gpt.ChatCompletionMessage {
+	var responseMessages []gpt.ChatCompletionMessage
+	for t := range threadMessages {
+		responseMessages = append(responseMessages, threadMessages[t].ChatMessage())
+	}
+	return responseMessages
+}
+
+// ThreadSummary is a rolling summary of every message in a thread up to and including SummarizedThrough. A summary
+// with no text marks a thread that was reset, everything before SummarizedThrough is forgotten
+type ThreadSummary struct {
+	Summary           string `dynamodbav:"summary" json:"summary"`
+	SummarizedThrough int64  `dynamodbav:"summarized_through" json:"summarized_through"`
+}
+
+// RateBucket is the stored state of a token bucket rate limit
+type RateBucket struct {
+	Tokens float64 `dynamodbav:"tokens" json:"tokens"`
+	// UpdatedAt is when Tokens was last worked out, in unix milliseconds. It's zero for a bucket that was never used
+	UpdatedAt int64 `dynamodbav:"updated_at" json:"updated_at"`
+	// ExpiresAt is when the bucket will have filled back up and can be forgotten, in unix seconds
+	ExpiresAt int64 `dynamodbav:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
+
+// UsageRecord is what a single OpenAI call used, and roughly what it cost
+type UsageRecord struct {
+	GuildId string `dynamodbav:"guild_id" json:"guild_id"`
+	// Day is the UTC date the call was made on, e.g. 2006-01-02
+	Day string `dynamodbav:"day" json:"day"`
+	// RecordedAt is when the call was made, in unix nanoseconds so that concurrent calls don't collide
+	RecordedAt       int64  `dynamodbav:"recorded_at" json:"recorded_at"`
+	UserId           string `dynamodbav:"user_id" json:"user_id"`
+	UserName         string `dynamodbav:"user_name" json:"user_name"`
+	Provider         string `dynamodbav:"provider,omitempty" json:"provider,omitempty"`
+	Model            string `dynamodbav:"model" json:"model"`
+	Feature          string `dynamodbav:"feature" json:"feature"`
+	PromptTokens     int    `dynamodbav:"prompt_tokens,omitempty" json:"prompt_tokens,omitempty"`
+	CompletionTokens int    `dynamodbav:"completion_tokens,omitempty" json:"completion_tokens,omitempty"`
+	// Units is what calls that aren't priced by the token are priced by, like images or minutes of audio
+	Units float64 `dynamodbav:"units,omitempty" json:"units,omitempty"`
+	// Cost is estimated in USD from the configured prices
+	Cost float64 `dynamodbav:"cost" json:"cost"`
+}
+
+// AuditRecord is something the bot did that a guild's admins may want to review later
+type AuditRecord struct {
+	GuildId string `dynamodbav:"guild_id" json:"guild_id"`
+	// RecordedAt is when it happened, in unix nanoseconds
+	RecordedAt int64  `dynamodbav:"recorded_at" json:"recorded_at"`
+	ChannelId  string `dynamodbav:"channel_id" json:"channel_id"`
+	UserId     string `dynamodbav:"user_id" json:"user_id"`
+	UserName   string `dynamodbav:"user_name" json:"user_name"`
+	// Action is what happened, e.g. moderation.prompt_blocked
+	Action string `dynamodbav:"action" json:"action"`
+	// Detail explains why it happened
+	Detail string `dynamodbav:"detail,omitempty" json:"detail,omitempty"`
+	// Content is what the action was taken on, if there was anything
+	Content string `dynamodbav:"content,omitempty" json:"content,omitempty"`
+}
+
+// AccessPolicy is the list of rules controlling where and by whom the bot can be used in a guild
+type AccessPolicy struct {
+	Rules []AccessRule `dynamodbav:"rules" json:"rules"`
+}
+
+// AccessRule allows or denies a feature of the bot to everything in a scope, like a channel or a role
+type AccessRule struct {
+	Effect  string `dynamodbav:"effect" json:"effect"`
+	Feature string `dynamodbav:"feature" json:"feature"`
+	Scope   string `dynamodbav:"scope" json:"scope"`
+	// ID is the ID of the channel, category, role or user the rule applies to, it's empty for the whole guild
+	ID string `dynamodbav:"id,omitempty" json:"id,omitempty"`
+}
@@ -2,28 +2,105 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	gpt "github.com/sashabaranov/go-openai"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/spf13/viper"
 )
 
+// Storage is a ConversationStore backed by a DynamoDB table
 type Storage struct {
 	client    *dynamodb.Client
 	tableName string
 }
 
-type threadMessage struct {
+var _ ConversationStore = (*Storage)(nil)
+
+// threadSummaryRecord is stored alongside the thread's messages, under a separate partition key
+type threadSummaryRecord struct {
+	ThreadId        string `dynamodbav:"thread_id"`
+	MessageUnixTime int64  `dynamodbav:"message_unix_time"`
+	ThreadSummary
+}
+
+// rateBucketRecord is a rate limit bucket, stored under a separate partition key. Version is bumped by every update,
+// so replicas can tell when they've raced each other
+type rateBucketRecord struct {
+	ThreadId        string `dynamodbav:"thread_id"`
+	MessageUnixTime int64  `dynamodbav:"message_unix_time"`
+	Version         int64  `dynamodbav:"version"`
+	RateBucket
+}
+
+// usageRecordItem is a usage record, stored under a separate partition key for each guild and sorted by when the call
+// was made
+type usageRecordItem struct {
+	ThreadId        string `dynamodbav:"thread_id"`
+	MessageUnixTime int64  `dynamodbav:"message_unix_time"`
+	UsageRecord
+}
+
+// auditRecordItem is an audit record, stored under a separate partition key for each guild and sorted by when it
+// happened
+type auditRecordItem struct {
 	ThreadId        string `dynamodbav:"thread_id"`
 	MessageUnixTime int64  `dynamodbav:"message_unix_time"`
-	MessageSource   string `dynamodbav:"message_source,omitempty"`
-	Message         string
+	AuditRecord
 }
 
+// accessPolicyRecord is a guild's access policy, stored under a separate partition key. Version counts the changes
+// made to it, so that concurrent changes can be detected
+type accessPolicyRecord struct {
+	ThreadId        string `dynamodbav:"thread_id"`
+	MessageUnixTime int64  `dynamodbav:"message_unix_time"`
+	Version         int64  `dynamodbav:"version"`
+	AccessPolicy
+}
+
+// threadPersonaRecord is the persona a thread is talking to, stored under a separate partition key
+type threadPersonaRecord struct {
+	ThreadId        string `dynamodbav:"thread_id"`
+	MessageUnixTime int64  `dynamodbav:"message_unix_time"`
+	Persona         string `dynamodbav:"persona"`
+}
+
+// maxQueryPageSize bounds how many messages are requested from DynamoDB in a single query page
+const maxQueryPageSize = 100
+
+func summaryKey(threadId string) string {
+	return "summary#" + threadId
+}
+
+func personaKey(threadId string) string {
+	return "persona#" + threadId
+}
+
+func rateBucketKey(key string) string {
+	return "ratelimit#" + key
+}
+
+func usageKey(guildId string) string {
+	return "usage#" + guildId
+}
+
+func auditKey(guildId string) string {
+	return "audit#" + guildId
+}
+
+func policyKey(guildId string) string {
+	return "policy#" + guildId
+}
+
+// maxUpdateAttempts bounds how many times UpdateRateBuckets and UpdateAccessPolicy start over after losing a race with
+// another replica
+const maxUpdateAttempts = 5
+
 func NewStorage(cfg aws.Config) *Storage {
 	svc := dynamodb.NewFromConfig(cfg)
 	return &Storage{
@@ -32,59 +109,243 @@ func NewStorage(cfg aws.Config) *Storage {
 	}
 }
 
-func (s *Storage) GetThread(ctx context.Context, threadId string) ([]gpt.ChatCompletionMessage, error) {
-	var responseMessages []gpt.ChatCompletionMessage
+// GetThread pages through a thread newest first until query.Limit messages are loaded, and returns them oldest first
+func (s *Storage) GetThread(ctx context.Context, threadId string, query ThreadQuery) ([]ThreadMessage, error) {
+	var responseMessages []ThreadMessage
 	// Construct our query and run it
 	keyEx := expression.KeyAnd(
-		expression.Key("thread_id").Equal(expression.Value(threadId)),                               // PK
-		expression.Key("message_unix_time").LessThanEqual(expression.Value(time.Now().UnixMilli())), // SK
+		expression.Key("thread_id").Equal(expression.Value(threadId)),                  // PK
+		expression.Key("message_unix_time").LessThan(expression.Value(query.before())), // SK
 	)
 	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
 	if err != nil {
 		return responseMessages, err
 	}
 
-	q, err := s.client.Query(ctx, &dynamodb.QueryInput{
+	limit := query.limit()
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
 		TableName:                 aws.String(s.tableName),
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		KeyConditionExpression:    expr.KeyCondition(),
-		Limit:                     aws.Int32(100),
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(int32(min(limit, maxQueryPageSize))),
 	})
+	for paginator.HasMorePages() && len(responseMessages) < limit {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return responseMessages, err
+		}
+
+		// Unmarshal the results into a list
+		var pageMessages []ThreadMessage
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pageMessages)
+		if err != nil {
+			return responseMessages, err
+		}
+		responseMessages = append(responseMessages, pageMessages...)
+	}
+
+	return chronological(responseMessages, limit), nil
+}
+
+func (s *Storage) AddThreadMessage(ctx context.Context, threadId string, messageSource string, message string, images ...string) error {
+	messageRecord := &ThreadMessage{
+		ThreadId:        threadId,
+		MessageUnixTime: time.Now().UnixMilli(),
+		MessageSource:   messageSource,
+		Message:         message,
+		Images:          images,
+	}
+	item, err := attributevalue.MarshalMap(messageRecord)
 	if err != nil {
-		return responseMessages, err
+		return err
 	}
 
-	// Unmarshal the results into a list
-	var threadMessages []threadMessage
-	err = attributevalue.UnmarshalListOfMaps(q.Items, &threadMessages)
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(s.tableName),
+	})
+
+	return err
+}
+
+func (s *Storage) GetThreadSummary(ctx context.Context, threadId string) (*ThreadSummary, error) {
+	key, err := attributevalue.MarshalMap(&threadSummaryRecord{ThreadId: summaryKey(threadId)})
 	if err != nil {
-		return responseMessages, err
+		return nil, err
+	}
+
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"thread_id":         key["thread_id"],
+			"message_unix_time": key["message_unix_time"],
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var record threadSummaryRecord
+	err = attributevalue.UnmarshalMap(result.Item, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record.ThreadSummary, nil
+}
+
+func (s *Storage) PutThreadSummary(ctx context.Context, threadId string, summary ThreadSummary) error {
+	item, err := attributevalue.MarshalMap(&threadSummaryRecord{
+		ThreadId:      summaryKey(threadId),
+		ThreadSummary: summary,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(s.tableName),
+	})
+
+	return err
+}
+
+func (s *Storage) GetThreadPersona(ctx context.Context, threadId string) (string, error) {
+	key, err := attributevalue.MarshalMap(&threadPersonaRecord{ThreadId: personaKey(threadId)})
+	if err != nil {
+		return "", err
+	}
+
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"thread_id":         key["thread_id"],
+			"message_unix_time": key["message_unix_time"],
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if result.Item == nil {
+		return "", nil
+	}
+
+	var record threadPersonaRecord
+	err = attributevalue.UnmarshalMap(result.Item, &record)
+	if err != nil {
+		return "", err
+	}
+	return record.Persona, nil
+}
+
+func (s *Storage) PutThreadPersona(ctx context.Context, threadId string, persona string) error {
+	item, err := attributevalue.MarshalMap(&threadPersonaRecord{
+		ThreadId: personaKey(threadId),
+		Persona:  persona,
+	})
+	if err != nil {
+		return err
 	}
 
-	// Concatenate the list of messages together and return them
-	for t := range threadMessages {
-		message := gpt.ChatCompletionMessage{
-			Content: threadMessages[t].Message,
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(s.tableName),
+	})
+
+	return err
+}
+
+// UpdateRateBuckets reads the buckets consistently, and writes them back in a transaction that only succeeds if none of
+// them changed since they were read
+func (s *Storage) UpdateRateBuckets(ctx context.Context, keys []string, update func(buckets []RateBucket) error) error {
+	for attempt := 1; ; attempt++ {
+		records := make([]rateBucketRecord, len(keys))
+		buckets := make([]RateBucket, len(keys))
+		for i, key := range keys {
+			record, err := s.getRateBucket(ctx, key)
+			if err != nil {
+				return err
+			}
+			records[i], buckets[i] = record, record.RateBucket
 		}
-		if threadMessages[t].MessageSource == "Bot" {
-			message.Role = "assistant"
-		} else {
-			message.Role = "user"
+
+		if err := update(buckets); err != nil {
+			return err
 		}
-		responseMessages = append(responseMessages, message)
+
+		writes := make([]types.TransactWriteItem, 0, len(records))
+		for i, record := range records {
+			// A bucket that was never stored must still not exist, otherwise it must still be the version we read
+			condition := expression.AttributeNotExists(expression.Name("thread_id"))
+			if record.Version > 0 {
+				condition = expression.Name("version").Equal(expression.Value(record.Version))
+			}
+			expr, err := expression.NewBuilder().WithCondition(condition).Build()
+			if err != nil {
+				return err
+			}
+
+			record.RateBucket = buckets[i]
+			record.Version++
+			item, err := attributevalue.MarshalMap(&record)
+			if err != nil {
+				return err
+			}
+
+			writes = append(writes, types.TransactWriteItem{
+				Put: &types.Put{
+					TableName:                 aws.String(s.tableName),
+					Item:                      item,
+					ConditionExpression:       expr.Condition(),
+					ExpressionAttributeNames:  expr.Names(),
+					ExpressionAttributeValues: expr.Values(),
+				},
+			})
+		}
+
+		_, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) && attempt < maxUpdateAttempts {
+			continue
+		}
+		return err
 	}
-	return responseMessages, nil
 }
 
-func (s *Storage) AddThreadMessage(ctx context.Context, threadId string, messageSource string, message string) error {
-	messageRecord := &threadMessage{
-		ThreadId:        threadId,
-		MessageUnixTime: time.Now().UnixMilli(),
-		MessageSource:   messageSource,
-		Message:         message,
+func (s *Storage) getRateBucket(ctx context.Context, key string) (rateBucketRecord, error) {
+	record := rateBucketRecord{ThreadId: rateBucketKey(key)}
+	keyItem, err := attributevalue.MarshalMap(&record)
+	if err != nil {
+		return record, err
 	}
-	item, err := attributevalue.MarshalMap(messageRecord)
+
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.tableName),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]types.AttributeValue{
+			"thread_id":         keyItem["thread_id"],
+			"message_unix_time": keyItem["message_unix_time"],
+		},
+	})
+	if err != nil || result.Item == nil {
+		return record, err
+	}
+
+	err = attributevalue.UnmarshalMap(result.Item, &record)
+	return record, err
+}
+
+func (s *Storage) AddUsage(ctx context.Context, usage UsageRecord) error {
+	item, err := attributevalue.MarshalMap(&usageRecordItem{
+		ThreadId:        usageKey(usage.GuildId),
+		MessageUnixTime: usage.RecordedAt,
+		UsageRecord:     usage,
+	})
 	if err != nil {
 		return err
 	}
@@ -96,3 +357,150 @@ func (s *Storage) AddThreadMessage(ctx context.Context, threadId string, message
 
 	return err
 }
+
+func (s *Storage) GetUsage(ctx context.Context, guildId string, since time.Time) ([]UsageRecord, error) {
+	var records []UsageRecord
+	keyEx := expression.KeyAnd(
+		expression.Key("thread_id").Equal(expression.Value(usageKey(guildId))),
+		expression.Key("message_unix_time").GreaterThanEqual(expression.Value(since.UnixNano())),
+	)
+	expr, err := expression.NewBuilder().WithKeyCondition(keyEx).Build()
+	if err != nil {
+		return records, err
+	}
+
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.tableName),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		KeyConditionExpression:    expr.KeyCondition(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return records, err
+		}
+
+		var pageItems []usageRecordItem
+		err = attributevalue.UnmarshalListOfMaps(page.Items, &pageItems)
+		if err != nil {
+			return records, err
+		}
+		for _, item := range pageItems {
+			records = append(records, item.UsageRecord)
+		}
+	}
+
+	return records, nil
+}
+
+func (s *Storage) AddAuditRecord(ctx context.Context, record AuditRecord) error {
+	item, err := attributevalue.MarshalMap(&auditRecordItem{
+		ThreadId:        auditKey(record.GuildId),
+		MessageUnixTime: record.RecordedAt,
+		AuditRecord:     record,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(s.tableName),
+	})
+
+	return err
+}
+
+func (s *Storage) GetAccessPolicy(ctx context.Context, guildId string) (*AccessPolicy, error) {
+	record, found, err := s.getAccessPolicy(ctx, guildId, false)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &record.AccessPolicy, nil
+}
+
+// UpdateAccessPolicy only saves the policy if it's still the version that was read, starting over if it isn't
+func (s *Storage) UpdateAccessPolicy(ctx context.Context, guildId string, update func(policy *AccessPolicy) error) error {
+	for attempt := 1; ; attempt++ {
+		record, _, err := s.getAccessPolicy(ctx, guildId, true)
+		if err != nil {
+			return err
+		}
+
+		if err := update(&record.AccessPolicy); err != nil {
+			return err
+		}
+
+		// A policy that was never stored must still not exist, otherwise it must still be the version we read. Policies
+		// stored before they were versioned have no version to compare
+		condition := expression.Or(
+			expression.AttributeNotExists(expression.Name("thread_id")),
+			expression.AttributeNotExists(expression.Name("version")),
+		)
+		if record.Version > 0 {
+			condition = expression.Name("version").Equal(expression.Value(record.Version))
+		}
+		expr, err := expression.NewBuilder().WithCondition(condition).Build()
+		if err != nil {
+			return err
+		}
+
+		record.Version++
+		item, err := attributevalue.MarshalMap(&record)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                 aws.String(s.tableName),
+			Item:                      item,
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		var conflict *types.ConditionalCheckFailedException
+		if errors.As(err, &conflict) && attempt < maxUpdateAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+// getAccessPolicy loads the stored record of a guild's access policy, or an empty one if it has none. Reads before an
+// update are consistent, so that they see the latest version
+func (s *Storage) getAccessPolicy(ctx context.Context, guildId string, consistent bool) (accessPolicyRecord, bool, error) {
+	record := accessPolicyRecord{ThreadId: policyKey(guildId)}
+	key, err := attributevalue.MarshalMap(&record)
+	if err != nil {
+		return record, false, err
+	}
+
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.tableName),
+		ConsistentRead: aws.Bool(consistent),
+		Key: map[string]types.AttributeValue{
+			"thread_id":         key["thread_id"],
+			"message_unix_time": key["message_unix_time"],
+		},
+	})
+	if err != nil || result.Item == nil {
+		return record, false, err
+	}
+
+	err = attributevalue.UnmarshalMap(result.Item, &record)
+	return record, err == nil, err
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	table, err := s.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.tableName),
+	})
+	if err != nil {
+		return err
+	}
+	if table.Table.TableStatus != types.TableStatusActive {
+		return fmt.Errorf("table %s is %s", s.tableName, table.Table.TableStatus)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// ImageStore keeps a copy of the images the bot draws or is shown, and the audio it speaks, and knows the public URL each
+// stored file can be retrieved from. A negative contentLength means the length isn't known up front
+type ImageStore interface {
+	StoreImage(ctx context.Context, groupId string, reader io.Reader, contentLength int64, contentType string) (string, error)
+	PublicURL(key string) string
+}
+
+var fileHttpClient = &http.Client{
+	Transport: otelhttp.NewTransport(http.DefaultTransport),
+}
+
+// GetFileFromURL opens a stream to the file hosted at URL, like a generated image or a discord attachment. It's up to the
+// caller to close it
+func GetFileFromURL(ctx context.Context, URL string) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, URL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create file request: %w", err)
+	}
+
+	resp, err := fileHttpClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to request file from URL: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, 0, fmt.Errorf("unexpected response status: %d", resp.StatusCode)
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// newImageKey generates a unique, time ordered key for an image, grouped by the guild it was created in
+func newImageKey(groupId string) (string, error) {
+	uid, err := ksuid.NewRandomWithTime(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("somehow failed to generate a uid: %w", err)
+	}
+
+	if groupId == "" {
+		groupId = "private-chat"
+	}
+	return groupId + "/" + uid.String(), nil
+}
+
+func joinURL(baseURL string, key string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + key
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FilesystemImageStorage is an ImageStore that writes images into a local directory, for running the bot without a bucket
+type FilesystemImageStorage struct {
+	directory string
+	publicURL string
+}
+
+var _ ImageStore = (*FilesystemImageStorage)(nil)
+
+// NewFilesystemImageStorage stores images beneath directory, if publicURL is empty images are referenced by file:// URLs
+func NewFilesystemImageStorage(directory string, publicURL string) (*FilesystemImageStorage, error) {
+	absDirectory, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve image directory: %w", err)
+	}
+
+	if err = os.MkdirAll(absDirectory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create image directory: %w", err)
+	}
+
+	if publicURL == "" {
+		publicURL = (&url.URL{Scheme: "file", Path: filepath.ToSlash(absDirectory)}).String()
+	}
+
+	return &FilesystemImageStorage{
+		directory: absDirectory,
+		publicURL: publicURL,
+	}, nil
+}
+
+func (i *FilesystemImageStorage) StoreImage(_ context.Context, groupId string, reader io.Reader, _ int64, _ string) (string, error) {
+	key, err := newImageKey(groupId)
+	if err != nil {
+		return "", err
+	}
+
+	imagePath := filepath.Join(i.directory, filepath.FromSlash(key))
+	if err = os.MkdirAll(filepath.Dir(imagePath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create image group directory: %w", err)
+	}
+
+	imageFile, err := os.Create(imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create image file: %w", err)
+	}
+
+	_, err = io.Copy(imageFile, reader)
+	closeErr := imageFile.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to write image file: %w", err)
+	}
+	if closeErr != nil {
+		return "", fmt.Errorf("failed to write image file: %w", closeErr)
+	}
+
+	return key, nil
+}
+
+// PublicURL is where an image can be fetched from, if the directory is served at publicURL. Nothing serves the file://
+// URLs used without one, so discord and OpenAI can't fetch those
+func (i *FilesystemImageStorage) PublicURL(key string) string {
+	return joinURL(i.publicURL, key)
+}
+
+// MemoryImageStorage is an ImageStore that keeps images in memory, they're lost when the process exits
+type MemoryImageStorage struct {
+	mu        sync.RWMutex
+	images    map[string][]byte
+	publicURL string
+}
+
+var _ ImageStore = (*MemoryImageStorage)(nil)
+
+// NewMemoryImageStorage keeps images in memory, if publicURL is empty images are referenced by memory:// URLs
+func NewMemoryImageStorage(publicURL string) *MemoryImageStorage {
+	if publicURL == "" {
+		publicURL = "memory://images"
+	}
+
+	return &MemoryImageStorage{
+		images:    make(map[string][]byte),
+		publicURL: publicURL,
+	}
+}
+
+func (i *MemoryImageStorage) StoreImage(_ context.Context, groupId string, reader io.Reader, _ int64, _ string) (string, error) {
+	key, err := newImageKey(groupId)
+	if err != nil {
+		return "", err
+	}
+
+	var image bytes.Buffer
+	if _, err = io.Copy(&image, reader); err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.images[key] = image.Bytes()
+
+	return key, nil
+}
+
+// PublicURL is where an image would be fetched from, but nothing serves images kept in memory, whether it's the
+// memory:// URLs used by default or publicURL. They can only be read back with Image
+func (i *MemoryImageStorage) PublicURL(key string) string {
+	return joinURL(i.publicURL, key)
+}
+
+// Image returns the contents of a previously stored image
+func (i *MemoryImageStorage) Image(key string) ([]byte, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	image, ok := i.images[key]
+	return image, ok
+}
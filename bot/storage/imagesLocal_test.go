@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilesystemImageStorage(t *testing.T) {
+	ctx := context.Background()
+	image := []byte("\x89PNG not really")
+
+	tests := []struct {
+		name      string
+		publicURL string
+		// wantPrefix is what the image's public URL should start with, "" for the file:// URL of the directory
+		wantPrefix string
+	}{
+		{name: "without a public URL"},
+		{name: "with a public URL", publicURL: "https://images.example.com/", wantPrefix: "https://images.example.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			directory := filepath.Join(t.TempDir(), "images")
+			s, err := NewFilesystemImageStorage(directory, tt.publicURL)
+			if err != nil {
+				t.Fatalf("NewFilesystemImageStorage() error = %v", err)
+			}
+
+			key, err := s.StoreImage(ctx, "guild", bytes.NewReader(image), int64(len(image)), "image/png")
+			if err != nil {
+				t.Fatalf("StoreImage() error = %v", err)
+			}
+			if !strings.HasPrefix(key, "guild/") {
+				t.Errorf("key = %q, want it in the guild's group", key)
+			}
+
+			stored, err := os.ReadFile(filepath.Join(directory, filepath.FromSlash(key)))
+			if err != nil || !bytes.Equal(stored, image) {
+				t.Errorf("stored image = %q, %v, want %q", stored, err, image)
+			}
+
+			publicURL := s.PublicURL(key)
+			if tt.wantPrefix != "" {
+				if publicURL != tt.wantPrefix+key {
+					t.Errorf("PublicURL() = %q, want %q", publicURL, tt.wantPrefix+key)
+				}
+				return
+			}
+			// The file:// URL leads back to the stored file
+			parsed, err := url.Parse(publicURL)
+			if err != nil || parsed.Scheme != "file" {
+				t.Fatalf("PublicURL() = %q, %v, want a file:// URL", publicURL, err)
+			}
+			if stored, err = os.ReadFile(filepath.FromSlash(parsed.Path)); err != nil || !bytes.Equal(stored, image) {
+				t.Errorf("image at %q = %q, %v, want %q", publicURL, stored, err, image)
+			}
+		})
+	}
+
+	// Images from direct messages have a group of their own
+	s, err := NewFilesystemImageStorage(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("NewFilesystemImageStorage() error = %v", err)
+	}
+	key, err := s.StoreImage(ctx, "", bytes.NewReader(image), int64(len(image)), "image/png")
+	if err != nil || !strings.HasPrefix(key, "private-chat/") {
+		t.Errorf("StoreImage() = %q, %v, want a key in the private-chat group", key, err)
+	}
+}
+
+func TestMemoryImageStorage(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryImageStorage("")
+
+	images := map[string][]byte{}
+	for _, image := range [][]byte{[]byte("first"), []byte("second")} {
+		key, err := s.StoreImage(ctx, "guild", bytes.NewReader(image), int64(len(image)), "image/png")
+		if err != nil {
+			t.Fatalf("StoreImage() error = %v", err)
+		}
+		images[key] = image
+	}
+	if len(images) != 2 {
+		t.Fatalf("StoreImage() gave %d keys for 2 images", len(images))
+	}
+
+	for key, image := range images {
+		stored, ok := s.Image(key)
+		if !ok || !bytes.Equal(stored, image) {
+			t.Errorf("Image(%q) = %q, %v, want %q", key, stored, ok, image)
+		}
+		if publicURL := s.PublicURL(key); publicURL != "memory://images/"+key {
+			t.Errorf("PublicURL() = %q, want a memory:// URL", publicURL)
+		}
+	}
+	if _, ok := s.Image("guild/missing"); ok {
+		t.Error("Image() found an image that was never stored")
+	}
+
+	if publicURL := NewMemoryImageStorage("https://images.example.com").PublicURL("guild/key"); publicURL != "https://images.example.com/guild/key" {
+		t.Errorf("PublicURL() = %q, want it beneath the public URL", publicURL)
+	}
+}
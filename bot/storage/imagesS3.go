@@ -1,73 +1,62 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
-	"net/http"
-	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/segmentio/ksuid"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
-type ImageStorage struct {
+// S3ImageStorage is an ImageStore that writes images to an S3 bucket, which is served publicly from publicURL
+type S3ImageStorage struct {
 	client     *s3.Client
-	httpClient *http.Client
 	bucketName string
+	publicURL  string
 }
 
-func NewImageStorage(config aws.Config, bucketName string) *ImageStorage {
-	return &ImageStorage{
-		client: s3.NewFromConfig(config),
-		httpClient: &http.Client{
-			Transport: otelhttp.NewTransport(http.DefaultTransport),
-		},
+var _ ImageStore = (*S3ImageStorage)(nil)
+
+func NewS3ImageStorage(config aws.Config, bucketName string, publicURL string) *S3ImageStorage {
+	return &S3ImageStorage{
+		client:     s3.NewFromConfig(config),
 		bucketName: bucketName,
+		publicURL:  publicURL,
 	}
 }
 
-func (i *ImageStorage) GetImageFromURL(ctx context.Context, URL string) (io.ReadCloser, int64, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, URL, nil)
-	if err != nil {
-		return nil, 0, fmt.Errorf("failed to create image request: %w", err)
-	}
-
-	resp, err := i.httpClient.Do(req)
+func (i *S3ImageStorage) StoreImage(ctx context.Context, groupId string, reader io.Reader, contentLength int64, contentType string) (string, error) {
+	constructedKey, err := newImageKey(groupId)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to request image from URL: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, 0, fmt.Errorf("unexpected response status: %d", resp.StatusCode)
+		return "", err
 	}
 
-	return resp.Body, resp.ContentLength, nil
-}
-
-func (i *ImageStorage) StoreImage(ctx context.Context, groupId string, reader io.Reader, contentLength int64) (string, error) {
-	uid, err := ksuid.NewRandomWithTime(time.Now())
-	if err != nil {
-		return "", fmt.Errorf("somehow failed to generate a uid: %w", err)
+	// S3 needs to know how long an upload is before it starts, so streams of unknown length are read into memory first
+	if contentLength < 0 {
+		var buffered bytes.Buffer
+		if _, err = io.Copy(&buffered, reader); err != nil {
+			return "", fmt.Errorf("failed to read image: %w", err)
+		}
+		reader, contentLength = &buffered, int64(buffered.Len())
 	}
 
-	if groupId == "" {
-		groupId = "private-chat"
-	}
-	constructedKey := aws.String(groupId + "/" + uid.String())
 	_, err = i.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:        aws.String(i.bucketName),
-		Key:           constructedKey,
+		Key:           aws.String(constructedKey),
 		Body:          reader,
 		ContentLength: &contentLength,
-		ContentType:   aws.String("image/png"),
+		ContentType:   aws.String(contentType),
 	})
 
 	if err != nil {
 		return "", fmt.Errorf("failed to write image to S3: %w", err)
 	}
 
-	return *constructedKey, nil
+	return constructedKey, nil
+}
+
+func (i *S3ImageStorage) PublicURL(key string) string {
+	return joinURL(i.publicURL, key)
 }
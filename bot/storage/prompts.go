@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/fsnotify/fsnotify"
+)
+
+// PromptStore is where the persona prompt files are kept
+type PromptStore interface {
+	// ReadPrompts returns the contents of every .json prompt file, by file name
+	ReadPrompts(ctx context.Context) (map[string][]byte, error)
+	// WatchPrompts calls changed whenever the prompt files may have changed, until ctx is done
+	WatchPrompts(ctx context.Context, changed func()) error
+}
+
+// DirectoryPromptStore reads prompt files from a local directory, and watches it for changes
+type DirectoryPromptStore struct {
+	directory string
+}
+
+var _ PromptStore = (*DirectoryPromptStore)(nil)
+
+func NewDirectoryPromptStore(directory string) *DirectoryPromptStore {
+	return &DirectoryPromptStore{directory: directory}
+}
+
+func (d *DirectoryPromptStore) ReadPrompts(_ context.Context) (map[string][]byte, error) {
+	paths, err := filepath.Glob(filepath.Join(d.directory, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list prompt files: %w", err)
+	}
+
+	prompts := make(map[string][]byte, len(paths))
+	for _, p := range paths {
+		contents, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read prompt file %s: %w", p, err)
+		}
+		prompts[filepath.Base(p)] = contents
+	}
+	return prompts, nil
+}
+
+// promptSettleTime is how long the directory has to be left alone before a change is reported, editors and deploys
+// tend to touch several files, or the same file several times, in quick succession
+const promptSettleTime = time.Millisecond * 500
+
+func (d *DirectoryPromptStore) WatchPrompts(ctx context.Context, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch prompt files: %w", err)
+	}
+	defer watcher.Close()
+
+	err = watcher.Add(d.directory)
+	if err != nil {
+		return fmt.Errorf("failed to watch prompt directory %s: %w", d.directory, err)
+	}
+
+	settle := time.NewTimer(promptSettleTime)
+	settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-watcher.Events:
+			settle.Reset(promptSettleTime)
+		case err := <-watcher.Errors:
+			return fmt.Errorf("stopped watching prompt directory %s: %w", d.directory, err)
+		case <-settle.C:
+			changed()
+		}
+	}
+}
+
+// S3PromptStore reads prompt files from beneath a prefix in an S3 bucket, and polls it for changes
+type S3PromptStore struct {
+	client       *s3.Client
+	bucketName   string
+	prefix       string
+	pollInterval time.Duration
+}
+
+var _ PromptStore = (*S3PromptStore)(nil)
+
+func NewS3PromptStore(config aws.Config, bucketName string, prefix string, pollInterval time.Duration) *S3PromptStore {
+	return &S3PromptStore{
+		client:       s3.NewFromConfig(config),
+		bucketName:   bucketName,
+		prefix:       prefix,
+		pollInterval: pollInterval,
+	}
+}
+
+func (s *S3PromptStore) ReadPrompts(ctx context.Context) (map[string][]byte, error) {
+	prompts := make(map[string][]byte)
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(s.prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list prompt files in S3: %w", err)
+		}
+
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			name := strings.TrimPrefix(key, s.prefix)
+			// Prompt files in "subdirectories" aren't part of the set, the same as for a local directory
+			if path.Ext(name) != ".json" || strings.Contains(name, "/") {
+				continue
+			}
+
+			contents, err := s.readObject(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			prompts[name] = contents
+		}
+	}
+	return prompts, nil
+}
+
+func (s *S3PromptStore) readObject(ctx context.Context, key string) ([]byte, error) {
+	object, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt file %s from S3: %w", key, err)
+	}
+	defer object.Body.Close()
+
+	contents, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt file %s from S3: %w", key, err)
+	}
+	return contents, nil
+}
+
+// WatchPrompts reports a possible change every poll interval, S3 can't tell us when objects change without a lot more
+// infrastructure
+func (s *S3PromptStore) WatchPrompts(ctx context.Context, changed func()) error {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			changed()
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// streamingPlaceholder is shown until the first tokens of a reply arrive, discord won't accept an empty message
+const streamingPlaceholder = "…"
+
+// streamingReply renders a completion as it streams in, by posting a placeholder message and editing it as tokens
+// arrive. Edits are spaced at least interval apart so that we stay clear of discord's rate limits. Replies that outgrow
+// a message continue in further messages, and replies too long for that are attached as a file once they're complete.
+// When there's a check, like moderation, the text is checked before each edit and only what has passed is shown, once
+// a check blocks the reply nothing more of it is shown
+type streamingReply struct {
+	reply    responder
+	format   replyFormatter
+	interval time.Duration
+	check    func(ctx context.Context, text string) (*moderationVerdict, error)
+	content  strings.Builder
+	// checked is how much of content has passed the check, and verdict is why it was blocked, if it was
+	checked int
+	verdict *moderationVerdict
+	// messageIDs and rendered track each message the reply is spread over, and what it currently shows
+	messageIDs []string
+	rendered   []string
+	lastEdit   time.Time
+}
+
+func newStreamingReply(reply responder, format replyFormatter, interval time.Duration, check func(ctx context.Context, text string) (*moderationVerdict, error)) *streamingReply {
+	return &streamingReply{
+		reply:    reply,
+		format:   format,
+		interval: interval,
+		check:    check,
+	}
+}
+
+// Start posts the placeholder message that will be edited as the reply streams in
+func (s *streamingReply) Start(ctx context.Context) error {
+	message, err := s.reply.Send(ctx, &discordgo.MessageSend{Content: streamingPlaceholder})
+	if err != nil {
+		return err
+	}
+	s.messageIDs = []string{message.ID}
+	s.rendered = []string{streamingPlaceholder}
+	s.lastEdit = time.Now()
+	return nil
+}
+
+// Append adds a chunk of streamed text, and updates the messages if they haven't been edited recently
+func (s *streamingReply) Append(ctx context.Context, text string) error {
+	s.content.WriteString(text)
+	if s.verdict != nil || time.Since(s.lastEdit) < s.interval {
+		return nil
+	}
+	// Once a reply is long enough to end up as an attachment, stop spreading it over more messages
+	if s.format.Attach(s.content.String()) {
+		return nil
+	}
+
+	if s.check != nil {
+		text := s.content.String()
+		verdict, err := s.check(ctx, text)
+		if err != nil {
+			// Hold back what hasn't been checked until the next edit, rather than checking again with every chunk
+			s.lastEdit = time.Now()
+			return err
+		}
+		if verdict != nil {
+			s.verdict = verdict
+			return nil
+		}
+		s.checked = len(text)
+	}
+	return s.render(ctx, s.visible())
+}
+
+// Text is everything that has streamed in so far
+func (s *streamingReply) Text() string {
+	return s.content.String()
+}
+
+// Verdict is why the check blocked the reply while it was streaming in, or nil if it hasn't
+func (s *streamingReply) Verdict() *moderationVerdict {
+	return s.verdict
+}
+
+// Shown reports whether any of the reply might have been shown, after which it can't be started over
+func (s *streamingReply) Shown() bool {
+	return s.visible() != ""
+}
+
+// Discard forgets what has streamed in so far, so that a reply that hasn't been shown can start over
+func (s *streamingReply) Discard() {
+	s.content.Reset()
+	s.checked = 0
+	s.verdict = nil
+}
+
+// visible is the part of the reply that can be shown, which is everything when there's no check
+func (s *streamingReply) visible() string {
+	if s.check == nil {
+		return s.content.String()
+	}
+	return s.content.String()[:s.checked]
+}
+
+// Finish makes sure the messages show the complete reply, or replaces them with an attachment if it's too long
+func (s *streamingReply) Finish(ctx context.Context) error {
+	text := s.content.String()
+	if !s.format.Attach(text) {
+		return s.render(ctx, text)
+	}
+
+	// Fold everything into the first message, and attach the whole reply after it
+	if err := s.collapse(ctx); err != nil {
+		return err
+	}
+
+	message := attachmentMessage(text)
+	if err := s.render(ctx, message.Content); err != nil {
+		return err
+	}
+	message.Content = ""
+	_, err := s.reply.Send(ctx, message)
+	return err
+}
+
+// Fail annotates the reply to show that it was cut short, or replaces the placeholder with notice if no part of the
+// reply that can be shown ever arrived
+func (s *streamingReply) Fail(ctx context.Context, notice string) error {
+	if s.visible() == "" {
+		return s.render(ctx, notice)
+	}
+	return s.render(ctx, s.visible()+"\n\n*("+notice+")*")
+}
+
+// Replace swaps everything shown so far for text, like when a reply turns out to be something we shouldn't have said
+func (s *streamingReply) Replace(ctx context.Context, text string) error {
+	if err := s.collapse(ctx); err != nil {
+		return err
+	}
+	return s.render(ctx, text)
+}
+
+// collapse deletes every message but the first
+func (s *streamingReply) collapse(ctx context.Context) error {
+	for i := len(s.messageIDs) - 1; i > 0; i-- {
+		if err := s.reply.Delete(ctx, s.messageIDs[i]); err != nil {
+			return err
+		}
+	}
+	s.messageIDs, s.rendered = s.messageIDs[:1], s.rendered[:1]
+	return nil
+}
+
+// render edits each message to show its part of content, sending more messages if content needs them
+func (s *streamingReply) render(ctx context.Context, content string) error {
+	if content == "" {
+		return nil
+	}
+
+	for i, chunk := range s.format.Split(content) {
+		if i >= len(s.messageIDs) {
+			message, err := s.reply.Send(ctx, &discordgo.MessageSend{Content: chunk})
+			if err != nil {
+				return err
+			}
+			s.messageIDs = append(s.messageIDs, message.ID)
+			s.rendered = append(s.rendered, chunk)
+			continue
+		}
+
+		if chunk == s.rendered[i] {
+			continue
+		}
+		_, err := s.reply.Edit(ctx, s.messageIDs[i], chunk)
+		if err != nil {
+			return err
+		}
+		s.rendered[i] = chunk
+	}
+	s.lastEdit = time.Now()
+	return nil
+}
@@ -0,0 +1,148 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeResponder keeps the messages a reply is made of, as discord would show them
+type fakeResponder struct {
+	messages map[string]string
+	sent     int
+}
+
+func (f *fakeResponder) Send(_ context.Context, message *discordgo.MessageSend) (*discordgo.Message, error) {
+	if f.messages == nil {
+		f.messages = make(map[string]string)
+	}
+	f.sent++
+	id := strconv.Itoa(f.sent)
+	f.messages[id] = message.Content
+	return &discordgo.Message{ID: id, Content: message.Content}, nil
+}
+
+func (f *fakeResponder) Edit(_ context.Context, messageID string, content string) (*discordgo.Message, error) {
+	f.messages[messageID] = content
+	return &discordgo.Message{ID: messageID, Content: content}, nil
+}
+
+func (f *fakeResponder) Delete(_ context.Context, messageID string) error {
+	delete(f.messages, messageID)
+	return nil
+}
+
+func TestStreamingReplyCheck(t *testing.T) {
+	ctx := context.Background()
+	errUnavailable := errors.New("unavailable")
+	// check blocks anything with "bad" in it, and fails for anything with "flaky" in it
+	check := func(_ context.Context, text string) (*moderationVerdict, error) {
+		switch {
+		case strings.Contains(text, "flaky"):
+			return nil, errUnavailable
+		case strings.Contains(text, "bad"):
+			return &moderationVerdict{categories: []string{"harassment"}}, nil
+		}
+		return nil, nil
+	}
+
+	tests := []struct {
+		name   string
+		check  func(ctx context.Context, text string) (*moderationVerdict, error)
+		chunks []string
+		// want is what's shown after each chunk
+		want    []string
+		blocked bool
+	}{
+		{
+			name:   "without a check",
+			chunks: []string{"Hello", " bad", " world"},
+			want:   []string{"Hello", "Hello bad", "Hello bad world"},
+		},
+		{
+			name:   "passing",
+			check:  check,
+			chunks: []string{"Hello", " there"},
+			want:   []string{"Hello", "Hello there"},
+		},
+		{
+			name:    "blocked",
+			check:   check,
+			chunks:  []string{"Hello", " bad", " world"},
+			want:    []string{"Hello", "Hello", "Hello"},
+			blocked: true,
+		},
+		{
+			name:   "check failing",
+			check:  check,
+			chunks: []string{"Hello", " flaky"},
+			want:   []string{"Hello", "Hello"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responder := &fakeResponder{}
+			streamed := newStreamingReply(responder, replyFormatter{limit: 2000, attachOver: 8000}, 0, tt.check)
+			if err := streamed.Start(ctx); err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			for i, chunk := range tt.chunks {
+				err := streamed.Append(ctx, chunk)
+				if err != nil && !errors.Is(err, errUnavailable) {
+					t.Fatalf("Append() error = %v", err)
+				}
+				if shown := responder.messages["1"]; shown != tt.want[i] {
+					t.Errorf("after %q shown = %q, want %q", chunk, shown, tt.want[i])
+				}
+			}
+			if (streamed.Verdict() != nil) != tt.blocked {
+				t.Errorf("Verdict() = %v, want blocked %v", streamed.Verdict(), tt.blocked)
+			}
+			if streamed.Text() != strings.Join(tt.chunks, "") {
+				t.Errorf("Text() = %q, want everything that streamed in", streamed.Text())
+			}
+
+			// A failed reply only ever shows what passed the check
+			if err := streamed.Fail(ctx, "cut short"); err != nil {
+				t.Fatalf("Fail() error = %v", err)
+			}
+			if want := tt.want[len(tt.want)-1] + "\n\n*(cut short)*"; responder.messages["1"] != want {
+				t.Errorf("failed reply = %q, want %q", responder.messages["1"], want)
+			}
+		})
+	}
+}
+
+func TestStreamingReplyDiscard(t *testing.T) {
+	ctx := context.Background()
+	check := func(_ context.Context, text string) (*moderationVerdict, error) {
+		if strings.Contains(text, "bad") {
+			return &moderationVerdict{categories: []string{"harassment"}}, nil
+		}
+		return nil, nil
+	}
+	responder := &fakeResponder{}
+	streamed := newStreamingReply(responder, replyFormatter{limit: 2000, attachOver: 8000}, 0, check)
+	if err := streamed.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	// Nothing that was blocked has been shown, so the reply can start over
+	if err := streamed.Append(ctx, "bad"); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	if streamed.Shown() || streamed.Verdict() == nil {
+		t.Fatalf("Shown(), Verdict() = %v, %v, want a blocked reply that wasn't shown", streamed.Shown(), streamed.Verdict())
+	}
+	streamed.Discard()
+	if err := streamed.Append(ctx, "fine"); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	if !streamed.Shown() || streamed.Verdict() != nil || responder.messages["1"] != "fine" {
+		t.Errorf("Shown(), Verdict(), shown = %v, %v, %q, want the new attempt shown", streamed.Shown(), streamed.Verdict(), responder.messages["1"])
+	}
+}
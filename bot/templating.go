@@ -0,0 +1,130 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	gpt "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// promptVariables are what prompt messages can refer to, like {{.GuildName}}. Anything that isn't known is left empty
+type promptVariables struct {
+	// Date is today's date, like "Saturday 17 October 2026"
+	Date string
+	// GuildName is the name of the server, empty in direct messages
+	GuildName string
+	// ChannelName is the name of the channel or thread
+	ChannelName string
+	// ChannelTopic is the channel's topic, threads have the topic of the channel they're in
+	ChannelTopic string
+	// UserDisplayName is what the person talking to the bot is called, their server nickname if they have one
+	UserDisplayName string
+}
+
+// samplePromptVariables are used to check that prompt templates render, before they're used for real
+var samplePromptVariables = promptVariables{
+	Date:            time.Date(2023, time.April, 8, 0, 0, 0, 0, time.UTC).Format(promptDateLayout),
+	GuildName:       "Thunder Bay Programmers",
+	ChannelName:     "general",
+	ChannelTopic:    "Trains, mostly",
+	UserDisplayName: "Dan",
+}
+
+const promptDateLayout = "Monday 2 January 2006"
+
+// parsePromptTemplates parses each prompt message that uses a variable as a template, and renders it against sample
+// data so that a mistake, like a variable that doesn't exist, is caught when the prompt file is loaded
+func parsePromptTemplates(name string, messages []gpt.ChatCompletionMessage) ([]*template.Template, error) {
+	templates := make([]*template.Template, len(messages))
+	for i, message := range messages {
+		if !strings.Contains(message.Content, "{{") {
+			continue
+		}
+
+		t, err := template.New(fmt.Sprintf("%s message %d", name, i)).Parse(message.Content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse prompt file %s message %d: %w", name, i, err)
+		}
+		err = t.Execute(io.Discard, samplePromptVariables)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render prompt file %s message %d: %w", name, i, err)
+		}
+		templates[i] = t
+	}
+	return templates, nil
+}
+
+// render fills in the variables in the persona's prompt. A message that somehow fails to render is left as it is,
+// placeholders and all, rather than holding up the reply
+func (p *persona) render(ctx context.Context, variables promptVariables) []gpt.ChatCompletionMessage {
+	messages := make([]gpt.ChatCompletionMessage, len(p.Prompt))
+	copy(messages, p.Prompt)
+	for i, t := range p.templates {
+		if t == nil {
+			continue
+		}
+
+		var rendered strings.Builder
+		err := t.Execute(&rendered, variables)
+		if err != nil {
+			slog.Default().WithGroup("render").WarnContext(ctx, "failed to render a prompt message", slog.Any("error", err), slog.String("persona", p.ID))
+			trace.SpanFromContext(ctx).RecordError(err)
+			continue
+		}
+		messages[i].Content = rendered.String()
+	}
+	return messages
+}
+
+// promptVariables looks up what prompts can refer to about a request in discordgo's state
+func (b *AIBot) promptVariables(req *request) promptVariables {
+	variables := promptVariables{
+		Date:            time.Now().Format(promptDateLayout),
+		UserDisplayName: req.author.DisplayName(),
+	}
+	if req.member != nil && req.member.Nick != "" {
+		variables.UserDisplayName = req.member.Nick
+	}
+
+	state := b.discordSession.State
+	if guild, err := state.Guild(req.guildID); err == nil {
+		variables.GuildName = guild.Name
+	}
+	if ch, err := state.Channel(req.channelID); err == nil {
+		variables.ChannelName = ch.Name
+		variables.ChannelTopic = ch.Topic
+		if ch.IsThread() {
+			if parent, err := state.Channel(ch.ParentID); err == nil {
+				variables.ChannelTopic = parent.Topic
+			}
+		}
+	}
+	return variables
+}
+
+// RenderPromptFile checks the prompt file at path and writes its messages out, rendered against sample data, so that
+// prompt changes can be tried out before they're deployed
+func RenderPromptFile(path string, out io.Writer) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read prompt file %s: %w", path, err)
+	}
+
+	p, err := parsePersona(filepath.Base(path), contents)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p.render(context.Background(), samplePromptVariables))
+}
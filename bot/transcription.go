@@ -0,0 +1,149 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	gpt "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"openai-discord-bot/bot/provider"
+	"openai-discord-bot/bot/storage"
+)
+
+// transcriptionConfig controls how voice messages and other audio attachments are transcribed
+type transcriptionConfig struct {
+	model    string
+	maxBytes int
+	// echo posts the transcript back to the channel, so people who can't listen to the audio can read it
+	echo bool
+}
+
+// audioSource is an audio file someone sent the bot
+type audioSource struct {
+	URL      string
+	Filename string
+	// Size is the size of the audio in bytes, if discord told us
+	Size int
+}
+
+// isVoiceMessage reports whether a message was recorded in discord's voice message UI, rather than typed
+func isVoiceMessage(m *discordgo.Message) bool {
+	return m.Flags&discordgo.MessageFlagsIsVoiceMessage != 0
+}
+
+// messageAudio finds the audio attached to a message
+func messageAudio(m *discordgo.Message) []audioSource {
+	var audio []audioSource
+	for _, attachment := range m.Attachments {
+		if !strings.HasPrefix(attachment.ContentType, "audio/") {
+			continue
+		}
+		audio = append(audio, audioSource{URL: attachment.URL, Filename: attachment.Filename, Size: attachment.Size})
+	}
+	return audio
+}
+
+// transcribe turns the audio sent to the bot into text, one paragraph per attachment
+func (b *AIBot) transcribe(ctx context.Context, req *request, sources []audioSource) (string, error) {
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "transcribe")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("model", b.transcription.model),
+		attribute.Int("attachments", len(sources)),
+	)
+
+	var transcripts []string
+	for _, source := range sources {
+		transcript, err := b.transcribeAudio(ctx, req, source)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return "", err
+		}
+		transcripts = append(transcripts, transcript)
+	}
+
+	span.SetStatus(codes.Ok, "Success")
+	return strings.Join(transcripts, "\n\n"), nil
+}
+
+func (b *AIBot) transcribeAudio(ctx context.Context, req *request, source audioSource) (string, error) {
+	if source.Size > b.transcription.maxBytes {
+		return "", fmt.Errorf("audio is too large to transcribe (%d bytes)", source.Size)
+	}
+
+	audioReader, _, err := storage.GetFileFromURL(ctx, source.URL)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve audio: %w", err)
+	}
+	defer func() {
+		_ = audioReader.Close()
+	}()
+
+	// Attachments don't always say how big they are, so read one byte past the limit to tell audio that's exactly the
+	// limit from audio that's over it, rather than sending the API part of a file
+	audio, err := io.ReadAll(io.LimitReader(audioReader, int64(b.transcription.maxBytes)+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read audio: %w", err)
+	}
+	if len(audio) > b.transcription.maxBytes {
+		return "", fmt.Errorf("audio is larger than %d bytes, too large to transcribe", b.transcription.maxBytes)
+	}
+
+	// The filename tells the API which format the audio is in, and the verbose format tells us how long it was
+	started := time.Now()
+	callCtx, served := provider.Track(ctx)
+	response, err := b.provider.CreateTranscription(callCtx, gpt.AudioRequest{
+		Model:    b.transcription.model,
+		FilePath: source.Filename,
+		Reader:   bytes.NewReader(audio),
+		Format:   gpt.AudioResponseFormatVerboseJSON,
+	})
+	b.health.RecordOpenAI(err)
+	metrics.recordOpenAI(ctx, transcriptionFeature, served.ModelOr(b.transcription.model), started, err)
+	if err != nil {
+		return "", fmt.Errorf("failed to transcribe audio: %w", err)
+	}
+	b.usage.Record(ctx, req, served.ModelOr(b.transcription.model), storage.UsageRecord{
+		Provider: served.Provider,
+		Model:    served.ModelOr(b.transcription.model),
+		Feature:  transcriptionFeature,
+		Units:    response.Duration / 60,
+	})
+	return strings.TrimSpace(response.Text), nil
+}
+
+// withTranscript transcribes audio sent along with a prompt, and adds the transcript to the prompt. The transcript is
+// echoed back to the channel if that's enabled
+func (b *AIBot) withTranscript(ctx context.Context, req *request, reply responder, prompt string, audio []audioSource) (string, error) {
+	logger := slog.Default().WithGroup("withTranscript")
+
+	transcript, err := b.transcribe(ctx, req, audio)
+	if err != nil {
+		return prompt, err
+	}
+	if transcript == "" {
+		return prompt, nil
+	}
+
+	if b.transcription.echo {
+		err = b.format.Send(ctx, reply, "> 🎤 "+strings.ReplaceAll(transcript, "\n", "\n> "))
+		if err != nil {
+			logger.WarnContext(ctx, "failed to echo transcript", slog.Any("error", err))
+		}
+	}
+
+	prompt = strings.TrimSpace(prompt)
+	if prompt == "" {
+		return transcript, nil
+	}
+	return prompt + "\n\n" + transcript, nil
+}
@@ -0,0 +1,38 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTranscribeAudioTooLarge(t *testing.T) {
+	const maxBytes = 10
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before writing leaves the response without a length, like audio that doesn't say how big it is
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte(strings.Repeat("a", maxBytes+1)))
+	}))
+	defer server.Close()
+
+	// There's no provider, so any audio that isn't refused fails the test by trying to transcribe it
+	b := &AIBot{transcription: transcriptionConfig{model: "whisper-1", maxBytes: maxBytes}}
+
+	tests := []struct {
+		name   string
+		source audioSource
+	}{
+		{name: "size known", source: audioSource{URL: server.URL, Filename: "voice.ogg", Size: maxBytes + 1}},
+		{name: "size unknown", source: audioSource{URL: server.URL, Filename: "voice.ogg"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := b.transcribeAudio(context.Background(), &request{}, tt.source)
+			if err == nil || !strings.Contains(err.Error(), "too large") {
+				t.Errorf("transcribeAudio() error = %v, want the audio refused as too large", err)
+			}
+		})
+	}
+}
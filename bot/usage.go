@@ -0,0 +1,205 @@
+package bot
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/spf13/viper"
+	"openai-discord-bot/bot/storage"
+)
+
+// The features usage is reported by, each of them calls OpenAI for something different
+const (
+	chatFeature          = "chat"
+	summaryFeature       = "summary"
+	imageFeature         = "image"
+	transcriptionFeature = "transcription"
+	speechFeature        = "speech"
+	moderationFeature    = "moderation"
+)
+
+// modelPrice is what a model costs in USD. Prompt and Completion are per million tokens, Unit is per image, per minute
+// of transcribed audio, or per character of speech
+type modelPrice struct {
+	Model      string  `mapstructure:"model"`
+	Prompt     float64 `mapstructure:"prompt"`
+	Completion float64 `mapstructure:"completion"`
+	Unit       float64 `mapstructure:"unit"`
+}
+
+// defaultPrices are OpenAI's and Anthropic's list prices, pictures are priced by model, quality and size
+var defaultPrices = []modelPrice{
+	{Model: "gpt-3.5-turbo", Prompt: 0.50, Completion: 1.50},
+	{Model: "gpt-4", Prompt: 30, Completion: 60},
+	{Model: "gpt-4-turbo", Prompt: 10, Completion: 30},
+	{Model: "gpt-4o", Prompt: 2.50, Completion: 10},
+	{Model: "gpt-4o-mini", Prompt: 0.15, Completion: 0.60},
+	{Model: "gpt-4.1", Prompt: 2, Completion: 8},
+	{Model: "gpt-4.1-mini", Prompt: 0.40, Completion: 1.60},
+	{Model: "claude-haiku-4-5", Prompt: 1, Completion: 5},
+	{Model: "claude-sonnet-4-5", Prompt: 3, Completion: 15},
+	{Model: "claude-opus-4-1", Prompt: 15, Completion: 75},
+	{Model: "dall-e-2/standard/1024x1024", Unit: 0.02},
+	{Model: "dall-e-3/standard/1024x1024", Unit: 0.04},
+	{Model: "dall-e-3/standard/1792x1024", Unit: 0.08},
+	{Model: "dall-e-3/standard/1024x1792", Unit: 0.08},
+	{Model: "dall-e-3/hd/1024x1024", Unit: 0.08},
+	{Model: "dall-e-3/hd/1792x1024", Unit: 0.12},
+	{Model: "dall-e-3/hd/1024x1792", Unit: 0.12},
+	{Model: "whisper-1", Unit: 0.006},
+	{Model: "tts-1", Unit: 0.000015},
+	{Model: "tts-1-hd", Unit: 0.00003},
+	{Model: "omni-moderation-latest"},
+	{Model: "text-moderation-latest"},
+}
+
+// imagePriceKey finds the price of a picture drawn with settings
+func imagePriceKey(settings GenerationSettings) string {
+	return fmt.Sprintf("%s/%s/%s", settings.ImageModel, settings.ImageQuality, settings.ImageSize)
+}
+
+// usageMeter records what every OpenAI call used, and estimates what it cost
+type usageMeter struct {
+	store  storage.UsageStore
+	prices map[string]modelPrice
+}
+
+// newUsageMeter prices calls with the default prices, overridden by any in the PRICES section of the config file
+func newUsageMeter(store storage.UsageStore) (*usageMeter, error) {
+	var configured []modelPrice
+	err := viper.UnmarshalKey("PRICES", &configured)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PRICES: %w", err)
+	}
+
+	prices := make(map[string]modelPrice)
+	for _, price := range slices.Concat(defaultPrices, configured) {
+		prices[price.Model] = price
+	}
+	return &usageMeter{store: store, prices: prices}, nil
+}
+
+// Record works out the cost of a call from the price under priceKey, and stores it against the requester. Failing to
+// record usage isn't worth failing the request over, so errors are only logged
+func (u *usageMeter) Record(ctx context.Context, req *request, priceKey string, usage storage.UsageRecord) {
+	logger := slog.Default().WithGroup("usageMeter")
+
+	price, ok := u.prices[priceKey]
+	if !ok {
+		logger.WarnContext(ctx, "no price for model, recording it as free", slog.String("model", priceKey))
+	}
+	usage.Cost = (float64(usage.PromptTokens)*price.Prompt+float64(usage.CompletionTokens)*price.Completion)/1_000_000 +
+		usage.Units*price.Unit
+
+	now := time.Now().UTC()
+	usage.GuildId = req.guildID
+	usage.Day = now.Format(time.DateOnly)
+	usage.RecordedAt = now.UnixNano()
+	usage.UserId = req.author.ID
+	usage.UserName = req.author.Username
+	metrics.recordUsage(ctx, usage.Model, usage.Feature, usage.PromptTokens, usage.CompletionTokens, usage.Cost)
+
+	err := u.store.AddUsage(ctx, usage)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to record usage", slog.Any("error", err), slog.String("feature", usage.Feature))
+	}
+}
+
+// usagePeriods are the periods the usage report totals spend over, starting from the current UTC day, week and month
+func usagePeriods(now time.Time) []time.Time {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	// Weeks start on Monday
+	week := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []time.Time{today, week, month}
+}
+
+// usageReport shows a guild's spend today, this week, and this month, broken down by feature and by user
+func (b *AIBot) usageReport(ctx context.Context, req *request) error {
+	reply := b.responderFor(ctx, req, req.channelID)
+	if req.guildID == "" {
+		return sendText(ctx, reply, "Usage is only tracked in servers")
+	}
+	if req.member == nil || req.member.Permissions&discordgo.PermissionManageGuild == 0 {
+		return sendText(ctx, reply, "Only server managers can see what I cost")
+	}
+
+	periods := usagePeriods(time.Now())
+	records, err := b.storage.GetUsage(ctx, req.guildID, slices.MinFunc(periods, func(a, b time.Time) int { return a.Compare(b) }))
+	if err != nil {
+		_ = sendText(ctx, reply, "Whoops something went wrong processing that")
+		return fmt.Errorf("failed to load usage: %w", err)
+	}
+
+	// Tally spend per row, with one column for each period
+	type usageRow struct {
+		name  string
+		spend []float64
+	}
+	newRow := func(name string) *usageRow {
+		return &usageRow{name: name, spend: make([]float64, len(periods))}
+	}
+	rowFor := func(rows map[string]*usageRow, key string, name string) *usageRow {
+		if _, ok := rows[key]; !ok {
+			rows[key] = newRow(name)
+		}
+		return rows[key]
+	}
+	total := newRow("Total")
+	features := make(map[string]*usageRow)
+	users := make(map[string]*usageRow)
+	for _, record := range records {
+		rows := []*usageRow{total, rowFor(features, record.Feature, record.Feature), rowFor(users, record.UserId, record.UserName)}
+		for i, start := range periods {
+			if record.RecordedAt < start.UnixNano() {
+				continue
+			}
+			for _, row := range rows {
+				row.spend[i] += record.Cost
+			}
+		}
+	}
+
+	// Biggest spenders first
+	sorted := func(rows map[string]*usageRow) []*usageRow {
+		values := make([]*usageRow, 0, len(rows))
+		for _, row := range rows {
+			values = append(values, row)
+		}
+		slices.SortFunc(values, func(a, b *usageRow) int {
+			return cmp.Or(cmp.Compare(b.spend[len(b.spend)-1], a.spend[len(a.spend)-1]), strings.Compare(a.name, b.name))
+		})
+		return values
+	}
+
+	var table strings.Builder
+	w := tabwriter.NewWriter(&table, 0, 0, 2, ' ', tabwriter.AlignRight)
+	writeRow := func(row *usageRow) {
+		_, _ = fmt.Fprintf(w, "%s\t", row.name)
+		for _, spend := range row.spend {
+			_, _ = fmt.Fprintf(w, "$%.2f\t", spend)
+		}
+		_, _ = fmt.Fprintln(w)
+	}
+	_, _ = fmt.Fprintln(w, "\tToday\tThis week\tThis month\t")
+	writeRow(total)
+	_, _ = fmt.Fprintln(w, "By feature\t\t\t\t")
+	for _, row := range sorted(features) {
+		writeRow(row)
+	}
+	_, _ = fmt.Fprintln(w, "By user\t\t\t\t")
+	for _, row := range sorted(users) {
+		writeRow(row)
+	}
+	_ = w.Flush()
+
+	return b.format.Send(ctx, reply, "Estimated OpenAI spend for this server, in USD\n```\n"+table.String()+"```")
+}
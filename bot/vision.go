@@ -0,0 +1,183 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	gpt "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"openai-discord-bot/bot/storage"
+)
+
+// visionImageTypes are the image formats vision models accept
+var visionImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// visionConfig limits the images passed along to vision models
+type visionConfig struct {
+	maxImages     int
+	maxImageBytes int
+}
+
+// imageSource is an image someone showed the bot, either attached to their message or embedded from a link
+type imageSource struct {
+	URL         string
+	ContentType string
+	// Size is the size of the image in bytes, if discord told us
+	Size int
+}
+
+// attachmentImage returns the image in an attachment, if it is one
+func attachmentImage(attachment *discordgo.MessageAttachment) (imageSource, bool) {
+	if attachment == nil || !strings.HasPrefix(attachment.ContentType, "image/") {
+		return imageSource{}, false
+	}
+	return imageSource{URL: attachment.URL, ContentType: attachment.ContentType, Size: attachment.Size}, true
+}
+
+// messageImages finds the images attached to or embedded in a message
+func messageImages(m *discordgo.Message) []imageSource {
+	var images []imageSource
+	for _, attachment := range m.Attachments {
+		if image, ok := attachmentImage(attachment); ok {
+			images = append(images, image)
+		}
+	}
+
+	// Links to images are embedded by discord, the embed's type tells us it's an image but not which format
+	for _, embed := range m.Embeds {
+		switch {
+		case embed.Type == discordgo.EmbedTypeImage && embed.URL != "":
+			images = append(images, imageSource{URL: embed.URL})
+		case embed.Image != nil && embed.Image.URL != "":
+			images = append(images, imageSource{URL: embed.Image.URL})
+		}
+	}
+	return images
+}
+
+// loadImages checks and downloads the images shown to the bot, returning them as message parts for the model, and the
+// URLs they should be referenced by in the thread's history. Images that fail the checks are skipped, and images that
+// couldn't be archived are left out of the history
+func (b *AIBot) loadImages(ctx context.Context, req *request, sources []imageSource) ([]gpt.ChatMessagePart, []string) {
+	logger := slog.Default().WithGroup("loadImages")
+	ctx, span := otel.GetTracerProvider().Tracer("AIBot").Start(ctx, "loadImages")
+	defer span.End()
+
+	if len(sources) > b.vision.maxImages {
+		logger.InfoContext(ctx, "ignoring extra images", slog.Int("images", len(sources)), slog.Int("max_images", b.vision.maxImages))
+		sources = sources[:b.vision.maxImages]
+	}
+
+	var parts []gpt.ChatMessagePart
+	var references []string
+	for _, source := range sources {
+		image, contentType, err := b.fetchImage(ctx, source)
+		if err != nil {
+			span.RecordError(err)
+			logger.WarnContext(ctx, "skipping image", slog.Any("error", err), slog.String("url", source.URL))
+			continue
+		}
+
+		parts = append(parts, gpt.ChatMessagePart{
+			Type: gpt.ChatMessagePartTypeImageURL,
+			ImageURL: &gpt.ChatMessageImageURL{
+				URL:    "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(image),
+				Detail: gpt.ImageURLDetailAuto,
+			},
+		})
+		if reference := b.archiveImage(ctx, req, source, image, contentType); reference != "" {
+			references = append(references, reference)
+		}
+	}
+
+	span.SetAttributes(attribute.Int("images", len(parts)))
+	return parts, references
+}
+
+// fetchImage downloads an image, making sure it's a format the model accepts and that it isn't too large
+func (b *AIBot) fetchImage(ctx context.Context, source imageSource) ([]byte, string, error) {
+	if source.ContentType != "" && !visionImageTypes[mediaType(source.ContentType)] {
+		return nil, "", fmt.Errorf("unsupported image type %s", source.ContentType)
+	}
+	if source.Size > b.vision.maxImageBytes {
+		return nil, "", fmt.Errorf("image is too large (%d bytes)", source.Size)
+	}
+
+	imageReader, _, err := storage.GetFileFromURL(ctx, source.URL)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = imageReader.Close()
+	}()
+
+	// Read one byte past the limit, so we can tell an image that's exactly the limit from one that's over it
+	image, err := io.ReadAll(io.LimitReader(imageReader, int64(b.vision.maxImageBytes)+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image: %w", err)
+	}
+	if len(image) > b.vision.maxImageBytes {
+		return nil, "", fmt.Errorf("image is larger than %d bytes", b.vision.maxImageBytes)
+	}
+
+	// Trust the content over whatever we were told about it
+	contentType := http.DetectContentType(image)
+	if !visionImageTypes[contentType] {
+		return nil, "", fmt.Errorf("unsupported image type %s", contentType)
+	}
+	return image, contentType, nil
+}
+
+// archiveImage keeps a copy of an image in image storage, returning a URL the model can fetch it from later in the
+// thread. Discord's own URLs expire, so when image storage isn't publicly reachable there's nothing lasting to refer to
+// and "" is returned, the image is only seen with the message it came with
+func (b *AIBot) archiveImage(ctx context.Context, req *request, source imageSource, image []byte, contentType string) string {
+	logger := slog.Default().WithGroup("archiveImage")
+	key, err := b.imageStorage.StoreImage(ctx, req.guildID, bytes.NewReader(image), int64(len(image)), contentType)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to store a copy of the image, leaving it out of the thread's history", slog.Any("error", err), slog.String("url", source.URL))
+		return ""
+	}
+
+	publicURL := b.imageStorage.PublicURL(key)
+	if !strings.HasPrefix(publicURL, "https://") && !strings.HasPrefix(publicURL, "http://") {
+		logger.WarnContext(ctx, "image storage has no public URL, leaving the image out of the thread's history", slog.String("key", key))
+		return ""
+	}
+	return publicURL
+}
+
+// withoutImages flattens multipart messages down to their text, for models that can't see images
+func withoutImages(messages []gpt.ChatCompletionMessage) []gpt.ChatCompletionMessage {
+	flattened := make([]gpt.ChatCompletionMessage, 0, len(messages))
+	for _, message := range messages {
+		if len(message.MultiContent) > 0 {
+			message.Content = messageText(message)
+			message.MultiContent = nil
+		}
+		flattened = append(flattened, message)
+	}
+	return flattened
+}
+
+func mediaType(contentType string) string {
+	parsed, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return parsed
+}
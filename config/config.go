@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -22,11 +23,80 @@ import (
 
 var awscfg aws.Config
 
+// secretSettings are left out of the logged configuration. viper lower cases the keys it returns, so these are
+// compared in upper case
+var secretSettings = map[string]bool{
+	"DISCORD_TOKEN":     true,
+	"OPENAI_AUTH_TOKEN": true,
+	"ADMIN_TOKEN":       true,
+	"ANTHROPIC_API_KEY": true,
+}
+
 func init() {
 	viper.SetDefault("DEBUG_LOGS", false)
 	viper.SetDefault("JSON_LOGS", true)
 	viper.SetDefault("TRACING", true)
+	viper.SetDefault("METRICS", true)
+	viper.SetDefault("METRICS_INTERVAL", time.Minute)
+	viper.SetDefault("TRACE_CONTENT", false)
+	viper.SetDefault("TRACE_CONTENT_MAX_LENGTH", 4000)
 	viper.SetDefault("OPENAIDISCORDBOTIMAGES_NAME", "")
+	viper.SetDefault("STORAGE_BACKEND", "dynamodb")
+	viper.SetDefault("STORAGE_PATH", "danbot.db")
+	viper.SetDefault("IMAGE_STORAGE_BACKEND", "s3")
+	viper.SetDefault("IMAGE_STORAGE_PATH", "images")
+	viper.SetDefault("IMAGE_PUBLIC_URL", "")
+	viper.SetDefault("CONTEXT_TOKEN_BUDGET", 3000)
+	viper.SetDefault("THREAD_HISTORY_LIMIT", storage.DefaultThreadLimit)
+	viper.SetDefault("PROVIDERS", []string{"openai"})
+	viper.SetDefault("PROVIDER_FAILURE_THRESHOLD", 3)
+	viper.SetDefault("PROVIDER_COOLDOWN", time.Second*30)
+	viper.SetDefault("ANTHROPIC_API_KEY", "")
+	viper.SetDefault("ANTHROPIC_BASE_URL", "https://api.anthropic.com/v1")
+	viper.SetDefault("ANTHROPIC_MODEL", "claude-sonnet-4-5")
+	viper.SetDefault("ANTHROPIC_MAX_TOKENS", 1024)
+	viper.SetDefault("OPENAI_API_TYPE", openaiAPIType)
+	viper.SetDefault("OPENAI_BASE_URL", "")
+	viper.SetDefault("OPENAI_API_VERSION", "")
+	viper.SetDefault("MODEL_ALIASES", map[string]string{})
+	viper.SetDefault("CHAT_MODEL", gpt.GPT3Dot5Turbo)
+	viper.SetDefault("IMAGE_MODEL", gpt.CreateImageModelDallE3)
+	viper.SetDefault("IMAGE_SIZE", gpt.CreateImageSize1024x1024)
+	viper.SetDefault("IMAGE_QUALITY", gpt.CreateImageQualityStandard)
+	viper.SetDefault("STREAM_EDIT_INTERVAL", time.Millisecond*1500)
+	viper.SetDefault("REPLY_ATTACHMENT_THRESHOLD", 8000)
+	viper.SetDefault("VISION_MAX_IMAGES", 4)
+	viper.SetDefault("VISION_MAX_IMAGE_BYTES", 20*1024*1024)
+	viper.SetDefault("TRANSCRIPTION_MODEL", gpt.Whisper1)
+	viper.SetDefault("TRANSCRIPTION_MAX_BYTES", 25*1024*1024)
+	viper.SetDefault("TRANSCRIPTION_ECHO", false)
+	viper.SetDefault("SPEECH_MODEL", gpt.TTSModel1)
+	viper.SetDefault("SPEECH_VOICE", gpt.VoiceOnyx)
+	viper.SetDefault("DEFAULT_PERSONA", "danbo")
+	viper.SetDefault("PROMPTS_PATH", "prompts")
+	viper.SetDefault("PROMPTS_BUCKET", "")
+	viper.SetDefault("PROMPTS_PREFIX", "prompts/")
+	viper.SetDefault("PROMPTS_POLL_INTERVAL", time.Minute)
+	viper.SetDefault("PROMPTS_WATCH", true)
+	viper.SetDefault("RATE_LIMIT_CHAT_USER_BURST", 10)
+	viper.SetDefault("RATE_LIMIT_CHAT_USER_INTERVAL", time.Second*30)
+	viper.SetDefault("RATE_LIMIT_IMAGE_USER_BURST", 3)
+	viper.SetDefault("RATE_LIMIT_IMAGE_USER_INTERVAL", time.Minute*10)
+	viper.SetDefault("RATE_LIMIT_EXEMPT_ROLES", []string{})
+	viper.SetDefault("MODERATION", true)
+	viper.SetDefault("MODERATION_MODEL", gpt.ModerationOmniLatest)
+	viper.SetDefault("ALLOWED_GUILDS", []string{})
+	viper.SetDefault("DENIED_GUILDS", []string{})
+	viper.SetDefault("ACCESS_POLICY_CACHE_TTL", time.Second*30)
+	viper.SetDefault("WORKERS", 8)
+	viper.SetDefault("WORK_QUEUE_SIZE", 64)
+	viper.SetDefault("SHUTDOWN_TIMEOUT", time.Second*25)
+	viper.SetDefault("ANNOUNCEMENT_CHANNELS", []string{})
+	viper.SetDefault("HTTP_ADDRESS", "")
+	viper.SetDefault("ADMIN_TOKEN", "")
+	viper.SetDefault("HEALTH_GATEWAY_GRACE", time.Minute*2)
+	viper.SetDefault("HEALTH_OPENAI_WINDOW", time.Minute*5)
+	viper.SetDefault("HEALTH_OPENAI_MIN_SUCCESS_RATE", 0.5)
 	viper.SetEnvPrefix("BOT")
 	viper.AutomaticEnv()
 
@@ -37,6 +107,15 @@ func init() {
 
 func Configure(serviceCtx context.Context) {
 	var err error
+	// Settings that don't fit in environment variables, like per guild overrides, can be kept in an optional config file
+	if configFile := viper.GetString("CONFIG_FILE"); configFile != "" {
+		viper.SetConfigFile(configFile)
+		err = viper.ReadInConfig()
+		if err != nil {
+			panic(fmt.Sprintf("unable to read config file, %v", err))
+		}
+	}
+
 	err = configureLogging(serviceCtx)
 	if err != nil {
 		panic(err)
@@ -47,7 +126,7 @@ func Configure(serviceCtx context.Context) {
 	configValues := viper.AllSettings()
 	configFields := make([]any, 0, len(configValues))
 	for k, v := range configValues {
-		if k == "DISCORD_TOKEN" || k == "OPENAI_AUTH_TOKEN" {
+		if secretSettings[strings.ToUpper(k)] {
 			v = "<REDACTED>"
 		}
 		configFields = append(configFields, slog.Any(k, v))
@@ -64,6 +143,15 @@ func Configure(serviceCtx context.Context) {
 		otel.SetTracerProvider(noop.NewTracerProvider())
 	}
 
+	// Without a meter provider the bot's metrics go nowhere
+	if viper.GetBool("METRICS") {
+		logger.InfoContext(serviceCtx, "Configuring metrics")
+		metricsErr := configureMetrics(serviceCtx)
+		if metricsErr != nil {
+			logger.ErrorContext(serviceCtx, "failed to initialize metrics", slog.Any("error", metricsErr))
+		}
+	}
+
 	logger.InfoContext(serviceCtx, "Configuring AWS Session")
 	// TODO Can I remove the region? And should I be using the serviceCtx here?
 	awscfg, err = config.LoadDefaultConfig(context.Background(), config.WithRegion("ca-central-1"))
@@ -77,12 +165,58 @@ func GetAWSConfig() aws.Config {
 	return awscfg
 }
 
-func GetStorage() *storage.Storage {
-	return storage.NewStorage(GetAWSConfig())
+// GetStorage returns the conversation store selected by the STORAGE_BACKEND setting, either "dynamodb" or the embedded
+// "bolt" database at STORAGE_PATH. Local stores are closed when the service context terminates
+func GetStorage(serviceCtx context.Context) (storage.ConversationStore, error) {
+	switch backend := viper.GetString("STORAGE_BACKEND"); backend {
+	case "dynamodb":
+		return storage.NewStorage(GetAWSConfig()), nil
+	case "bolt":
+		boltStorage, err := storage.NewBoltStorage(viper.GetString("STORAGE_PATH"))
+		if err != nil {
+			return nil, err
+		}
+		go func(lifecycleContext context.Context) {
+			<-lifecycleContext.Done()
+			if err := boltStorage.Close(); err != nil {
+				slog.Default().ErrorContext(serviceCtx, "Failed to close conversation storage", slog.Any("error", err))
+			}
+		}(serviceCtx)
+		return boltStorage, nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
 }
 
-func GetImageStorage() *storage.ImageStorage {
-	return storage.NewImageStorage(GetAWSConfig(), viper.GetString("OPENAIDISCORDBOTIMAGES_NAME"))
+// defaultS3ImagePublicURL is where the images bucket is served from when IMAGE_PUBLIC_URL isn't configured
+const defaultS3ImagePublicURL = "https://sillybullshit.click"
+
+// GetImageStorage returns the image store selected by the IMAGE_STORAGE_BACKEND setting, one of "s3", "filesystem"
+// (beneath IMAGE_STORAGE_PATH) or "memory". Stored images are linked from IMAGE_PUBLIC_URL
+func GetImageStorage() (storage.ImageStore, error) {
+	publicURL := viper.GetString("IMAGE_PUBLIC_URL")
+	switch backend := viper.GetString("IMAGE_STORAGE_BACKEND"); backend {
+	case "s3":
+		if publicURL == "" {
+			publicURL = defaultS3ImagePublicURL
+		}
+		return storage.NewS3ImageStorage(GetAWSConfig(), viper.GetString("OPENAIDISCORDBOTIMAGES_NAME"), publicURL), nil
+	case "filesystem":
+		return storage.NewFilesystemImageStorage(viper.GetString("IMAGE_STORAGE_PATH"), publicURL)
+	case "memory":
+		return storage.NewMemoryImageStorage(publicURL), nil
+	default:
+		return nil, fmt.Errorf("unknown IMAGE_STORAGE_BACKEND %q", backend)
+	}
+}
+
+// GetPromptStore reads persona prompt files from beneath PROMPTS_PREFIX in the PROMPTS_BUCKET S3 bucket if it's set,
+// or from the PROMPTS_PATH directory otherwise
+func GetPromptStore() storage.PromptStore {
+	if bucket := viper.GetString("PROMPTS_BUCKET"); bucket != "" {
+		return storage.NewS3PromptStore(GetAWSConfig(), bucket, viper.GetString("PROMPTS_PREFIX"), viper.GetDuration("PROMPTS_POLL_INTERVAL"))
+	}
+	return storage.NewDirectoryPromptStore(viper.GetString("PROMPTS_PATH"))
 }
 
 func GetLogger() *slog.Logger {
@@ -103,31 +237,3 @@ func GetDiscordSession() (*discordgo.Session, error) {
 	discordSession.Client.Transport = otelhttp.NewTransport(http.DefaultTransport)
 	return discordSession, nil
 }
-
-func GetOpenAISession() (*gpt.Client, error) {
-	authToken := viper.GetString("OPENAI_AUTH_TOKEN")
-	if authToken == "" {
-		return nil, fmt.Errorf("no authToken is present in configuration")
-	}
-
-	openaiCfg := gpt.DefaultConfig(authToken)
-	openaiCfg.HTTPClient = &http.Client{
-		Transport: otelhttp.NewTransport(http.DefaultTransport),
-	}
-	client := gpt.NewClientWithConfig(openaiCfg)
-
-	request := gpt.CompletionRequest{
-		Model:     gpt.GPT3Dot5TurboInstruct,
-		Prompt:    "are you alive?",
-		Suffix:    "",
-		MaxTokens: 5,
-	}
-	requestCtx, cancel := context.WithTimeout(context.Background(), time.Second*2)
-	defer cancel()
-	_, err := client.CreateCompletion(requestCtx, request)
-	if err != nil {
-		return nil, fmt.Errorf("openAPI client failed warmup request: %w", err)
-	}
-
-	return client, nil
-}
@@ -13,10 +13,12 @@ import (
 	"go.opentelemetry.io/contrib/detectors/aws/ecs"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/log/global"
 	"go.opentelemetry.io/otel/propagation"
 	otellog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/trace"
 )
 
@@ -67,8 +69,65 @@ func configureTracing(serviceCtx context.Context) error {
 	return nil
 }
 
+// configureMetrics sets up a meter provider that periodically exports to the sidecar collector, alongside the traces
+func configureMetrics(serviceCtx context.Context) error {
+	metricExporter, err := otlpmetricgrpc.New(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to create new OTLP metric exporter: %w", err)
+	}
+
+	// Configure some resource detection to get data about our operating environment
+	detectionCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	ec2Resource, _ := ec2ResourceDetector.Detect(detectionCtx)
+	ecsResource, _ := ecsResourceDetector.Detect(detectionCtx)
+
+	meterProvider := metric.NewMeterProvider(
+		metric.WithReader(metric.NewPeriodicReader(metricExporter, metric.WithInterval(viper.GetDuration("METRICS_INTERVAL")))),
+		metric.WithResource(ec2Resource),
+		metric.WithResource(ecsResource),
+	)
+	otel.SetMeterProvider(meterProvider)
+
+	// Shutting down the provider exports whatever was recorded since the last export
+	go func(lifecycleContext context.Context) {
+		<-lifecycleContext.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		defer cancel()
+		err := meterProvider.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Default().ErrorContext(serviceCtx, "Failed to flush metrics", slog.Any("error", err))
+		}
+	}(serviceCtx)
+
+	return nil
+}
+
 var programLevel = new(slog.LevelVar)
 
+// LogLevel is the level logs are written at, changing it takes effect straight away
+func LogLevel() *slog.LevelVar {
+	return programLevel
+}
+
+// levelHandler drops records below programLevel before they reach a handler that doesn't take a level of its own, like
+// the OpenTelemetry bridge
+type levelHandler struct {
+	slog.Handler
+}
+
+func (h levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= programLevel.Level() && h.Handler.Enabled(ctx, level)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name)}
+}
+
 // configureLogging sets up the logging system for the service, either local text, local json, or otlp based opentelemetry logging,
 // through the slog package, based on configuration from viper settings and OTLP environment variables
 func configureLogging(serviceCtx context.Context) error {
@@ -93,7 +152,7 @@ func configureLogging(serviceCtx context.Context) error {
 		)
 		global.SetLoggerProvider(provider)
 
-		logger = otelslog.NewLogger("openai-discord-bot")
+		logger = slog.New(levelHandler{otelslog.NewHandler("openai-discord-bot")})
 
 		// Rather than trying to return a shutdown function to main, call it based on the serviceContext being terminated
 		go func(lifecycleContext context.Context) {
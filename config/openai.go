@@ -0,0 +1,166 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	gpt "github.com/sashabaranov/go-openai"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// The kinds of API OPENAI_API_TYPE can pick between
+const (
+	// openaiAPIType is OpenAI itself
+	openaiAPIType = "openai"
+	// azureAPIType is Azure OpenAI, where models are deployments
+	azureAPIType = "azure"
+	// compatibleAPIType is anything else that speaks OpenAI's API, like llama.cpp's server or Ollama
+	compatibleAPIType = "compatible"
+)
+
+// probeTimeout is how long the startup probe waits, self-hosted servers can take a while to load a model
+const probeTimeout = time.Second * 10
+
+// GetOpenAISession connects to OpenAI, or whichever OpenAI compatible API is configured, and checks that it responds
+func GetOpenAISession() (*gpt.Client, error) {
+	apiType := viper.GetString("OPENAI_API_TYPE")
+	authToken := viper.GetString("OPENAI_AUTH_TOKEN")
+	baseURL := viper.GetString("OPENAI_BASE_URL")
+	// Model names are case-insensitive here, viper lower cases the keys of maps
+	aliases := viper.GetStringMapString("MODEL_ALIASES")
+
+	var openaiCfg gpt.ClientConfig
+	switch apiType {
+	case openaiAPIType:
+		if authToken == "" {
+			return nil, fmt.Errorf("no authToken is present in configuration")
+		}
+		openaiCfg = gpt.DefaultConfig(authToken)
+		if baseURL != "" {
+			openaiCfg.BaseURL = baseURL
+		}
+	case azureAPIType:
+		if authToken == "" || baseURL == "" {
+			return nil, fmt.Errorf("the azure API needs both OPENAI_AUTH_TOKEN and OPENAI_BASE_URL")
+		}
+		openaiCfg = gpt.DefaultAzureConfig(authToken, baseURL)
+		if apiVersion := viper.GetString("OPENAI_API_VERSION"); apiVersion != "" {
+			openaiCfg.APIVersion = apiVersion
+		}
+		// Aliases name the deployment a model is served from, anything else gets the deployment name Azure suggests
+		deploymentName := openaiCfg.AzureModelMapperFunc
+		openaiCfg.AzureModelMapperFunc = func(model string) string {
+			if alias, ok := aliases[strings.ToLower(model)]; ok {
+				return alias
+			}
+			return deploymentName(model)
+		}
+	case compatibleAPIType:
+		if baseURL == "" {
+			return nil, fmt.Errorf("a compatible API needs OPENAI_BASE_URL, like http://localhost:11434/v1")
+		}
+		// Self-hosted servers often don't check for a token at all
+		openaiCfg = gpt.DefaultConfig(authToken)
+		openaiCfg.BaseURL = baseURL
+	default:
+		return nil, fmt.Errorf("unknown OPENAI_API_TYPE %q", apiType)
+	}
+
+	var transport http.RoundTripper = otelhttp.NewTransport(http.DefaultTransport)
+	if len(aliases) > 0 && apiType != azureAPIType {
+		transport = modelAliasTransport{next: transport, aliases: aliases}
+	}
+	openaiCfg.HTTPClient = &http.Client{Transport: transport}
+	client := gpt.NewClientWithConfig(openaiCfg)
+
+	probeCtx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	chatModel := viper.GetString("CHAT_MODEL")
+	if alias, ok := aliases[strings.ToLower(chatModel)]; ok && apiType != azureAPIType {
+		chatModel = alias
+	}
+	err := probeOpenAI(probeCtx, client, chatModel, apiType != azureAPIType)
+	if err != nil {
+		return nil, fmt.Errorf("openAPI client failed warmup request: %w", err)
+	}
+
+	return client, nil
+}
+
+// probeOpenAI checks that the API responds, by listing its models. Not every compatible server can list models, so a
+// tiny chat completion will do instead. Azure lists the models it offers rather than the deployments that can be used,
+// so they're only checked for chatModel when checkModels is set
+func probeOpenAI(ctx context.Context, client *gpt.Client, chatModel string, checkModels bool) error {
+	logger := slog.Default().WithGroup("probeOpenAI")
+
+	models, err := client.ListModels(ctx)
+	if err == nil {
+		available := slices.ContainsFunc(models.Models, func(model gpt.Model) bool {
+			return model.ID == chatModel
+		})
+		if checkModels && !available {
+			logger.WarnContext(ctx, "the chat model isn't one the API lists, replies will probably fail", slog.String("model", chatModel), slog.Int("models", len(models.Models)))
+		}
+		return nil
+	}
+
+	logger.InfoContext(ctx, "couldn't list models, trying a chat completion instead", slog.Any("error", err))
+	_, chatErr := client.CreateChatCompletion(ctx, gpt.ChatCompletionRequest{
+		Model:     chatModel,
+		Messages:  []gpt.ChatCompletionMessage{{Role: gpt.ChatMessageRoleUser, Content: "are you alive?"}},
+		MaxTokens: 1,
+	})
+	if chatErr != nil {
+		return errors.Join(err, chatErr)
+	}
+	return nil
+}
+
+// modelAliasTransport swaps the models requested for the names the API knows them by. Only JSON requests name a model
+// this way, transcriptions are uploaded as forms and keep their model's name
+type modelAliasTransport struct {
+	next    http.RoundTripper
+	aliases map[string]string
+}
+
+func (t modelAliasTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return t.next.RoundTrip(r)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	var fields map[string]json.RawMessage
+	var model string
+	if json.Unmarshal(body, &fields) == nil && json.Unmarshal(fields["model"], &model) == nil {
+		if alias, ok := t.aliases[strings.ToLower(model)]; ok {
+			fields["model"], _ = json.Marshal(alias)
+			body, err = json.Marshal(fields)
+			if err != nil {
+				return nil, fmt.Errorf("failed to alias model %s: %w", model, err)
+			}
+		}
+	}
+
+	r = r.Clone(r.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"openai-discord-bot/bot/provider"
+)
+
+// GetProvider sets up each of the PROVIDERS in order, and routes calls to the first of them that's working. A provider
+// that can't be set up is left out, so long as there's another to use instead
+func GetProvider() (provider.Provider, error) {
+	logger := slog.Default().WithGroup("GetProvider")
+
+	var providers []provider.Provider
+	for _, name := range viper.GetStringSlice("PROVIDERS") {
+		var p provider.Provider
+		var err error
+		switch name {
+		case "openai":
+			p, err = getOpenAIProvider()
+		case "anthropic":
+			p, err = getAnthropicProvider()
+		default:
+			return nil, fmt.Errorf("unknown provider %q in PROVIDERS", name)
+		}
+		if err != nil {
+			logger.Error("leaving out a provider that couldn't be set up", slog.String("provider", name), slog.Any("error", err))
+			continue
+		}
+		providers = append(providers, p)
+	}
+
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("none of PROVIDERS %v could be set up", viper.GetStringSlice("PROVIDERS"))
+	}
+	return provider.NewRouter(providers, viper.GetInt("PROVIDER_FAILURE_THRESHOLD"), viper.GetDuration("PROVIDER_COOLDOWN")), nil
+}
+
+func getOpenAIProvider() (provider.Provider, error) {
+	client, err := GetOpenAISession()
+	if err != nil {
+		return nil, err
+	}
+	return provider.NewOpenAI(client), nil
+}
+
+func getAnthropicProvider() (provider.Provider, error) {
+	apiKey := viper.GetString("ANTHROPIC_API_KEY")
+	if apiKey == "" {
+		return nil, fmt.Errorf("ANTHROPIC_API_KEY must be defined")
+	}
+
+	httpClient := &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	return provider.NewAnthropic(apiKey, viper.GetString("ANTHROPIC_BASE_URL"), viper.GetString("ANTHROPIC_MODEL"), viper.GetInt("ANTHROPIC_MAX_TOKENS"), httpClient), nil
+}
@@ -14,6 +14,15 @@ import (
 )
 
 func main() {
+	// `render-prompt <file>` checks a prompt file and shows it rendered against sample data, without starting the bot
+	if len(os.Args) == 3 && os.Args[1] == "render-prompt" {
+		err := bot.RenderPromptFile(os.Args[2], os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	serviceCtx, cancel := context.WithCancel(context.Background())
 	config.Configure(serviceCtx)
 	logger := config.GetLogger()
@@ -23,43 +32,43 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to instantiate Discord client", err)
 	}
-	err = discordSession.Open()
+
+	logger.Info("connecting to AI providers")
+	aiProvider, err := config.GetProvider()
 	if err != nil {
+		log.Fatal("Failed to instantiate AI providers", slog.Any("error", err))
+	}
 
-		log.Fatal("Failed to connect to Discord", err)
+	conversationStorage, err := config.GetStorage(serviceCtx)
+	if err != nil {
+		log.Fatal("Failed to instantiate conversation storage", slog.Any("error", err))
 	}
-	defer func() {
-		err = discordSession.Close()
-		if err != nil {
-			logger.Error("Error closing Discord connection", slog.Any("error", err))
-		}
-	}()
 
-	logger.Info("connecting to OpenAI")
-	openapiClient, err := config.GetOpenAISession()
+	imageStorage, err := config.GetImageStorage()
 	if err != nil {
-		log.Fatal("Failed to instantiate OpenAPI client", slog.Any("error", err))
+		log.Fatal("Failed to instantiate image storage", slog.Any("error", err))
 	}
 
-	botInstance := bot.NewAIBot(serviceCtx, openapiClient, discordSession, config.GetStorage(), config.GetImageStorage())
+	botInstance := bot.NewAIBot(aiProvider, discordSession, conversationStorage, imageStorage, config.GetPromptStore())
+
+	// The bot runs until we're asked to stop, then finishes what it's doing
+	runCtx, stop := signal.NotifyContext(serviceCtx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	logger.Info("Starting bot")
-	err = botInstance.Go()
+	err = botInstance.Run(runCtx)
 	if err != nil {
-		log.Fatal("Failed to run the bot!", slog.Any("error", err))
+		logger.Error("Bot did not shut down cleanly", slog.Any("error", err))
+	} else {
+		logger.Info("Bot shut down")
 	}
 
-	stop := make(chan os.Signal)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
-
-	logger.Info("Gracefully shutting down")
-	botInstance.Shutdown()
-	time.Sleep(time.Second * 1)
-
 	// Terminate the service context, which should flush any open logs/traces/etc.
 	cancel()
 
-	// Give anything flushing from the system context, a few seconds to finish up, then exit
-	time.Sleep(time.Second * 5)
+	// The exporters get a couple of seconds to flush once the service context terminates, wait for them before exiting
+	time.Sleep(time.Second * 3)
+	if err != nil {
+		os.Exit(1)
+	}
 }